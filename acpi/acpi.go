@@ -0,0 +1,447 @@
+// Package acpi builds the ACPI tables describing the VM, which are found by
+// the guest kernel through RSDP in the BIOS area.
+//
+// refs: https://uefi.org/specs/ACPI/6.4/05_ACPI_Software_Programming_Model/ACPI_Software_Programming_Model.html
+package acpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	maxVCPUs = 64
+
+	// The addresses of the local APICs and the I/O APIC emulated by KVM.
+	lapicAddr  = 0xfee00000
+	ioapicAddr = 0xfec00000
+
+	oemID      = "GOKVM "
+	oemTableID = "GOKVMVM "
+	creatorID  = "GKVM"
+
+	// Entry types of MADT.
+	madtLocalAPIC         = 0
+	madtIOAPIC            = 1
+	madtInterruptOverride = 2
+
+	madtPCATCompat     = 1 // the dual 8259 PICs are present
+	lapicEnabled       = 1
+	irqActiveHighLevel = 0x000d
+
+	// IA-PC boot architecture flags of FADT.
+	bootArchLegacyDevices = 1 << 0
+	bootArch8042          = 1 << 1
+
+	// cmosCentury is the CMOS RAM index of the century of RTC.
+	cmosCentury = 0x32
+
+	// Feature flags of FADT.
+	fadtWBINVD      = 1 << 0
+	fadtSlpButton   = 1 << 5 // the sleep button is not a fixed feature
+	fadtResetRegSup = 1 << 10
+
+	gasSystemIO    = 1
+	gasAccessByte  = 1
+	gasAccessWord  = 2
+	gasAccessDWord = 3
+
+	tableAlign = 16
+
+	// The IO ports of the PCI configuration mechanism #1, 0xcf8-0xcff.
+	pciConfigPort = 0xcf8
+	pciConfigLen  = 8
+)
+
+var (
+	errorVCPUNumExceed = fmt.Errorf("the number of vCPUs must be less than or equal to %d", maxVCPUs)
+	errorTooLarge      = fmt.Errorf("ACPI tables do not fit in the area")
+)
+
+// Config is the platform described by the tables.
+type Config struct {
+	NumCPUs int
+
+	// SCI is the IRQ of the system control interrupt, which is wired to the
+	// same pin of the I/O APIC and is active high and level-triggered.
+	SCI uint8
+
+	// PCI is the PCI host bridge of bus 0.
+	PCI PCIConfig
+}
+
+// PCIConfig is the resources of the PCI host bridge, which are described in
+// DSDT so that the guest enumerates bus 0 with ACPI.
+type PCIConfig struct {
+	// The IO ports and the memory from base to limit, inclusive, where the
+	// BARs of the devices are placed. The IO window is omitted if IOLimit
+	// is less than IOBase.
+	IOBase, IOLimit   uint16
+	MemBase, MemLimit uint32
+
+	Routes []PCIRoute
+}
+
+// PCIRoute is the IRQ to which INTA# of the device in the slot is wired.
+// Linux makes it level-triggered and active low as _PRT tells.
+type PCIRoute struct {
+	Slot uint8
+	IRQ  uint32
+}
+
+type header struct {
+	Signature       [4]byte
+	Length          uint32
+	Revision        uint8
+	Checksum        uint8
+	OEMID           [6]byte
+	OEMTableID      [8]byte
+	OEMRevision     uint32
+	CreatorID       [4]byte
+	CreatorRevision uint32
+}
+
+// Root System Description Pointer for ACPI 2.0 and later.
+type rsdp struct {
+	Signature        [8]byte
+	Checksum         uint8
+	OEMID            [6]byte
+	Revision         uint8
+	RSDTAddress      uint32
+	Length           uint32
+	XSDTAddress      uint64
+	ExtendedChecksum uint8
+	_                [3]uint8
+}
+
+// Generic Address Structure.
+type gas struct {
+	SpaceID    uint8
+	BitWidth   uint8
+	BitOffset  uint8
+	AccessSize uint8
+	Address    uint64
+}
+
+// Fixed ACPI Description Table, revision 6, without the header.
+type fadt struct {
+	FirmwareCtrl       uint32
+	DSDT               uint32
+	_                  uint8
+	PreferredPMProfile uint8
+	SCIInt             uint16
+	SMICmd             uint32
+	ACPIEnable         uint8
+	ACPIDisable        uint8
+	S4BIOSReq          uint8
+	PStateCnt          uint8
+	PM1aEvtBlk         uint32
+	PM1bEvtBlk         uint32
+	PM1aCntBlk         uint32
+	PM1bCntBlk         uint32
+	PM2CntBlk          uint32
+	PMTmrBlk           uint32
+	GPE0Blk            uint32
+	GPE1Blk            uint32
+	PM1EvtLen          uint8
+	PM1CntLen          uint8
+	PM2CntLen          uint8
+	PMTmrLen           uint8
+	GPE0BlkLen         uint8
+	GPE1BlkLen         uint8
+	GPE1Base           uint8
+	CstCnt             uint8
+	PLvl2Lat           uint16
+	PLvl3Lat           uint16
+	FlushSize          uint16
+	FlushStride        uint16
+	DutyOffset         uint8
+	DutyWidth          uint8
+	DayAlrm            uint8
+	MonAlrm            uint8
+	Century            uint8
+	IAPCBootArch       uint16
+	_                  uint8
+	Flags              uint32
+	ResetReg           gas
+	ResetValue         uint8
+	ARMBootArch        uint16
+	MinorVersion       uint8
+	XFirmwareCtrl      uint64
+	XDSDT              uint64
+	XPM1aEvtBlk        gas
+	XPM1bEvtBlk        gas
+	XPM1aCntBlk        gas
+	XPM1bCntBlk        gas
+	XPM2CntBlk         gas
+	XPMTmrBlk          gas
+	XGPE0Blk           gas
+	XGPE1Blk           gas
+	SleepControlReg    gas
+	SleepStatusReg     gas
+	HypervisorVendorID uint64
+}
+
+type madtLAPIC struct {
+	Type         uint8
+	Length       uint8
+	ProcessorUID uint8
+	APICID       uint8
+	Flags        uint32
+}
+
+type madtIOAPICEntry struct {
+	Type     uint8
+	Length   uint8
+	IOAPICID uint8
+	_        uint8
+	Address  uint32
+	GSIBase  uint32
+}
+
+type madtOverride struct {
+	Type   uint8
+	Length uint8
+	Bus    uint8
+	Source uint8
+	GSI    uint32
+	Flags  uint16
+}
+
+// Tables is the set of the ACPI tables placed at a fixed guest physical
+// address, with RSDP first.
+type Tables struct {
+	base uint32
+	buf  []byte
+}
+
+// New builds the tables to be placed at base, which must be 16-byte aligned
+// and within 0xe0000-0xfffff where the guest searches for RSDP.
+func New(base uint32, c Config) (*Tables, error) {
+	if c.NumCPUs > maxVCPUs {
+		return nil, errorVCPUNumExceed
+	}
+
+	t := &Tables{base: base}
+
+	// RSDP is filled last, since it points to the other tables.
+	rsdpAddr := t.place(make([]byte, binary.Size(rsdp{})))
+
+	dsdt, err := table("DSDT", 2, dsdtAML(c.PCI))
+	if err != nil {
+		return nil, err
+	}
+
+	dsdtAddr := t.place(dsdt)
+
+	madt, err := newMADT(c)
+	if err != nil {
+		return nil, err
+	}
+
+	madtAddr := t.place(madt)
+
+	fadt, err := newFADT(c, dsdtAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fadtAddr := t.place(fadt)
+
+	xsdt, err := table("XSDT", 1, []uint64{uint64(fadtAddr), uint64(madtAddr)})
+	if err != nil {
+		return nil, err
+	}
+
+	xsdtAddr := t.place(xsdt)
+
+	rsdt, err := table("RSDT", 1, []uint32{fadtAddr, madtAddr})
+	if err != nil {
+		return nil, err
+	}
+
+	rsdtAddr := t.place(rsdt)
+
+	p := rsdp{Revision: 2, RSDTAddress: rsdtAddr, XSDTAddress: uint64(xsdtAddr)}
+	copy(p.Signature[:], "RSD PTR ")
+	copy(p.OEMID[:], oemID)
+	p.Length = uint32(binary.Size(p))
+
+	b, err := encode(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksum of ACPI 1.0 covers the first 20 bytes, and the extended
+	// one covers the whole.
+	b[8] = checksum(b[:20])
+	b[32] = checksum(b)
+
+	copy(t.buf[rsdpAddr-base:], b)
+
+	return t, nil
+}
+
+// Bytes returns the tables, which are at most size bytes.
+func (t *Tables) Bytes(size int) ([]byte, error) {
+	if len(t.buf) > size {
+		return nil, fmt.Errorf("%w: 0x%x bytes", errorTooLarge, len(t.buf))
+	}
+
+	return t.buf, nil
+}
+
+// place appends the table aligned, and returns its address.
+func (t *Tables) place(b []byte) uint32 {
+	for len(t.buf)%tableAlign != 0 {
+		t.buf = append(t.buf, 0)
+	}
+
+	addr := t.base + uint32(len(t.buf))
+	t.buf = append(t.buf, b...)
+
+	return addr
+}
+
+func encode(data ...interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	for _, d := range data {
+		if err := binary.Write(buf, binary.LittleEndian, d); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// checksum returns the byte which makes the sum of b zero, where the byte of
+// the checksum itself in b is zero.
+func checksum(b []byte) uint8 {
+	sum := uint8(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	return -sum
+}
+
+// table returns the table with the header followed by the body.
+func table(signature string, revision uint8, body ...interface{}) ([]byte, error) {
+	h := header{Revision: revision, OEMRevision: 1, CreatorRevision: 1}
+	copy(h.Signature[:], signature)
+	copy(h.OEMID[:], oemID)
+	copy(h.OEMTableID[:], oemTableID)
+	copy(h.CreatorID[:], creatorID)
+
+	b, err := encode(append([]interface{}{h}, body...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	b[9] = checksum(b)
+
+	return b, nil
+}
+
+// newMADT returns Multiple APIC Description Table, which lists the local APIC
+// of each vCPU and the I/O APIC. The IRQs other than SCI are identity-mapped
+// to the pins of the I/O APIC with the ISA defaults.
+func newMADT(c Config) ([]byte, error) {
+	entries := []interface{}{uint32(lapicAddr), uint32(madtPCATCompat)}
+
+	for i := 0; i < c.NumCPUs; i++ {
+		entries = append(entries, madtLAPIC{
+			Type: madtLocalAPIC, Length: 8, ProcessorUID: uint8(i), APICID: uint8(i), Flags: lapicEnabled,
+		})
+	}
+
+	entries = append(entries,
+		madtIOAPICEntry{Type: madtIOAPIC, Length: 12, Address: ioapicAddr},
+		madtOverride{
+			Type: madtInterruptOverride, Length: 10, Source: c.SCI, GSI: uint32(c.SCI), Flags: irqActiveHighLevel,
+		},
+	)
+
+	return table("APIC", 4, entries...)
+}
+
+// newFADT returns Fixed ACPI Description Table, which points to the fixed
+// hardware emulated by PM. SMI_CMD is zero, which means that the system is
+// always in the ACPI mode.
+func newFADT(c Config, dsdtAddr uint32) ([]byte, error) {
+	f := fadt{
+		DSDT:         dsdtAddr,
+		SCIInt:       uint16(c.SCI),
+		PM1aEvtBlk:   PM1EventBlock,
+		PM1aCntBlk:   PM1ControlBlock,
+		PM1EvtLen:    pm1EventLen,
+		PM1CntLen:    pm1ControlLen,
+		Century:      cmosCentury,
+		IAPCBootArch: bootArchLegacyDevices | bootArch8042,
+		Flags:        fadtWBINVD | fadtSlpButton | fadtResetRegSup,
+		ResetReg:     ioGAS(ResetRegister, 1, gasAccessByte),
+		ResetValue:   ResetValue,
+		XDSDT:        uint64(dsdtAddr),
+		XPM1aEvtBlk:  ioGAS(PM1EventBlock, pm1EventLen, gasAccessDWord),
+		XPM1aCntBlk:  ioGAS(PM1ControlBlock, pm1ControlLen, gasAccessWord),
+	}
+
+	return table("FACP", 6, f)
+}
+
+func ioGAS(port uint64, length, accessSize uint8) gas {
+	return gas{SpaceID: gasSystemIO, BitWidth: length * 8, AccessSize: accessSize, Address: port}
+}
+
+// dsdtAML returns the definition block of DSDT, which is
+//
+//	Name (_S5, Package () { 5, 5, 0, 0 })
+//	Scope (\_SB) {
+//		Device (PCI0) {
+//			Name (_HID, EISAID ("PNP0A03"))
+//			Name (_UID, 0)
+//			Name (_CRS, ResourceTemplate () { ... })
+//			Name (_PRT, Package () { ... })
+//		}
+//	}
+//
+// to tell SLP_TYP for S5 and the PCI host bridge to the guest. Linux finds
+// the PCI root buses only in the namespace when ACPI is enabled.
+func dsdtAML(c PCIConfig) []byte {
+	s5 := amlName("_S5_", amlPackage(
+		amlInteger(slpTypS5), amlInteger(slpTypS5), amlInteger(0), amlInteger(0),
+	))
+
+	// Bus 0, the configuration ports and the windows for the BARs.
+	crs := resWord(resTypeBus, 0, 0, 0)
+	crs = append(crs, resIOPort(pciConfigPort, pciConfigLen)...)
+
+	if c.IOBase <= c.IOLimit {
+		crs = append(crs, resWord(resTypeIO, resIOEntireRange, c.IOBase, c.IOLimit)...)
+	}
+
+	crs = append(crs, resDWordMem(c.MemBase, c.MemLimit)...)
+	crs = append(crs, resEndTag, 0)
+
+	// Package () { Address, Pin, Source, Source Index } of each slot,
+	// where the address is the slot with any function and the source 0
+	// means that the index is GSI.
+	prt := [][]byte{}
+	for _, r := range c.Routes {
+		prt = append(prt, amlPackage(
+			amlInteger(uint64(r.Slot)<<16|0xffff), amlInteger(0), amlInteger(0), amlInteger(uint64(r.IRQ)),
+		))
+	}
+
+	pci0 := amlDevice("PCI0",
+		amlName("_HID", amlInteger(uint64(eisaID("PNP0A03")))),
+		amlName("_UID", amlInteger(0)),
+		amlName("_CRS", amlBuffer(crs)),
+		amlName("_PRT", amlPackage(prt...)),
+	)
+
+	return append(s5, amlScope("_SB_", pci0)...)
+}
@@ -0,0 +1,254 @@
+package acpi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+const base = 0xe0000
+
+func sum(b []byte) uint8 {
+	s := uint8(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
+
+// table returns the table at the address, checking its checksum.
+func table(t *testing.T, b []byte, addr uint64, signature string) []byte {
+	t.Helper()
+
+	b = b[addr-base:]
+
+	if string(b[:4]) != signature {
+		t.Fatalf("invalid signature at 0x%x: %q, want %q", addr, b[:4], signature)
+	}
+
+	b = b[:binary.LittleEndian.Uint32(b[4:])]
+
+	if sum(b) != 0 {
+		t.Fatalf("invalid checksum of %s", signature)
+	}
+
+	return b
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	tables, err := acpi.New(base, acpi.Config{NumCPUs: 4, SCI: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := tables.Bytes(0x10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b[:8]) != "RSD PTR " || sum(b[:20]) != 0 || sum(b[:36]) != 0 {
+		t.Fatal("invalid RSDP")
+	}
+
+	rsdt := table(t, b, uint64(binary.LittleEndian.Uint32(b[16:])), "RSDT")
+	xsdt := table(t, b, binary.LittleEndian.Uint64(b[24:]), "XSDT")
+
+	if len(rsdt) != 36+4*2 || len(xsdt) != 36+8*2 {
+		t.Fatalf("invalid number of entries: RSDT %d bytes, XSDT %d bytes", len(rsdt), len(xsdt))
+	}
+
+	fadt := table(t, b, binary.LittleEndian.Uint64(xsdt[36:]), "FACP")
+	madt := table(t, b, binary.LittleEndian.Uint64(xsdt[44:]), "APIC")
+
+	if len(fadt) != 276 {
+		t.Fatalf("invalid size of FADT: %d", len(fadt))
+	}
+
+	if sci := binary.LittleEndian.Uint16(fadt[46:]); sci != 5 {
+		t.Fatalf("invalid SCI: %d", sci)
+	}
+
+	evt, cnt := binary.LittleEndian.Uint32(fadt[56:]), binary.LittleEndian.Uint32(fadt[64:])
+	if evt != acpi.PM1EventBlock || cnt != acpi.PM1ControlBlock {
+		t.Fatalf("invalid PM1 blocks: 0x%x, 0x%x", evt, cnt)
+	}
+
+	if century := fadt[108]; century != 0x32 {
+		t.Fatalf("invalid century: 0x%x", century)
+	}
+
+	dsdt := table(t, b, uint64(binary.LittleEndian.Uint32(fadt[40:])), "DSDT")
+
+	if string(dsdt[37:41]) != "_S5_" {
+		t.Fatalf("invalid DSDT: %x", dsdt[36:])
+	}
+
+	// header, local APIC address and flags, 4 local APICs, I/O APIC and an
+	// interrupt source override
+	if len(madt) != 44+4*8+12+10 {
+		t.Fatalf("invalid size of MADT: %d", len(madt))
+	}
+
+	if _, err := tables.Bytes(len(b) - 1); err == nil {
+		t.Fatal("tables larger than the area should be an error")
+	}
+
+	if _, err := acpi.New(base, acpi.Config{NumCPUs: 65}); err == nil {
+		t.Fatal("too many vCPUs should be an error")
+	}
+}
+
+// pkgLength splits the object at b, which starts with PkgLength, into its
+// body and the rest.
+func pkgLength(t *testing.T, b []byte) ([]byte, []byte) {
+	t.Helper()
+
+	extra := int(b[0] >> 6)
+	n := int(b[0] & 0x3f)
+
+	if extra > 0 {
+		n &= 0xf
+		for i := 0; i < extra; i++ {
+			n |= int(b[1+i]) << (4 + 8*i)
+		}
+	}
+
+	if n > len(b) {
+		t.Fatalf("invalid PkgLength %d of %d bytes", n, len(b))
+	}
+
+	return b[1+extra : n], b[n:]
+}
+
+// amlObject splits the data object at b into itself and the rest, where the
+// integers are decoded into v.
+func amlObject(t *testing.T, b []byte) (obj []byte, v uint64, rest []byte) {
+	t.Helper()
+
+	switch b[0] {
+	case 0x00, 0x01:
+		return b[:1], uint64(b[0]), b[1:]
+	case 0x0a:
+		return b[:2], uint64(b[1]), b[2:]
+	case 0x0b:
+		return b[:3], uint64(binary.LittleEndian.Uint16(b[1:])), b[3:]
+	case 0x0c:
+		return b[:5], uint64(binary.LittleEndian.Uint32(b[1:])), b[5:]
+	case 0x11, 0x12:
+		body, rest := pkgLength(t, b[1:])
+
+		return body, 0, rest
+	}
+
+	t.Fatalf("unknown object: %x", b)
+
+	return nil, 0, nil
+}
+
+func TestDSDTHostBridge(t *testing.T) {
+	t.Parallel()
+
+	tables, err := acpi.New(base, acpi.Config{NumCPUs: 1, SCI: 5, PCI: acpi.PCIConfig{
+		IOBase: 0x6200, IOLimit: 0x67ff, MemBase: 0xc0000000, MemLimit: 0xfebfffff,
+		Routes: []acpi.PCIRoute{{Slot: 1, IRQ: 9}, {Slot: 2, IRQ: 10}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := tables.Bytes(0x10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xsdt := table(t, b, binary.LittleEndian.Uint64(b[24:]), "XSDT")
+	fadt := table(t, b, binary.LittleEndian.Uint64(xsdt[36:]), "FACP")
+	aml := table(t, b, uint64(binary.LittleEndian.Uint32(fadt[40:])), "DSDT")[36:]
+
+	// Name (_S5, Package ()) is followed by Scope (\_SB).
+	if aml[0] != 0x08 || string(aml[1:5]) != "_S5_" || aml[5] != 0x12 {
+		t.Fatalf("invalid _S5: %x", aml)
+	}
+
+	_, rest := pkgLength(t, aml[6:])
+
+	if rest[0] != 0x10 {
+		t.Fatalf("invalid scope: %x", rest)
+	}
+
+	scope, rest := pkgLength(t, rest[1:])
+	if len(rest) != 0 || string(scope[:5]) != "\\_SB_" || scope[5] != 0x5b || scope[6] != 0x82 {
+		t.Fatalf("invalid scope: %x", scope)
+	}
+
+	dev, rest := pkgLength(t, scope[7:])
+	if len(rest) != 0 || string(dev[:4]) != "PCI0" {
+		t.Fatalf("invalid device: %x", dev)
+	}
+
+	names := map[string][]byte{}
+	values := map[string]uint64{}
+
+	for rest = dev[4:]; len(rest) > 0; {
+		if rest[0] != 0x08 {
+			t.Fatalf("invalid name: %x", rest)
+		}
+
+		name := string(rest[1:5])
+		names[name], values[name], rest = amlObject(t, rest[5:])
+	}
+
+	if values["_HID"] != 0x030ad041 {
+		t.Fatalf("invalid _HID: 0x%x", values["_HID"])
+	}
+
+	// The buffer of _CRS starts with its size.
+	_, size, crs := amlObject(t, names["_CRS"])
+	if int(size) != len(crs) || !bytes.HasSuffix(crs, []byte{0x79, 0}) {
+		t.Fatalf("invalid _CRS: %x", names["_CRS"])
+	}
+
+	for _, r := range [][]byte{
+		{0x88, 0x0d, 0, 2, 0x0c, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0},
+		{0x47, 1, 0xf8, 0x0c, 0xf8, 0x0c, 1, 8},
+		{0x88, 0x0d, 0, 1, 0x0c, 3, 0, 0, 0x00, 0x62, 0xff, 0x67, 0, 0, 0x00, 0x06},
+		{
+			0x87, 0x17, 0, 0, 0x0c, 1, 0, 0, 0, 0, 0, 0, 0, 0xc0, 0xff, 0xff, 0xbf, 0xfe,
+			0, 0, 0, 0, 0, 0, 0xc0, 0x3e,
+		},
+	} {
+		if !bytes.Contains(crs, r) {
+			t.Fatalf("_CRS does not have %x: %x", r, crs)
+		}
+	}
+
+	prt := names["_PRT"]
+	if prt[0] != 2 {
+		t.Fatalf("invalid number of _PRT entries: %d", prt[0])
+	}
+
+	expected := [][4]uint64{{0x1ffff, 0, 0, 9}, {0x2ffff, 0, 0, 10}}
+
+	for rest, i := prt[1:], 0; len(rest) > 0; i++ {
+		var entry []byte
+
+		entry, _, rest = amlObject(t, rest)
+		if entry[0] != 4 {
+			t.Fatalf("invalid _PRT entry: %x", entry)
+		}
+
+		actual := [4]uint64{}
+		for j, e := 0, entry[1:]; j < 4; j++ {
+			_, actual[j], e = amlObject(t, e)
+		}
+
+		if actual != expected[i] {
+			t.Fatalf("unexpected _PRT entry %d: %x", i, actual)
+		}
+	}
+}
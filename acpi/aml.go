@@ -0,0 +1,186 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+// Opcodes and prefixes of AML.
+//
+// refs: https://uefi.org/specs/ACPI/6.4/20_AML_Specification/AML_Specification.html
+const (
+	amlZeroOp      = 0x00
+	amlOneOp       = 0x01
+	amlNameOp      = 0x08
+	amlBytePrefix  = 0x0a
+	amlWordPrefix  = 0x0b
+	amlDWordPrefix = 0x0c
+	amlQWordPrefix = 0x0e
+	amlScopeOp     = 0x10
+	amlBufferOp    = 0x11
+	amlPackageOp   = 0x12
+	amlExtOpPrefix = 0x5b
+	amlDeviceOp    = 0x82 // following amlExtOpPrefix
+	amlRootChar    = '\\'
+)
+
+// Tags of the resource descriptors in _CRS.
+const (
+	resIO          = 0x47 // small item of the IO port descriptor, 8 bytes
+	resEndTag      = 0x79 // small item of the end tag, 2 bytes
+	resDWordMemory = 0x87
+	resWordAddress = 0x88
+
+	// Resource types of the address space descriptors.
+	resTypeMemory = 0
+	resTypeIO     = 1
+	resTypeBus    = 2
+
+	// The general flags for the range produced by the bridge, whose minimum
+	// and maximum addresses are fixed.
+	resProducerFixed = 0x0c
+
+	resIODecode16    = 0x01
+	resIOEntireRange = 0x03
+	resMemReadWrite  = 0x01
+)
+
+// amlPkgLength returns the object with PkgLength before body, which counts
+// the bytes of PkgLength itself.
+func amlPkgLength(body []byte) []byte {
+	n := len(body) + 1
+	if n <= 0x3f {
+		return append([]byte{uint8(n)}, body...)
+	}
+
+	// The lead byte has the number of the following bytes in bits 6-7 and
+	// the least significant 4 bits of the length.
+	for extra := 1; extra <= 3; extra++ {
+		n = len(body) + 1 + extra
+		if n < 1<<(4+8*extra) {
+			b := []byte{uint8(extra<<6 | n&0xf)}
+			for i := 0; i < extra; i++ {
+				b = append(b, uint8(n>>(4+8*i)))
+			}
+
+			return append(b, body...)
+		}
+	}
+
+	panic("AML object is too large")
+}
+
+// amlInteger returns the shortest encoding of the integer.
+func amlInteger(v uint64) []byte {
+	switch {
+	case v == 0:
+		return []byte{amlZeroOp}
+	case v == 1:
+		return []byte{amlOneOp}
+	case v <= 0xff:
+		return []byte{amlBytePrefix, uint8(v)}
+	case v <= 0xffff:
+		b := []byte{amlWordPrefix, 0, 0}
+		binary.LittleEndian.PutUint16(b[1:], uint16(v))
+
+		return b
+	case v <= 0xffffffff:
+		b := []byte{amlDWordPrefix, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(b[1:], uint32(v))
+
+		return b
+	}
+
+	b := []byte{amlQWordPrefix, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(b[1:], v)
+
+	return b
+}
+
+// amlName returns Name (name, object), where name is a NameSeg of 4
+// characters.
+func amlName(name string, object []byte) []byte {
+	return append(append([]byte{amlNameOp}, name...), object...)
+}
+
+// amlScope returns Scope (\name) { body }.
+func amlScope(name string, body ...[]byte) []byte {
+	b := append([]byte{amlRootChar}, name...)
+
+	return append([]byte{amlScopeOp}, amlPkgLength(append(b, concat(body)...))...)
+}
+
+// amlDevice returns Device (name) { body }.
+func amlDevice(name string, body ...[]byte) []byte {
+	b := append([]byte(name), concat(body)...)
+
+	return append([]byte{amlExtOpPrefix, amlDeviceOp}, amlPkgLength(b)...)
+}
+
+// amlBuffer returns Buffer () { data }.
+func amlBuffer(data []byte) []byte {
+	b := append(amlInteger(uint64(len(data))), data...)
+
+	return append([]byte{amlBufferOp}, amlPkgLength(b)...)
+}
+
+// amlPackage returns Package () { elements }.
+func amlPackage(elements ...[]byte) []byte {
+	b := append([]byte{uint8(len(elements))}, concat(elements)...)
+
+	return append([]byte{amlPackageOp}, amlPkgLength(b)...)
+}
+
+// eisaID returns EISAID (id) for the ID like "PNP0A03", where the 3 letters
+// are compressed into 5 bits each and the value is big endian.
+func eisaID(id string) uint32 {
+	v := uint32(id[0]-'@')<<26 | uint32(id[1]-'@')<<21 | uint32(id[2]-'@')<<16
+
+	for i := 3; i < 7; i++ {
+		c := uint32(id[i] - '0')
+		if id[i] >= 'A' {
+			c = uint32(id[i]-'A') + 10
+		}
+
+		v |= c << (4 * (6 - i))
+	}
+
+	return v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24
+}
+
+func concat(b [][]byte) []byte {
+	r := []byte{}
+	for _, x := range b {
+		r = append(r, x...)
+	}
+
+	return r
+}
+
+// resWord returns Word Address Space Descriptor of the range from min to max
+// produced by the bridge.
+func resWord(typ, flags uint8, min, max uint16) []byte {
+	b := []byte{resWordAddress, 0x0d, 0x00, typ, resProducerFixed, flags, 0, 0}
+	b = append(b, uint8(min), uint8(min>>8), uint8(max), uint8(max>>8), 0, 0)
+
+	length := max - min + 1
+
+	return append(b, uint8(length), uint8(length>>8))
+}
+
+// resDWordMem returns DWord Address Space Descriptor of the memory from min to
+// max produced by the bridge.
+func resDWordMem(min, max uint32) []byte {
+	b := []byte{resDWordMemory, 0x17, 0x00, resTypeMemory, resProducerFixed, resMemReadWrite}
+
+	for _, v := range []uint32{0, min, max, 0, max - min + 1} {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], v)
+	}
+
+	return b
+}
+
+// resIOPort returns IO Port Descriptor of the fixed ports.
+func resIOPort(port uint16, length uint8) []byte {
+	return []byte{resIO, resIODecode16, uint8(port), uint8(port >> 8), uint8(port), uint8(port >> 8), 1, length}
+}
@@ -0,0 +1,188 @@
+package acpi
+
+import "sync"
+
+// I/O ports of the fixed hardware, which are described in FADT.
+const (
+	PM1EventBlock   = 0x600 // PM1_STS (2 bytes) and PM1_EN (2 bytes)
+	PM1ControlBlock = 0x604 // PM1_CNT (2 bytes)
+	ResetRegister   = 0x606
+
+	pm1EventLen   = 4
+	pm1ControlLen = 2
+
+	// ResetValue is written to ResetRegister to reset the system.
+	ResetValue = 1
+
+	// slpTypS5 is SLP_TYP for S5 (soft off), which is given by \_S5 in DSDT.
+	slpTypS5 = 5
+)
+
+// Bits of the PM1 registers.
+const (
+	pm1PwrBtnSts = 1 << 8
+
+	pm1SCIEn       = 1 << 0
+	pm1SlpTypShift = 10
+	pm1SlpTypMask  = 7 << pm1SlpTypShift
+	pm1SlpEn       = 1 << 13
+)
+
+// Platform is the VM which the PM device controls.
+type Platform interface {
+	// SetSCI sets the level of the system control interrupt.
+	SetSCI(level bool)
+
+	// PowerOff is called when the guest enters S5.
+	PowerOff()
+
+	// Reset is called when the guest writes the reset register.
+	Reset()
+}
+
+// PM emulates the PM1 event and control blocks and the reset register of the
+// ACPI fixed hardware. The system is always in the ACPI mode, so SCI_EN is
+// fixed to 1.
+type PM struct {
+	mu sync.Mutex
+
+	sts uint16
+	en  uint16
+	cnt uint16
+
+	sciLevel bool
+
+	platform Platform
+}
+
+func NewPM(platform Platform) *PM {
+	return &PM{cnt: pm1SCIEn, platform: platform}
+}
+
+// PMState is the state of PM saved in a snapshot of the VM.
+type PMState struct {
+	Sts, En, Cnt uint16
+}
+
+func (p *PM) State() PMState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PMState{Sts: p.sts, En: p.en, Cnt: p.cnt}
+}
+
+func (p *PM) SetState(s PMState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sts, p.en, p.cnt = s.Sts, s.En, s.Cnt
+
+	// The line may be already high in the restored interrupt controller.
+	p.sciLevel = p.sts&p.en != 0
+}
+
+// PressPowerButton raises the power button event, on which the guest is
+// expected to shut down.
+func (p *PM) PressPowerButton() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sts |= pm1PwrBtnSts
+	p.updateSCI()
+}
+
+func (p *PM) updateSCI() {
+	level := p.sts&p.en != 0
+	if level == p.sciLevel {
+		return
+	}
+
+	p.sciLevel = level
+	p.platform.SetSCI(level)
+}
+
+// In reads the registers byte by byte, since the 16-bit registers may be
+// accessed by 8 bits or together by 32 bits.
+func (p *PM) In(port uint64, values []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range values {
+		values[i] = p.inByte(port + uint64(i))
+	}
+
+	return nil
+}
+
+func (p *PM) Out(port uint64, values []byte) error {
+	p.mu.Lock()
+
+	for i := range values {
+		p.outByte(port+uint64(i), values[i])
+	}
+
+	p.updateSCI()
+
+	// The callbacks are called without the lock, since they may take time,
+	// e.g. to reset the VM including this device.
+	cnt := p.cnt
+	p.cnt &^= pm1SlpEn
+	p.mu.Unlock()
+
+	switch {
+	case cnt&pm1SlpEn != 0 && (cnt&pm1SlpTypMask)>>pm1SlpTypShift == slpTypS5:
+		p.platform.PowerOff()
+	case port == ResetRegister && values[0] == ResetValue:
+		p.platform.Reset()
+	}
+
+	return nil
+}
+
+func byteOf(reg uint16, hi bool) byte {
+	if hi {
+		return byte(reg >> 8)
+	}
+
+	return byte(reg)
+}
+
+func setByte(reg *uint16, hi bool, b byte) {
+	if hi {
+		*reg = *reg&0x00ff | uint16(b)<<8
+	} else {
+		*reg = *reg&0xff00 | uint16(b)
+	}
+}
+
+func (p *PM) inByte(port uint64) byte {
+	hi := port%2 == 1
+
+	switch port &^ 1 {
+	case PM1EventBlock:
+		return byteOf(p.sts, hi)
+	case PM1EventBlock + 2:
+		return byteOf(p.en, hi)
+	case PM1ControlBlock:
+		return byteOf(p.cnt, hi)
+	}
+
+	return 0
+}
+
+func (p *PM) outByte(port uint64, b byte) {
+	hi := port%2 == 1
+
+	switch port &^ 1 {
+	case PM1EventBlock:
+		// The status bits are cleared by writing 1.
+		clear := uint16(0)
+		setByte(&clear, hi, b)
+		p.sts &^= clear
+	case PM1EventBlock + 2:
+		setByte(&p.en, hi, b)
+	case PM1ControlBlock:
+		setByte(&p.cnt, hi, b)
+		p.cnt |= pm1SCIEn
+	}
+}
@@ -0,0 +1,115 @@
+package acpi_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+type mockPlatform struct {
+	sci      bool
+	poweroff bool
+	reset    bool
+}
+
+func (p *mockPlatform) SetSCI(level bool) {
+	p.sci = level
+}
+
+func (p *mockPlatform) PowerOff() {
+	p.poweroff = true
+}
+
+func (p *mockPlatform) Reset() {
+	p.reset = true
+}
+
+func TestPowerButton(t *testing.T) {
+	t.Parallel()
+
+	p := &mockPlatform{}
+	pm := acpi.NewPM(p)
+
+	// The event is not signaled until it is enabled.
+	pm.PressPowerButton()
+
+	if p.sci {
+		t.Fatal("SCI is raised for a disabled event")
+	}
+
+	if err := pm.Out(acpi.PM1EventBlock+2, []byte{0x00, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.sci {
+		t.Fatal("SCI is not raised")
+	}
+
+	sts := []byte{0, 0, 0, 0}
+	if err := pm.In(acpi.PM1EventBlock, sts); err != nil {
+		t.Fatal(err)
+	}
+
+	if sts[1] != 0x01 || sts[3] != 0x01 {
+		t.Fatalf("unexpected PM1 event block: %v", sts)
+	}
+
+	state := pm.State()
+
+	// The status is cleared by writing 1.
+	if err := pm.Out(acpi.PM1EventBlock, []byte{0x00, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.sci {
+		t.Fatal("SCI is not lowered")
+	}
+
+	restored := acpi.NewPM(&mockPlatform{})
+	restored.SetState(state)
+
+	if restored.State() != state {
+		t.Fatalf("state is not restored: %+v", restored.State())
+	}
+}
+
+func TestSleepAndReset(t *testing.T) {
+	t.Parallel()
+
+	p := &mockPlatform{}
+	pm := acpi.NewPM(p)
+
+	cnt := []byte{0, 0}
+	if err := pm.In(acpi.PM1ControlBlock, cnt); err != nil {
+		t.Fatal(err)
+	}
+
+	if cnt[0]&1 == 0 {
+		t.Fatal("SCI_EN is not set")
+	}
+
+	// SLP_TYP without SLP_EN does nothing.
+	if err := pm.Out(acpi.PM1ControlBlock, []byte{0x01, 5 << 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.poweroff {
+		t.Fatal("powered off without SLP_EN")
+	}
+
+	if err := pm.Out(acpi.PM1ControlBlock, []byte{0x01, 5<<2 | 0x20}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.poweroff {
+		t.Fatal("not powered off")
+	}
+
+	if err := pm.Out(acpi.ResetRegister, []byte{acpi.ResetValue}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.reset {
+		t.Fatal("not reset")
+	}
+}
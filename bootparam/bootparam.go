@@ -20,10 +20,12 @@ const (
 	E820Max      = 128
 	E820Ram      = 1
 	E820Reserved = 2
+	E820ACPI     = 3
 
 	RealModeIvtBegin = 0x00000000
 	EBDAStart        = 0x0009fc00
 	VGARAMBegin      = 0x000a0000
+	ACPITablesBegin  = 0x000e0000
 	MBBIOSBegin      = 0x000f0000
 	MBBIOSEnd        = 0x000fffff
 )
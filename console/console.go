@@ -0,0 +1,239 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/term"
+)
+
+var ErrInvalidSpec = errors.New("invalid console backend")
+
+// Open opens the host side of a serial port specified by spec, which is one
+// of the following. The returned reader is nil if the backend has no input.
+//
+//	stdio      the standard input and output
+//	null       discard the output
+//	file:PATH  append the output to the file
+//	unix:PATH  listen on the unix domain socket and talk to the last client
+//	pty        allocate a pseudo terminal, whose name is printed to stderr
+func Open(spec string) (io.Writer, io.Reader, error) {
+	typ, path := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		typ, path = spec[:i], spec[i+1:]
+	}
+
+	switch {
+	case typ == "stdio" && path == "":
+		return os.Stdout, os.Stdin, nil
+	case typ == "null" && path == "":
+		return ioutil.Discard, nil, nil
+	case typ == "file" && path != "":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return f, nil, nil
+	case typ == "unix" && path != "":
+		s, err := listenUnix(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return s, s, nil
+	case typ == "pty" && path == "":
+		p, err := openPTY()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fmt.Fprintf(os.Stderr, "serial port is redirected to %s\n", p.name)
+
+		return p, p, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrInvalidSpec, spec)
+}
+
+// unixSocket accepts clients on the unix domain socket one after another. The
+// output is discarded while no client is connected.
+type unixSocket struct {
+	l    net.Listener
+	mu   sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+}
+
+func listenUnix(path string) (*unixSocket, error) {
+	// Remove the socket left by the previous run, but never a regular file.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &unixSocket{l: l}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.accept()
+
+	return s, nil
+}
+
+func (s *unixSocket) accept() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+
+		if s.conn != nil {
+			s.conn.Close()
+		}
+
+		s.conn = conn
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *unixSocket) drop(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn.Close()
+
+	if s.conn == conn {
+		s.conn = nil
+	}
+}
+
+// Read blocks until a client connects and sends data. It never returns
+// io.EOF when the client disconnects, but waits for the next one.
+func (s *unixSocket) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+
+		for s.conn == nil {
+			s.cond.Wait()
+		}
+
+		conn := s.conn
+		s.mu.Unlock()
+
+		n, err := conn.Read(p)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+
+		s.drop(conn)
+	}
+}
+
+func (s *unixSocket) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil {
+		return len(p), nil
+	}
+
+	if _, err := conn.Write(p); err != nil {
+		s.drop(conn)
+	}
+
+	return len(p), nil
+}
+
+func ioctl(fd, op, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// pty is a pseudo terminal, which is read and written on the master side.
+// The slave side is kept open in raw mode, so that the output of the guest
+// is neither echoed back nor lost while no one opens it, and the master
+// does not fail with EIO.
+type pty struct {
+	master, slave *os.File
+	name          string
+}
+
+// openPTY allocates a new pseudo terminal, whose slave side is named name.
+func openPTY() (*pty, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := int32(0)
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+
+		return nil, err
+	}
+
+	n := uint32(0)
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+
+		return nil, err
+	}
+
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+
+		return nil, err
+	}
+
+	if _, err := term.SetRawModeFd(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+
+		return nil, err
+	}
+
+	return &pty{master: master, slave: slave, name: name}, nil
+}
+
+func (p *pty) Read(b []byte) (int, error) {
+	return p.master.Read(b)
+}
+
+func (p *pty) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+// Close closes both sides of the pseudo terminal.
+func (p *pty) Close() error {
+	err := p.master.Close()
+	if err2 := p.slave.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
@@ -0,0 +1,127 @@
+package console_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/console"
+)
+
+func TestOpenInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{"", "foo", "file:", "unix:", "null:foo", "pty:foo"} {
+		if _, _, err := console.Open(spec); !errors.Is(err, console.ErrInvalidSpec) {
+			t.Fatalf("%s: expected: %v, actual: %v", spec, console.ErrInvalidSpec, err)
+		}
+	}
+}
+
+func TestOpenNull(t *testing.T) {
+	t.Parallel()
+
+	out, in, err := console.Open("null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in != nil {
+		t.Fatal("null backend has input")
+	}
+
+	if _, err := out.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gokvm-console")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "serial.log")
+
+	out, in, err := console.Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in != nil {
+		t.Fatal("file backend has input")
+	}
+
+	if _, err := out.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(actual) != "hello" {
+		t.Fatalf("unexpected output: %q", actual)
+	}
+}
+
+func TestOpenUnix(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gokvm-console")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "serial.sock")
+
+	out, in, err := console.Open("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is discarded while no client is connected
+	if _, err := out.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1)
+	if _, err := in.Read(buf); err != nil || buf[0] != 'a' {
+		t.Fatalf("unexpected input: %q, %v", buf, err)
+	}
+
+	// the client has been accepted by now, since the input came through it
+	if _, err := out.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Read(buf); err != nil || buf[0] != 'b' {
+		t.Fatalf("unexpected output: %q, %v", buf, err)
+	}
+}
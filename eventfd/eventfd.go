@@ -0,0 +1,65 @@
+// Package eventfd wraps eventfd(2), a counter in the kernel which is signaled
+// and waited for through a file descriptor. KVM signals it on the notifications
+// of the devices by KVM_IOEVENTFD, and injects the interrupt when it is
+// signaled by KVM_IRQFD, so that the vCPU threads do not exit to userspace.
+//
+// refs https://man7.org/linux/man-pages/man2/eventfd.2.html
+package eventfd
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+type EventFD struct {
+	fd int
+}
+
+// New creates the eventfd whose counter is zero.
+func New() (*EventFD, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	return &EventFD{fd: int(fd)}, nil
+}
+
+// FD returns the file descriptor given to KVM.
+func (e *EventFD) FD() int {
+	return e.fd
+}
+
+// Signal adds 1 to the counter, which wakes up Wait.
+func (e *EventFD) Signal() error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 1)
+
+	_, err := syscall.Write(e.fd, buf)
+
+	return err
+}
+
+// Wait blocks until the counter is positive, and returns the counter after
+// resetting it to zero. The signals while the caller is not waiting are
+// coalesced.
+func (e *EventFD) Wait() (uint64, error) {
+	buf := make([]byte, 8)
+
+	for {
+		_, err := syscall.Read(e.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return binary.LittleEndian.Uint64(buf), nil
+	}
+}
+
+func (e *EventFD) Close() error {
+	return syscall.Close(e.fd)
+}
@@ -0,0 +1,44 @@
+package eventfd_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/eventfd"
+)
+
+func TestSignalAndWait(t *testing.T) {
+	t.Parallel()
+
+	e, err := eventfd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	// The signals are coalesced until Wait.
+	for i := 0; i < 3; i++ {
+		if err := e.Signal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := e.Wait(); err != nil || n != 3 {
+		t.Fatalf("unexpected counter %d or error %v", n, err)
+	}
+
+	done := make(chan uint64)
+
+	go func() {
+		n, _ := e.Wait()
+		done <- n
+	}()
+
+	if err := e.Signal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-done; n != 1 {
+		t.Fatalf("unexpected counter: %d", n)
+	}
+}
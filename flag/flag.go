@@ -1,26 +1,268 @@
 package flag
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func ParseArgs(args []string) (string, string, string, string, int, error) {
-	kernel := flag.String("k", "./bzImage", "kernel image path")
-	initrd := flag.String("i", "./initrd", "initrd path")
-	nCpus := flag.Int("c", 1, "number of cpus")
-	tapIfName := flag.String("t", "tap", "name of tap interface")
+var (
+	ErrInvalidSize   = errors.New("invalid size")
+	ErrInvalidSerial = errors.New("invalid serial ports")
+	ErrInvalidRTC    = errors.New("invalid rtc base")
+	ErrInvalidMAC    = errors.New("invalid mac address")
+	ErrInvalidNIC    = errors.New("invalid nic")
+)
+
+// NumSerials is the number of serial ports, COM1-COM4.
+const NumSerials = 4
+
+// stringList is the value of a flag which can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+
+	return nil
+}
+
+// ParseSize parses the size like "512M" or "4G". The suffix is one of K, M and
+// G (case-insensitive) with the unit of 1024, and the number without any
+// suffix is in bytes.
+func ParseSize(s string) (int, error) {
+	shift := 0
+
+	switch {
+	case strings.HasSuffix(strings.ToUpper(s), "K"):
+		shift = 10
+	case strings.HasSuffix(strings.ToUpper(s), "M"):
+		shift = 20
+	case strings.HasSuffix(strings.ToUpper(s), "G"):
+		shift = 30
+	}
+
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || (n<<shift)>>shift != n {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSize, s)
+	}
+
+	return n << shift, nil
+}
+
+// NIC is a network interface of the VM.
+type NIC struct {
+	TapIfName string
+
+	// MAC is the MAC address of virtio-net. It is derived from TapIfName if
+	// nil.
+	MAC net.HardwareAddr
+
+	// Queues is the number of the queue pairs of virtio-net, which is 1
+	// unless given.
+	Queues int
+}
+
+// ParseNIC parses the NIC like "tap0" or "tap0,mac=52:54:00:12:34:56,queues=4".
+func ParseNIC(s string) (NIC, error) {
+	fields := strings.Split(s, ",")
+	nic := NIC{TapIfName: fields[0], Queues: 1}
+
+	if nic.TapIfName == "" {
+		return nic, fmt.Errorf("%w: %s", ErrInvalidNIC, s)
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "mac="):
+			mac, err := parseMAC(strings.TrimPrefix(f, "mac="))
+			if err != nil {
+				return nic, err
+			}
+
+			nic.MAC = mac
+		case strings.HasPrefix(f, "queues="):
+			n, err := strconv.Atoi(strings.TrimPrefix(f, "queues="))
+			if err != nil || n < 1 {
+				return nic, fmt.Errorf("%w: %s", ErrInvalidNIC, s)
+			}
+
+			nic.Queues = n
+		default:
+			return nic, fmt.Errorf("%w: %s", ErrInvalidNIC, s)
+		}
+	}
+
+	return nic, nil
+}
+
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMAC, s)
+	}
+
+	return mac, nil
+}
+
+// Config is the configuration of the VM given by the command-line arguments.
+type Config struct {
+	Kernel string
+	Initrd string
+	Params string
+
+	// NICs are the network interfaces in the order of the -net flags, or
+	// the one given by -t and -mac if none is given.
+	NICs []NIC
+
+	DiskPath string
+	NCPUs    int
+	MemSize  int
+
+	// SnapshotPath is the file to save the snapshot of the VM by Ctrl-a s.
+	SnapshotPath string
+
+	// RestorePath is the snapshot file to restore the VM from. If it is not
+	// empty, the kernel and the initrd are not loaded.
+	RestorePath string
+
+	// Serials are the backends of COM1, COM2 and so on, in the order of the
+	// -serial flags. See console.Open for the format. COM1 is connected to
+	// the standard input and output if none is given.
+	Serials []string
+
+	// MonitorPath is the unix domain socket for the monitor API. The monitor
+	// is disabled if it is empty.
+	MonitorPath string
+
+	// GDBAddr is the address for the GDB remote stub, HOST:PORT for TCP or
+	// unix:PATH. If it is not empty, the VM starts paused until the debugger
+	// is attached and continues it.
+	GDBAddr string
+
+	// NoReboot makes gokvm exit instead of rebooting the guest when it
+	// resets the system.
+	NoReboot bool
+
+	// VirtioMMIO attaches the virtio devices to virtio-mmio instead of PCI,
+	// which is for the kernels without PCI support.
+	VirtioMMIO bool
+
+	// RTCBase is the time of RTC when the VM starts. The clock of RTC
+	// follows the host time if it is zero.
+	RTCBase time.Time
+}
+
+func ParseArgs(args []string) (*Config, error) {
+	c := &Config{}
+
+	flag.StringVar(&c.Kernel, "k", "./bzImage", "kernel image path")
+	flag.StringVar(&c.Initrd, "i", "./initrd", "initrd path")
+	flag.IntVar(&c.NCPUs, "c", 1, "number of cpus")
+	memSize := flag.String("m", "1G", "memory size in bytes, or with a suffix K, M or G")
+	tapIfName := flag.String("t", "tap", "name of tap interface, unless -net is given")
+	mac := flag.String("mac", "", "MAC address of virtio-net, e.g. 52:54:00:12:34:56 "+
+		"(derived from the name of tap interface if empty), unless -net is given")
+
+	nics := stringList{}
+	flag.Var(&nics, "net", "network interface TAP[,mac=MAC][,queues=N] with the name of tap interface "+
+		"and the number of queue pairs, given for each NIC")
+	flag.StringVar(&c.DiskPath, "d", "", "raw disk image path for virtio-blk (disabled if empty)")
+	flag.StringVar(&c.SnapshotPath, "s", "./snapshot", "snapshot file path to save the VM by Ctrl-a s")
+	flag.StringVar(&c.RestorePath, "r", "", "snapshot file path to restore the VM from instead of booting")
+	flag.StringVar(&c.MonitorPath, "monitor", "", "unix domain socket path for the JSON-RPC monitor (disabled if empty)")
+
+	flag.StringVar(&c.GDBAddr, "gdb", "", "address for the GDB remote stub, e.g. :1234 or unix:PATH "+
+		"(disabled if empty, and the VM waits for the debugger otherwise)")
+
+	flag.BoolVar(&c.NoReboot, "no-reboot", false, "exit instead of rebooting when the guest resets the system")
+
+	flag.BoolVar(&c.VirtioMMIO, "virtio-mmio", false, "attach virtio devices to virtio-mmio instead of PCI")
+
+	rtcBase := flag.String("rtc-base", "", "start time of RTC in RFC 3339, e.g. 2021-01-01T00:00:00Z "+
+		"(the host time if empty)")
+
+	serials := stringList{}
+	flag.Var(&serials, "serial", "serial port backend (stdio, null, file:PATH, unix:PATH or pty), "+
+		"given for COM1 first and up to COM4")
 
 	//  refs: commit 1621292e73770aabbc146e72036de5e26f901e86 in kvmtool
-	params := flag.String("p", `console=ttyS0 earlyprintk=serial noapic noacpi notsc `+
+	flag.StringVar(&c.Params, "p", `console=ttyS0 earlyprintk=serial notsc `+
 		`debug apic=debug show_lapic=all mitigations=off lapic tsc_early_khz=2000 `+
-		`dyndbg="file arch/x86/kernel/smpboot.c +plf ; file drivers/net/virtio_net.c +plf" pci=realloc=off `+
-		`virtio_pci.force_legacy=1`, "kernel command-line parameters")
+		`dyndbg="file arch/x86/kernel/smpboot.c +plf ; file drivers/net/virtio_net.c +plf" pci=realloc=off`,
+		"kernel command-line parameters")
 
 	flag.Parse()
 
 	if err := flag.CommandLine.Parse(args[1:]); err != nil {
-		return "", "", "", "", 0, err
+		return nil, err
+	}
+
+	var err error
+
+	if c.MemSize, err = ParseSize(*memSize); err != nil {
+		return nil, err
 	}
 
-	return *kernel, *initrd, *params, *tapIfName, *nCpus, nil
+	for _, spec := range nics {
+		nic, err := ParseNIC(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		c.NICs = append(c.NICs, nic)
+	}
+
+	if len(nics) == 0 {
+		nic := NIC{TapIfName: *tapIfName, Queues: 1}
+
+		if *mac != "" {
+			if nic.MAC, err = parseMAC(*mac); err != nil {
+				return nil, err
+			}
+		}
+
+		c.NICs = []NIC{nic}
+	}
+
+	if *rtcBase != "" {
+		if c.RTCBase, err = time.Parse(time.RFC3339, *rtcBase); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidRTC, *rtcBase)
+		}
+	}
+
+	if len(serials) == 0 {
+		serials = stringList{"stdio"}
+	}
+
+	if len(serials) > NumSerials {
+		return nil, fmt.Errorf("%w: more than %d ports", ErrInvalidSerial, NumSerials)
+	}
+
+	nStdio := 0
+
+	for _, spec := range serials {
+		if spec == "stdio" {
+			nStdio++
+		}
+	}
+
+	if nStdio > 1 {
+		return nil, fmt.Errorf("%w: stdio is given more than once", ErrInvalidSerial)
+	}
+
+	c.Serials = serials
+
+	return c, nil
 }
@@ -1,7 +1,9 @@
 package flag_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/bobuhiro11/gokvm/flag"
 )
@@ -17,34 +19,155 @@ func TestParseArg(t *testing.T) {
 		"kernel_path",
 		"-p",
 		"params",
-		"-t",
+		"-net",
 		"tap_if_name",
+		"-net",
+		"tap1,mac=52:54:00:12:34:56",
+		"-d",
+		"disk_path",
 		"-c",
 		"2",
+		"-m",
+		"2G",
+		"-s",
+		"snapshot_path",
+		"-r",
+		"restore_path",
+		"-serial",
+		"stdio",
+		"-serial",
+		"unix:/tmp/gokvm.sock",
+		"-monitor",
+		"monitor_path",
+		"-gdb",
+		":1234",
+		"-no-reboot",
+		"-virtio-mmio",
+		"-rtc-base",
+		"2021-01-02T03:04:05Z",
 	}
 
-	kernel, initrd, params, tapIfName, nCpus, err := flag.ParseArgs(args)
+	c, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if kernel != "kernel_path" {
+	if c.Kernel != "kernel_path" {
 		t.Fatal("invalid kernel image path")
 	}
 
-	if initrd != "initrd_path" {
+	if c.Initrd != "initrd_path" {
 		t.Fatal("invalid initrd path")
 	}
 
-	if params != "params" {
+	if c.Params != "params" {
 		t.Fatal("invalid kernel command-line parameters")
 	}
 
-	if tapIfName != "tap_if_name" {
+	if len(c.NICs) != 2 || c.NICs[0].TapIfName != "tap_if_name" || c.NICs[0].MAC != nil {
 		t.Fatal("invalid name of tap interface")
 	}
 
-	if nCpus != 2 {
+	if c.NICs[1].TapIfName != "tap1" || c.NICs[1].MAC.String() != "52:54:00:12:34:56" {
+		t.Fatal("invalid mac address")
+	}
+
+	if c.DiskPath != "disk_path" {
+		t.Fatal("invalid disk image path")
+	}
+
+	if c.NCPUs != 2 {
 		t.Fatal("invalid number of vcpus")
 	}
+
+	if c.MemSize != 2<<30 {
+		t.Fatal("invalid memory size")
+	}
+
+	if c.SnapshotPath != "snapshot_path" {
+		t.Fatal("invalid snapshot path")
+	}
+
+	if c.RestorePath != "restore_path" {
+		t.Fatal("invalid restore path")
+	}
+
+	if len(c.Serials) != 2 || c.Serials[0] != "stdio" || c.Serials[1] != "unix:/tmp/gokvm.sock" {
+		t.Fatal("invalid serial port backends")
+	}
+
+	if c.MonitorPath != "monitor_path" {
+		t.Fatal("invalid monitor path")
+	}
+
+	if c.GDBAddr != ":1234" {
+		t.Fatal("invalid gdb address")
+	}
+
+	if !c.NoReboot {
+		t.Fatal("invalid reboot policy")
+	}
+
+	if !c.VirtioMMIO {
+		t.Fatal("invalid virtio transport")
+	}
+
+	if !c.RTCBase.Equal(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatal("invalid rtc base")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+
+	for s, expected := range map[string]int{
+		"4096": 4096,
+		"64k":  64 << 10,
+		"512M": 512 << 20,
+		"8G":   8 << 30,
+	} {
+		actual, err := flag.ParseSize(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != expected {
+			t.Fatalf("%s: expected: %v, actual: %v", s, expected, actual)
+		}
+	}
+
+	for _, s := range []string{"", "G", "-1M", "1T", "99999999999G"} {
+		if _, err := flag.ParseSize(s); !errors.Is(err, flag.ErrInvalidSize) {
+			t.Fatalf("%s: expected: %v, actual: %v", s, flag.ErrInvalidSize, err)
+		}
+	}
+}
+
+func TestParseNIC(t *testing.T) {
+	t.Parallel()
+
+	nic, err := flag.ParseNIC("tap0,mac=52:54:00:ab:cd:ef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nic.TapIfName != "tap0" || nic.MAC.String() != "52:54:00:ab:cd:ef" || nic.Queues != 1 {
+		t.Fatalf("unexpected nic: %+v", nic)
+	}
+
+	if nic, err = flag.ParseNIC("tap0,queues=4"); err != nil || nic.Queues != 4 {
+		t.Fatalf("unexpected nic %+v or error %v", nic, err)
+	}
+
+	for s, expected := range map[string]error{
+		"":                      flag.ErrInvalidNIC,
+		"tap0,ip=10.0.0.1":      flag.ErrInvalidNIC,
+		"tap0,queues=0":         flag.ErrInvalidNIC,
+		"tap0,mac=52:54:00":     flag.ErrInvalidMAC,
+		"tap0,mac=not-a-mac-ad": flag.ErrInvalidMAC,
+	} {
+		if _, err := flag.ParseNIC(s); !errors.Is(err, expected) {
+			t.Fatalf("%s: expected: %v, actual: %v", s, expected, err)
+		}
+	}
 }
@@ -0,0 +1,914 @@
+// Package gdbstub serves the GDB remote serial protocol, so that the guest
+// kernel can be debugged by
+//
+//	(gdb) target remote :1234
+//
+// Each vCPU is a thread of the debugger, whose id is the index of the vCPU
+// plus one. The VM runs in the all-stop mode: all the vCPUs are paused while
+// the debugger has the control.
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+var errDetached = errors.New("debugger detached")
+
+const (
+	sigInt  = 2
+	sigTrap = 5
+
+	exceptionDB = 1
+	exceptionBP = 3
+
+	// dr6BS is the bit of DR6 for single-stepping. The bits 0-3 are for the
+	// hardware breakpoints DR0-DR3.
+	dr6BS = 1 << 14
+
+	numHWBreakpoints = 4
+
+	// maxMemLen is the maximum length of memory read by an 'm' packet, so
+	// that the reply fits in PacketSize.
+	maxMemLen = 0x7f0
+)
+
+// Types of the Z packets.
+const (
+	zSoftware = 0
+	zHardware = 1
+	zWrite    = 2
+	zRead     = 3
+	zAccess   = 4
+)
+
+// Machine is the VM debugged by the stub, which is implemented by
+// machine.Machine.
+type Machine interface {
+	Pause() error
+	Resume()
+	Status() machine.Status
+	VCPURegs(i int) (kvm.Regs, kvm.Sregs, error)
+	SetVCPURegs(i int, regs kvm.Regs) error
+	ReadVirt(cpu int, addr uint64, data []byte) error
+	WriteVirt(cpu int, addr uint64, data []byte) error
+	SetGuestDebug(cpu int, dbg kvm.GuestDebug) error
+	SetDebugHandler(h func(cpu int, exit kvm.DebugExitArch) bool)
+}
+
+type hwBreakpoint struct {
+	used bool
+	typ  int // type of the Z packet
+	addr uint64
+	len  uint64
+}
+
+type stop struct {
+	cpu    int
+	signal int
+	exit   kvm.DebugExitArch
+}
+
+type Stub struct {
+	m     Machine
+	nCPUs int
+
+	// mu protects the fields below, which are read by the debug handler on
+	// the vCPU threads.
+	mu            sync.Mutex
+	running       bool
+	stepCPU       int
+	swBreakpoints map[uint64]byte // original byte at each address
+	hwBreakpoints [numHWBreakpoints]hwBreakpoint
+
+	// stops receives the first stop after the vCPUs are resumed.
+	stops chan stop
+
+	// The fields below are used only by the goroutine serving the debugger.
+	w        io.Writer
+	writeMu  sync.Mutex
+	lastStop stop
+	gCPU     int // vCPU selected by Hg for registers and memory
+	cCPU     int // vCPU selected by Hc for step, or -1 for any
+}
+
+func New(m Machine) *Stub {
+	return &Stub{
+		m:             m,
+		nCPUs:         m.Status().NumCPUs,
+		stepCPU:       -1,
+		swBreakpoints: map[uint64]byte{},
+		stops:         make(chan stop, 1),
+	}
+}
+
+// Listen listens on the address, which is "unix:PATH" for a unix domain
+// socket or HOST:PORT for TCP.
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Serve accepts the debuggers on the listener one by one until the listener
+// is closed.
+func (s *Stub) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("gdbstub: %w", err)
+		}
+
+		// The connection is usually closed by the debugger, and another
+		// one can be attached again.
+		_ = s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single debugger until it detaches or disconnects. The VM
+// is paused while the debugger is attached, and resumed after that.
+func (s *Stub) ServeConn(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	s.w = conn
+
+	if err := s.attach(); err != nil {
+		return err
+	}
+
+	defer s.detach()
+
+	packets := make(chan string)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+
+	defer close(done)
+
+	go s.readPackets(bufio.NewReader(conn), packets, errc, done)
+
+	for {
+		var err error
+
+		select {
+		case p := <-packets:
+			if p == interruptPacket {
+				err = s.interrupt()
+			} else {
+				err = s.handle(p)
+			}
+		case st := <-s.stops:
+			err = s.stopped(st)
+		case err = <-errc:
+		}
+
+		if errors.Is(err, errDetached) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readPackets passes the packets to the serving goroutine, and acknowledges
+// them as soon as they are received.
+func (s *Stub) readPackets(r *bufio.Reader, packets chan<- string, errc chan<- error, done <-chan struct{}) {
+	for {
+		p, valid, err := readPacket(r)
+		if err != nil {
+			errc <- err
+
+			return
+		}
+
+		if p != interruptPacket {
+			ack := "+"
+			if !valid {
+				ack = "-"
+			}
+
+			if err := s.write(ack); err != nil {
+				errc <- err
+
+				return
+			}
+
+			if !valid {
+				continue
+			}
+		}
+
+		select {
+		case packets <- p:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Stub) write(data string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_, err := io.WriteString(s.w, data)
+
+	return err
+}
+
+func (s *Stub) send(data string) error {
+	return s.write(encodePacket(data))
+}
+
+func (s *Stub) attach() error {
+	s.m.SetDebugHandler(s.handleDebugExit)
+
+	if err := s.m.Pause(); err != nil {
+		return err
+	}
+
+	// The stop left by the previous debugger disconnected while running.
+	select {
+	case <-s.stops:
+	default:
+	}
+
+	s.lastStop = stop{cpu: 0, signal: sigTrap}
+	s.gCPU = 0
+	s.cCPU = -1
+
+	return nil
+}
+
+// detach removes the breakpoints and resumes the VM.
+func (s *Stub) detach() {
+	s.mu.Lock()
+	running := s.running
+	s.running = false
+	s.mu.Unlock()
+
+	if running {
+		_ = s.m.Pause()
+	}
+
+	s.mu.Lock()
+
+	for addr, orig := range s.swBreakpoints {
+		_ = s.m.WriteVirt(s.gCPU, addr, []byte{orig})
+	}
+
+	s.swBreakpoints = map[uint64]byte{}
+	s.hwBreakpoints = [numHWBreakpoints]hwBreakpoint{}
+	s.stepCPU = -1
+	s.mu.Unlock()
+
+	for i := 0; i < s.nCPUs; i++ {
+		_ = s.m.SetGuestDebug(i, kvm.GuestDebug{})
+	}
+
+	s.m.SetDebugHandler(nil)
+	s.m.Resume()
+}
+
+// handleDebugExit is called on the vCPU thread, and reports whether the exit
+// is caused by the debugger. The first such exit after resuming the vCPUs is
+// reported to the debugger.
+func (s *Stub) handleDebugExit(cpu int, exit kvm.DebugExitArch) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case exit.Exception == exceptionBP:
+		if _, ok := s.swBreakpoints[exit.PC]; !ok {
+			return false
+		}
+	case exit.Exception == exceptionDB && exit.DR6&dr6BS != 0 && cpu == s.stepCPU:
+	case exit.Exception == exceptionDB && s.hwHit(exit.DR6) >= 0:
+	default:
+		return false
+	}
+
+	if s.running {
+		s.running = false
+		s.stops <- stop{cpu: cpu, signal: sigTrap, exit: exit}
+	}
+
+	return true
+}
+
+// hwHit returns the index of the hardware breakpoint hit, or -1.
+func (s *Stub) hwHit(dr6 uint64) int {
+	for i, bp := range s.hwBreakpoints {
+		if bp.used && dr6&(1<<i) != 0 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *Stub) stopped(st stop) error {
+	if err := s.m.Pause(); err != nil {
+		return err
+	}
+
+	s.lastStop = st
+	s.gCPU = st.cpu
+
+	return s.send(s.stopReply(st))
+}
+
+func (s *Stub) interrupt() error {
+	s.mu.Lock()
+	running := s.running
+	s.running = false
+	s.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	return s.stopped(stop{cpu: s.gCPU, signal: sigInt})
+}
+
+func (s *Stub) stopReply(st stop) string {
+	reply := fmt.Sprintf("T%02xthread:%x;", st.signal, st.cpu+1)
+
+	if st.signal != sigTrap {
+		return reply
+	}
+
+	switch st.exit.Exception {
+	case exceptionBP:
+		return reply + "swbreak:;"
+	case exceptionDB:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		i := s.hwHit(st.exit.DR6)
+		if i < 0 {
+			return reply
+		}
+
+		switch bp := s.hwBreakpoints[i]; bp.typ {
+		case zWrite:
+			return reply + fmt.Sprintf("watch:%x;", bp.addr)
+		case zAccess:
+			return reply + fmt.Sprintf("awatch:%x;", bp.addr)
+		default:
+			return reply + "hwbreak:;"
+		}
+	}
+
+	return reply
+}
+
+// resume programs the breakpoints into the vCPUs and resumes them. cpu is
+// single-stepped if step is true.
+func (s *Stub) resume(step bool, cpu int) error {
+	s.mu.Lock()
+	dbg := s.guestDebug()
+
+	s.stepCPU = -1
+	if step {
+		s.stepCPU = cpu
+	}
+	s.mu.Unlock()
+
+	for i := 0; i < s.nCPUs; i++ {
+		d := dbg
+		if step && i == cpu {
+			d.Control |= kvm.GuestDebugSingleStep
+		}
+
+		if err := s.m.SetGuestDebug(i, d); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+
+	s.m.Resume()
+
+	return nil
+}
+
+func (s *Stub) guestDebug() kvm.GuestDebug {
+	dbg := kvm.GuestDebug{Control: kvm.GuestDebugEnable}
+
+	if len(s.swBreakpoints) > 0 {
+		dbg.Control |= kvm.GuestDebugUseSWBP
+	}
+
+	for i, bp := range s.hwBreakpoints {
+		if !bp.used {
+			continue
+		}
+
+		dbg.Control |= kvm.GuestDebugUseHWBP
+		dbg.DebugReg[i] = bp.addr
+
+		// DR7 has the global enable bit and the R/W and LEN bits for each
+		// breakpoint.
+		rw := map[int]uint64{zHardware: 0, zWrite: 1, zAccess: 3}[bp.typ]
+		length := map[uint64]uint64{1: 0, 2: 1, 8: 2, 4: 3}[bp.len]
+
+		if bp.typ == zHardware {
+			length = 0
+		}
+
+		dbg.DebugReg[7] |= 2<<(i*2) | (rw|length<<2)<<(16+i*4)
+	}
+
+	return dbg
+}
+
+// handle handles a packet other than the interrupt.
+func (s *Stub) handle(p string) error {
+	if p == "" {
+		return s.send("")
+	}
+
+	args := p[1:]
+
+	switch p[0] {
+	case '?':
+		return s.send(s.stopReply(s.lastStop))
+	case 'g':
+		return s.readRegs()
+	case 'G':
+		return s.writeRegs(args)
+	case 'p':
+		return s.readReg(args)
+	case 'P':
+		return s.writeReg(args)
+	case 'm':
+		return s.readMem(args)
+	case 'M':
+		return s.writeMem(args)
+	case 'c', 's':
+		return s.cont(p[0] == 's', args)
+	case 'H':
+		return s.setThread(args)
+	case 'T':
+		if _, err := s.parseThread(args); err != nil {
+			return s.send("E01")
+		}
+
+		return s.send("OK")
+	case 'q':
+		return s.query(args)
+	case 'Z', 'z':
+		return s.breakpoint(p[0] == 'Z', args)
+	case 'D':
+		if err := s.send("OK"); err != nil {
+			return err
+		}
+
+		return errDetached
+	case 'k':
+		return errDetached
+	}
+
+	// The packet is not supported.
+	return s.send("")
+}
+
+func (s *Stub) query(args string) error {
+	switch {
+	case strings.HasPrefix(args, "Supported"):
+		return s.send(fmt.Sprintf("PacketSize=%x;swbreak+;hwbreak+", 2*maxMemLen+16))
+	case args == "Attached":
+		return s.send("1")
+	case args == "C":
+		return s.send(fmt.Sprintf("QC%x", s.gCPU+1))
+	case args == "fThreadInfo":
+		ids := make([]string, s.nCPUs)
+		for i := range ids {
+			ids[i] = strconv.FormatInt(int64(i+1), 16)
+		}
+
+		return s.send("m" + strings.Join(ids, ","))
+	case args == "sThreadInfo":
+		return s.send("l")
+	case args == "Symbol::":
+		return s.send("OK")
+	}
+
+	return s.send("")
+}
+
+// parseThread parses the thread id, which returns -1 for all the threads and
+// the current vCPU for 0 (any thread).
+func (s *Stub) parseThread(id string) (int, error) {
+	n, err := strconv.ParseInt(id, 16, 64)
+
+	switch {
+	case err != nil:
+		return 0, err
+	case n == -1:
+		return -1, nil
+	case n == 0:
+		return s.gCPU, nil
+	case n > int64(s.nCPUs):
+		return 0, fmt.Errorf("no thread %x", n)
+	}
+
+	return int(n - 1), nil
+}
+
+func (s *Stub) setThread(args string) error {
+	if args == "" {
+		return s.send("E01")
+	}
+
+	cpu, err := s.parseThread(args[1:])
+	if err != nil {
+		return s.send("E01")
+	}
+
+	switch args[0] {
+	case 'g':
+		if cpu >= 0 {
+			s.gCPU = cpu
+		}
+	case 'c':
+		s.cCPU = cpu
+	default:
+		return s.send("E01")
+	}
+
+	return s.send("OK")
+}
+
+// regs returns the pointers to the registers in the order of GDB for amd64,
+// rax, rbx, rcx, rdx, rsi, rdi, rbp, rsp, r8-r15, rip and eflags.
+func regs(r *kvm.Regs) []*uint64 {
+	return []*uint64{
+		&r.RAX, &r.RBX, &r.RCX, &r.RDX, &r.RSI, &r.RDI, &r.RBP, &r.RSP,
+		&r.R8, &r.R9, &r.R10, &r.R11, &r.R12, &r.R13, &r.R14, &r.R15,
+		&r.RIP, &r.RFLAGS,
+	}
+}
+
+// regValues returns the registers in the order of GDB. eflags and the segment
+// selectors following the 64-bit registers are 32-bit.
+func regValues(r *kvm.Regs, sr *kvm.Sregs) []uint64 {
+	values := []uint64{}
+
+	for _, p := range regs(r) {
+		values = append(values, *p)
+	}
+
+	for _, seg := range []kvm.Segment{sr.CS, sr.SS, sr.DS, sr.ES, sr.FS, sr.GS} {
+		values = append(values, uint64(seg.Selector))
+	}
+
+	return values
+}
+
+const numGPRs = 17 // the 64-bit registers up to rip
+
+func encodeReg(i int, v uint64) string {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+
+	if i >= numGPRs {
+		buf = buf[:4]
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+func decodeReg(s string) (uint64, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) > 8 {
+		return 0, fmt.Errorf("invalid register value %q", s)
+	}
+
+	buf := make([]byte, 8)
+	copy(buf, b)
+
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+func (s *Stub) readRegs() error {
+	r, sr, err := s.m.VCPURegs(s.gCPU)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	var b strings.Builder
+
+	for i, v := range regValues(&r, &sr) {
+		b.WriteString(encodeReg(i, v))
+	}
+
+	return s.send(b.String())
+}
+
+// writeRegs writes the registers up to eflags. The segment registers are
+// not written.
+func (s *Stub) writeRegs(args string) error {
+	r, _, err := s.m.VCPURegs(s.gCPU)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	for i, p := range regs(&r) {
+		size := 16
+		if i >= numGPRs {
+			size = 8
+		}
+
+		if len(args) < size {
+			break
+		}
+
+		v, err := decodeReg(args[:size])
+		if err != nil {
+			return s.send("E01")
+		}
+
+		*p = v
+		args = args[size:]
+	}
+
+	if err := s.m.SetVCPURegs(s.gCPU, r); err != nil {
+		return s.send("E01")
+	}
+
+	return s.send("OK")
+}
+
+func (s *Stub) readReg(args string) error {
+	n, err := strconv.ParseUint(args, 16, 32)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	r, sr, err := s.m.VCPURegs(s.gCPU)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	values := regValues(&r, &sr)
+	if int(n) >= len(values) {
+		return s.send("E01")
+	}
+
+	return s.send(encodeReg(int(n), values[n]))
+}
+
+func (s *Stub) writeReg(args string) error {
+	kv := strings.SplitN(args, "=", 2)
+	if len(kv) != 2 {
+		return s.send("E01")
+	}
+
+	n, err := strconv.ParseUint(kv[0], 16, 32)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	v, err := decodeReg(kv[1])
+	if err != nil {
+		return s.send("E01")
+	}
+
+	r, _, err := s.m.VCPURegs(s.gCPU)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	p := regs(&r)
+	if int(n) >= len(p) {
+		return s.send("E01")
+	}
+
+	*p[n] = v
+
+	if err := s.m.SetVCPURegs(s.gCPU, r); err != nil {
+		return s.send("E01")
+	}
+
+	return s.send("OK")
+}
+
+// parseAddrLen parses "addr,length" in hex.
+func parseAddrLen(s string) (uint64, uint64, error) {
+	al := strings.SplitN(s, ",", 2)
+	if len(al) != 2 {
+		return 0, 0, fmt.Errorf("invalid address and length %q", s)
+	}
+
+	addr, err := strconv.ParseUint(al[0], 16, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length, err := strconv.ParseUint(al[1], 16, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return addr, length, nil
+}
+
+func (s *Stub) readMem(args string) error {
+	addr, length, err := parseAddrLen(args)
+	if err != nil {
+		return s.send("E01")
+	}
+
+	if length > maxMemLen {
+		length = maxMemLen
+	}
+
+	data := make([]byte, length)
+	if err := s.m.ReadVirt(s.gCPU, addr, data); err != nil {
+		return s.send("E14") // EFAULT
+	}
+
+	return s.send(hex.EncodeToString(data))
+}
+
+func (s *Stub) writeMem(args string) error {
+	al := strings.SplitN(args, ":", 2)
+	if len(al) != 2 {
+		return s.send("E01")
+	}
+
+	addr, length, err := parseAddrLen(al[0])
+	if err != nil {
+		return s.send("E01")
+	}
+
+	data, err := hex.DecodeString(al[1])
+	if err != nil || uint64(len(data)) != length {
+		return s.send("E01")
+	}
+
+	if err := s.m.WriteVirt(s.gCPU, addr, data); err != nil {
+		return s.send("E14")
+	}
+
+	return s.send("OK")
+}
+
+// cont handles 'c' and 's', which reply when the vCPUs stop.
+func (s *Stub) cont(step bool, args string) error {
+	cpu := s.cCPU
+	if cpu < 0 {
+		cpu = s.gCPU
+	}
+
+	if args != "" {
+		addr, err := strconv.ParseUint(args, 16, 64)
+		if err != nil {
+			return s.send("E01")
+		}
+
+		r, _, err := s.m.VCPURegs(cpu)
+		if err != nil {
+			return s.send("E01")
+		}
+
+		r.RIP = addr
+
+		if err := s.m.SetVCPURegs(cpu, r); err != nil {
+			return s.send("E01")
+		}
+	}
+
+	return s.resume(step, cpu)
+}
+
+// breakpoint handles "Z<type>,<addr>,<kind>" and "z<type>,<addr>,<kind>".
+// The software breakpoints are written into the memory immediately, and the
+// hardware ones are programmed into the vCPUs when they are resumed.
+func (s *Stub) breakpoint(insert bool, args string) error {
+	fields := strings.SplitN(args, ",", 3)
+	if len(fields) != 3 {
+		return s.send("E01")
+	}
+
+	typ, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return s.send("E01")
+	}
+
+	addr, kind, err := parseAddrLen(fields[1] + "," + strings.SplitN(fields[2], ";", 2)[0])
+	if err != nil {
+		return s.send("E01")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reply string
+
+	switch typ {
+	case zSoftware:
+		reply = s.swBreakpoint(insert, addr)
+	case zHardware, zWrite, zAccess:
+		reply = s.hwBreakpoint(insert, typ, addr, kind)
+	default:
+		// Including zRead, since x86 cannot break only on reads.
+		reply = ""
+	}
+
+	return s.send(reply)
+}
+
+func (s *Stub) swBreakpoint(insert bool, addr uint64) string {
+	orig, ok := s.swBreakpoints[addr]
+
+	if !insert {
+		if ok {
+			if err := s.m.WriteVirt(s.gCPU, addr, []byte{orig}); err != nil {
+				return "E14"
+			}
+
+			delete(s.swBreakpoints, addr)
+		}
+
+		return "OK"
+	}
+
+	if ok {
+		return "OK"
+	}
+
+	b := []byte{0}
+	if err := s.m.ReadVirt(s.gCPU, addr, b); err != nil {
+		return "E14"
+	}
+
+	if err := s.m.WriteVirt(s.gCPU, addr, []byte{0xcc}); err != nil { // int3
+		return "E14"
+	}
+
+	s.swBreakpoints[addr] = b[0]
+
+	return "OK"
+}
+
+func (s *Stub) hwBreakpoint(insert bool, typ int, addr, length uint64) string {
+	if typ == zHardware {
+		length = 1
+	}
+
+	if !insert {
+		for i, bp := range s.hwBreakpoints {
+			if bp.used && bp.typ == typ && bp.addr == addr && bp.len == length {
+				s.hwBreakpoints[i] = hwBreakpoint{}
+			}
+		}
+
+		return "OK"
+	}
+
+	// The watched range must be aligned to its length.
+	switch length {
+	case 1, 2, 4, 8:
+	default:
+		return "E22" // EINVAL
+	}
+
+	if addr%length != 0 {
+		return "E22"
+	}
+
+	for i, bp := range s.hwBreakpoints {
+		if !bp.used {
+			s.hwBreakpoints[i] = hwBreakpoint{used: true, typ: typ, addr: addr, len: length}
+
+			return "OK"
+		}
+	}
+
+	return "E28" // ENOSPC
+}
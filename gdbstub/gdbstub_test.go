@@ -0,0 +1,371 @@
+package gdbstub_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/gdbstub"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+var errFault = errors.New("fault")
+
+type mockMachine struct {
+	mu      sync.Mutex
+	paused  bool
+	regs    [2]kvm.Regs
+	mem     []byte
+	debug   [2]kvm.GuestDebug
+	handler func(cpu int, exit kvm.DebugExitArch) bool
+}
+
+func (m *mockMachine) Pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paused = true
+
+	return nil
+}
+
+func (m *mockMachine) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paused = false
+}
+
+func (m *mockMachine) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.paused
+}
+
+func (m *mockMachine) Status() machine.Status {
+	return machine.Status{NumCPUs: 2}
+}
+
+func (m *mockMachine) VCPURegs(i int) (kvm.Regs, kvm.Sregs, error) {
+	return m.regs[i], kvm.Sregs{CS: kvm.Segment{Selector: 0x10}}, nil
+}
+
+func (m *mockMachine) SetVCPURegs(i int, regs kvm.Regs) error {
+	m.regs[i] = regs
+
+	return nil
+}
+
+func (m *mockMachine) ReadVirt(cpu int, addr uint64, data []byte) error {
+	if addr+uint64(len(data)) > uint64(len(m.mem)) {
+		return errFault
+	}
+
+	copy(data, m.mem[addr:])
+
+	return nil
+}
+
+func (m *mockMachine) WriteVirt(cpu int, addr uint64, data []byte) error {
+	if addr+uint64(len(data)) > uint64(len(m.mem)) {
+		return errFault
+	}
+
+	copy(m.mem[addr:], data)
+
+	return nil
+}
+
+func (m *mockMachine) SetGuestDebug(cpu int, dbg kvm.GuestDebug) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.debug[cpu] = dbg
+
+	return nil
+}
+
+func (m *mockMachine) SetDebugHandler(h func(cpu int, exit kvm.DebugExitArch) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handler = h
+}
+
+func (m *mockMachine) exit(cpu int, exit kvm.DebugExitArch) bool {
+	m.mu.Lock()
+	h := m.handler
+	m.mu.Unlock()
+
+	return h(cpu, exit)
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newClient(t *testing.T, m *mockMachine) *client {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	stub := gdbstub.New(m)
+
+	done := make(chan struct{})
+
+	go func() {
+		_ = stub.ServeConn(server)
+
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) write(data string) {
+	c.t.Helper()
+
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", data, sum); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("no ack for %q: %c %v", data, b, err)
+	}
+}
+
+// resume sends 'c' or 's', and waits until the VM is resumed.
+func (c *client) resume(m *mockMachine, data string) {
+	c.t.Helper()
+
+	c.write(data)
+
+	for m.Paused() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *client) read() string {
+	c.t.Helper()
+
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(c.r, make([]byte, 2)); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return strings.TrimSuffix(data, "#")
+}
+
+func (c *client) call(data, want string) {
+	c.t.Helper()
+
+	c.write(data)
+
+	if got := c.read(); got != want {
+		c.t.Fatalf("%q: got %q, want %q", data, got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	c := newClient(t, m)
+
+	c.call("qfThreadInfo", "m1,2")
+	c.call("qsThreadInfo", "l")
+	c.call("qAttached", "1")
+	c.call("?", "T05thread:1;")
+	c.call("Hg2", "OK")
+	c.call("qC", "QC2")
+	c.call("T3", "E01")
+	c.call("vMustReplyEmpty", "")
+
+	// The packet with a wrong checksum is not acknowledged.
+	if _, err := c.conn.Write([]byte("$OK#00")); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := c.r.ReadByte(); err != nil || b != '-' {
+		t.Fatalf("unexpected ack: %c %v", b, err)
+	}
+
+	if !m.Paused() {
+		t.Fatal("VM is not paused while the debugger is attached")
+	}
+}
+
+func TestRegs(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	m.regs[0] = kvm.Regs{RAX: 1, RIP: 0xffffffff81000000, RFLAGS: 0x2}
+	c := newClient(t, m)
+
+	c.write("g")
+	g := c.read()
+
+	if len(g) != 17*16+7*8 {
+		t.Fatalf("unexpected length of registers: %d", len(g))
+	}
+
+	if !strings.HasPrefix(g, "0100000000000000") || g[16*16:17*16] != "00000081ffffffff" {
+		t.Fatalf("unexpected registers: %s", g)
+	}
+
+	if g[17*16:] != "02000000"+"10000000"+strings.Repeat("00000000", 5) {
+		t.Fatalf("unexpected eflags and segments: %s", g[17*16:])
+	}
+
+	c.call("P1=0200000000000000", "OK")
+	c.call("p1", "0200000000000000")
+
+	if m.regs[0].RBX != 2 {
+		t.Fatalf("rbx is not written: 0x%x", m.regs[0].RBX)
+	}
+
+	c.call("G"+strings.Repeat("00", 8)+g[16:], "OK")
+
+	if m.regs[0].RAX != 0 || m.regs[0].RIP != 0xffffffff81000000 {
+		t.Fatalf("registers are not written: %+v", m.regs[0])
+	}
+}
+
+func TestMem(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{mem: make([]byte, 0x100)}
+	c := newClient(t, m)
+
+	c.call("M10,4:deadbeef", "OK")
+	c.call("m10,4", "deadbeef")
+	c.call("m1000,4", "E14")
+}
+
+func TestBreakpoint(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{mem: make([]byte, 0x100)}
+	m.mem[0x20] = 0x90
+	c := newClient(t, m)
+
+	c.call("Z0,20,1", "OK")
+
+	if m.mem[0x20] != 0xcc {
+		t.Fatalf("int3 is not written: 0x%x", m.mem[0x20])
+	}
+
+	c.resume(m, "c")
+
+	if m.exit(1, kvm.DebugExitArch{Exception: 3, PC: 0x30}) {
+		t.Fatal("int3 of the guest is regarded as the breakpoint")
+	}
+
+	if !m.exit(1, kvm.DebugExitArch{Exception: 3, PC: 0x20}) {
+		t.Fatal("breakpoint is not handled")
+	}
+
+	if got := c.read(); got != "T05thread:2;swbreak:;" {
+		t.Fatalf("unexpected stop reply: %q", got)
+	}
+
+	if m.debug[0].Control != kvm.GuestDebugEnable|kvm.GuestDebugUseSWBP {
+		t.Fatalf("unexpected guest debug: 0x%x", m.debug[0].Control)
+	}
+
+	c.call("z0,20,1", "OK")
+
+	if m.mem[0x20] != 0x90 {
+		t.Fatalf("original byte is not restored: 0x%x", m.mem[0x20])
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	c := newClient(t, m)
+
+	c.call("Z2,1000,3", "E22")
+	c.call("Z2,1000,4", "OK")
+	c.call("Z3,1000,4", "")
+	c.resume(m, "c")
+
+	dbg := m.debug[0]
+	if dbg.Control&kvm.GuestDebugUseHWBP == 0 || dbg.DebugReg[0] != 0x1000 || dbg.DebugReg[7] != 0xd0002 {
+		t.Fatalf("unexpected guest debug: %+v", dbg)
+	}
+
+	if !m.exit(0, kvm.DebugExitArch{Exception: 1, DR6: 1}) {
+		t.Fatal("watchpoint is not handled")
+	}
+
+	if got := c.read(); got != "T05thread:1;watch:1000;" {
+		t.Fatalf("unexpected stop reply: %q", got)
+	}
+}
+
+func TestStepAndInterrupt(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	c := newClient(t, m)
+
+	c.call("Hc2", "OK")
+	c.resume(m, "s")
+
+	if m.debug[1].Control&kvm.GuestDebugSingleStep == 0 || m.debug[0].Control&kvm.GuestDebugSingleStep != 0 {
+		t.Fatalf("unexpected guest debug: %+v", m.debug)
+	}
+
+	if m.Paused() {
+		t.Fatal("VM is not resumed")
+	}
+
+	if !m.exit(1, kvm.DebugExitArch{Exception: 1, DR6: 1 << 14}) {
+		t.Fatal("single-step is not handled")
+	}
+
+	if got := c.read(); got != "T05thread:2;" {
+		t.Fatalf("unexpected stop reply: %q", got)
+	}
+
+	c.resume(m, "c")
+
+	if _, err := c.conn.Write([]byte{0x03}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.read(); got != "T02thread:2;" {
+		t.Fatalf("unexpected stop reply: %q", got)
+	}
+
+	c.call("D", "OK")
+}
@@ -0,0 +1,98 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// interruptPacket is what the debugger sends for Ctrl-C. It is not a packet
+// on the wire, but a single byte 0x03 outside of any packet.
+const interruptPacket = "\x03"
+
+func checksum(data string) byte {
+	var sum byte
+
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+
+	return sum
+}
+
+// escape escapes the characters which cannot appear in the packet data.
+func escape(data string) string {
+	buf := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '$', '#', '}', '*':
+			buf = append(buf, '}', c^0x20)
+		default:
+			buf = append(buf, c)
+		}
+	}
+
+	return string(buf)
+}
+
+// encodePacket frames the data as $<data>#<checksum>.
+func encodePacket(data string) string {
+	data = escape(data)
+
+	return fmt.Sprintf("$%s#%02x", data, checksum(data))
+}
+
+// readPacket reads the next packet, skipping the acknowledgements. It returns
+// interruptPacket for Ctrl-C. The data of the packet is unescaped, and valid
+// is false if the checksum does not match.
+func readPacket(r *bufio.Reader) (data string, valid bool, err error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", false, err
+		}
+
+		switch c {
+		case '$':
+			return readPacketData(r)
+		case 0x03:
+			return interruptPacket, true, nil
+		}
+	}
+}
+
+func readPacketData(r *bufio.Reader) (string, bool, error) {
+	raw, err := r.ReadBytes('#')
+	if err != nil {
+		return "", false, err
+	}
+
+	raw = raw[:len(raw)-1]
+
+	cs := make([]byte, 2)
+	if _, err := io.ReadFull(r, cs); err != nil {
+		return "", false, err
+	}
+
+	want, err := strconv.ParseUint(string(cs), 16, 8)
+	if err != nil || byte(want) != checksum(string(raw)) {
+		return "", false, nil
+	}
+
+	data := make([]byte, 0, len(raw))
+
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '}' && i+1 < len(raw) {
+			i++
+			data = append(data, raw[i]^0x20)
+
+			continue
+		}
+
+		data = append(data, raw[i])
+	}
+
+	return string(data), true, nil
+}
@@ -12,6 +12,7 @@ const (
 	kvmCreateVCPU          = 44609
 	kvmRun                 = 44672
 	kvmGetVCPUMMapSize     = 44548
+	kvmCheckExtension      = 0xae03
 	kvmGetSregs            = 0x8138ae83
 	kvmSetSregs            = 0x4138ae84
 	kvmGetRegs             = 0x8090ae81
@@ -24,6 +25,29 @@ const (
 	kvmGetSupportedCPUID   = 0xC008AE05
 	kvmSetCPUID2           = 0x4008AE90
 	kvmIRQLine             = 0xc008ae67
+	kvmGetMSRIndexList     = 0xc004ae02
+	kvmGetMSRs             = 0xc008ae88
+	kvmSetMSRs             = 0x4008ae89
+	kvmGetFPU              = 0x81a0ae8c
+	kvmSetFPU              = 0x41a0ae8d
+	kvmGetLAPIC            = 0x8400ae8e
+	kvmSetLAPIC            = 0x4400ae8f
+	kvmGetIRQChip          = 0xc208ae62
+	kvmSetIRQChip          = 0x8208ae63
+	kvmGetPIT2             = 0x8070ae9f
+	kvmSetPIT2             = 0x4070aea0
+	kvmGetMPState          = 0x8004ae98
+	kvmSetMPState          = 0x4004ae99
+	kvmGetClock            = 0x8030ae7c
+	kvmSetClock            = 0x4030ae7b
+	kvmGetXSave            = 0x9000aea4
+	kvmSetXSave            = 0x5000aea5
+	kvmGetXCRs             = 0x8188aea6
+	kvmSetXCRs             = 0x4188aea7
+	kvmSetGuestDebug       = 0x4048ae9b
+	kvmTranslate           = 0xc018ae85
+	kvmIOEventFD           = 0x4040ae79
+	kvmIRQFD               = 0x4020ae76
 
 	EXITUNKNOWN       = 0
 	EXITEXCEPTION     = 1
@@ -47,13 +71,35 @@ const (
 	EXITIOIN  = 0
 	EXITIOOUT = 1
 
+	IRQChipPICMaster = 0
+	IRQChipPICSlave  = 1
+	IRQChipIOAPIC    = 2
+
+	CapIRQFD         = 32
+	CapIOEventFD     = 36
+	CapImmediateExit = 136
+
+	GuestDebugEnable     = 0x1
+	GuestDebugSingleStep = 0x2
+	GuestDebugUseSWBP    = 0x10000
+	GuestDebugUseHWBP    = 0x20000
+	GuestDebugInjectDB   = 0x40000
+	GuestDebugInjectBP   = 0x80000
+
+	MPStateRunnable      = 0
+	MPStateUninitialized = 1
+
 	numInterrupts   = 0x100
+	maxMSRs         = 0x400
 	CPUIDFeatures   = 0x40000001
 	CPUIDSignature  = 0x40000000
 	CPUIDFuncPerMon = 0x0A
 )
 
-var ErrorUnexpectedEXITReason = errors.New("unexpected kvm exit reason")
+var (
+	ErrorUnexpectedEXITReason = errors.New("unexpected kvm exit reason")
+	ErrorTooManyMSRs          = errors.New("too many MSRs")
+)
 
 type Regs struct {
 	RAX    uint64
@@ -142,6 +188,37 @@ func (r *RunData) IO() (uint64, uint64, uint64, uint64, uint64) {
 	return direction, size, port, count, offset
 }
 
+// MMIO returns the guest physical address, the data and whether the access is
+// a write for KVM_EXIT_MMIO. The returned slice is backed by kvm_run, so the
+// result of a read should be stored into it before the next KVM_RUN.
+func (r *RunData) MMIO() (uint64, []byte, bool) {
+	physAddr := r.Data[0]
+	l := r.Data[2] & 0xFFFFFFFF
+	isWrite := (r.Data[2]>>32)&0xFF != 0
+
+	if l > 8 {
+		l = 8
+	}
+
+	data := (*[8]byte)(unsafe.Pointer(&r.Data[1]))[:l]
+
+	return physAddr, data, isWrite
+}
+
+// DebugExitArch is the exit information of KVM_EXIT_DEBUG.
+type DebugExitArch struct {
+	Exception uint32
+	_         uint32
+	PC        uint64
+	DR6       uint64
+	DR7       uint64
+}
+
+// Debug returns the exit information for KVM_EXIT_DEBUG.
+func (r *RunData) Debug() DebugExitArch {
+	return *(*DebugExitArch)(unsafe.Pointer(&r.Data[0]))
+}
+
 type UserspaceMemoryRegion struct {
 	Slot          uint32
 	Flags         uint32
@@ -174,6 +251,12 @@ func GetAPIVersion(kvmFd uintptr) (uintptr, error) {
 	return ioctl(kvmFd, uintptr(kvmGetAPIVersion), uintptr(0))
 }
 
+// CheckExtension returns a positive value if the capability is supported,
+// or 0 if not.
+func CheckExtension(kvmFd uintptr, capability int) (uintptr, error) {
+	return ioctl(kvmFd, uintptr(kvmCheckExtension), uintptr(capability))
+}
+
 func CreateVM(kvmFd uintptr) (uintptr, error) {
 	return ioctl(kvmFd, uintptr(kvmCreateVM), uintptr(0))
 }
@@ -259,6 +342,54 @@ func IRQLine(vmFd uintptr, irq, level uint32) error {
 	return err
 }
 
+// Flags of IOEventFD.
+const (
+	IOEventFDFlagDataMatch = 1 << 0
+	IOEventFDFlagPIO       = 1 << 1
+	IOEventFDFlagDeassign  = 1 << 2
+)
+
+// IOEventFD is struct kvm_ioeventfd, which makes KVM signal the eventfd FD
+// on the guest writes of Len bytes to Addr, instead of exiting to userspace.
+// The writes must also equal DataMatch if IOEventFDFlagDataMatch is set.
+type IOEventFD struct {
+	DataMatch uint64
+	Addr      uint64
+	Len       uint32
+	FD        int32
+	Flags     uint32
+	_         [36]uint8
+}
+
+// SetIOEventFD assigns the eventfd to the MMIO address, or the IO port with
+// IOEventFDFlagPIO. It is deassigned with IOEventFDFlagDeassign.
+func SetIOEventFD(vmFd uintptr, ioeventfd *IOEventFD) error {
+	_, err := ioctl(vmFd, kvmIOEventFD, uintptr(unsafe.Pointer(ioeventfd)))
+
+	return err
+}
+
+// IRQFDFlagDeassign is the flag of IRQFD to deassign the eventfd.
+const IRQFDFlagDeassign = 1 << 0
+
+// IRQFD is struct kvm_irqfd, which makes KVM inject an edge of the interrupt
+// GSI when the eventfd FD is signaled.
+type IRQFD struct {
+	FD         uint32
+	GSI        uint32
+	Flags      uint32
+	ResampleFD uint32
+	_          [16]uint8
+}
+
+// SetIRQFD assigns the eventfd to the interrupt. The in-kernel irqchip must be
+// created by CreateIRQChip.
+func SetIRQFD(vmFd uintptr, irqfd *IRQFD) error {
+	_, err := ioctl(vmFd, kvmIRQFD, uintptr(unsafe.Pointer(irqfd)))
+
+	return err
+}
+
 func CreateIRQChip(vmFd uintptr) error {
 	_, err := ioctl(vmFd, kvmCreateIRQChip, 0)
 
@@ -307,3 +438,284 @@ func SetCPUID2(vcpuFd uintptr, kvmCPUID *CPUID) error {
 
 	return err
 }
+
+type FPU struct {
+	FPR        [8][16]uint8
+	FCW        uint16
+	FSW        uint16
+	FTWX       uint8
+	_          uint8
+	LastOpcode uint16
+	LastIP     uint64
+	LastDP     uint64
+	XMM        [16][16]uint8
+	MXCSR      uint32
+	_          uint32
+}
+
+func GetFPU(vcpuFd uintptr) (FPU, error) {
+	fpu := FPU{}
+	_, err := ioctl(vcpuFd, kvmGetFPU, uintptr(unsafe.Pointer(&fpu)))
+
+	return fpu, err
+}
+
+func SetFPU(vcpuFd uintptr, fpu FPU) error {
+	_, err := ioctl(vcpuFd, kvmSetFPU, uintptr(unsafe.Pointer(&fpu)))
+
+	return err
+}
+
+type XSave struct {
+	Region [1024]uint32
+}
+
+func GetXSave(vcpuFd uintptr) (XSave, error) {
+	xsave := XSave{}
+	_, err := ioctl(vcpuFd, kvmGetXSave, uintptr(unsafe.Pointer(&xsave)))
+
+	return xsave, err
+}
+
+func SetXSave(vcpuFd uintptr, xsave XSave) error {
+	_, err := ioctl(vcpuFd, kvmSetXSave, uintptr(unsafe.Pointer(&xsave)))
+
+	return err
+}
+
+type XCR struct {
+	XCR   uint32
+	_     uint32
+	Value uint64
+}
+
+type XCRs struct {
+	NrXCRs uint32
+	Flags  uint32
+	XCRs   [16]XCR
+	_      [16]uint64
+}
+
+func GetXCRs(vcpuFd uintptr) (XCRs, error) {
+	xcrs := XCRs{}
+	_, err := ioctl(vcpuFd, kvmGetXCRs, uintptr(unsafe.Pointer(&xcrs)))
+
+	return xcrs, err
+}
+
+func SetXCRs(vcpuFd uintptr, xcrs XCRs) error {
+	_, err := ioctl(vcpuFd, kvmSetXCRs, uintptr(unsafe.Pointer(&xcrs)))
+
+	return err
+}
+
+type msrList struct {
+	NMSRs   uint32
+	Indices [maxMSRs]uint32
+}
+
+// GetMSRIndexList returns the list of MSRs supported by KVM, which should be
+// saved and restored along with the other vCPU state.
+func GetMSRIndexList(kvmFd uintptr) ([]uint32, error) {
+	list := msrList{NMSRs: maxMSRs}
+
+	if _, err := ioctl(kvmFd, kvmGetMSRIndexList, uintptr(unsafe.Pointer(&list))); err != nil {
+		return []uint32{}, err
+	}
+
+	return list.Indices[:list.NMSRs], nil
+}
+
+type MSREntry struct {
+	Index uint32
+	_     uint32
+	Data  uint64
+}
+
+type msrs struct {
+	NMSRs   uint32
+	_       uint32
+	Entries [maxMSRs]MSREntry
+}
+
+// GetMSRs reads the MSRs specified by the Index of the entries. It returns the
+// number of MSRs actually read, which is less than len(entries) if KVM fails
+// to read the entry at the position.
+func GetMSRs(vcpuFd uintptr, entries []MSREntry) (int, error) {
+	if len(entries) > maxMSRs {
+		return 0, ErrorTooManyMSRs
+	}
+
+	m := msrs{NMSRs: uint32(len(entries))}
+	copy(m.Entries[:], entries)
+
+	n, err := ioctl(vcpuFd, kvmGetMSRs, uintptr(unsafe.Pointer(&m)))
+	if err != nil {
+		return 0, err
+	}
+
+	copy(entries, m.Entries[:n])
+
+	return int(n), nil
+}
+
+// SetMSRs writes the MSRs and returns the number of MSRs actually written.
+func SetMSRs(vcpuFd uintptr, entries []MSREntry) (int, error) {
+	if len(entries) > maxMSRs {
+		return 0, ErrorTooManyMSRs
+	}
+
+	m := msrs{NMSRs: uint32(len(entries))}
+	copy(m.Entries[:], entries)
+
+	n, err := ioctl(vcpuFd, kvmSetMSRs, uintptr(unsafe.Pointer(&m)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+type LAPICState struct {
+	Regs [1024]uint8
+}
+
+func GetLocalAPIC(vcpuFd uintptr) (LAPICState, error) {
+	lapic := LAPICState{}
+	_, err := ioctl(vcpuFd, kvmGetLAPIC, uintptr(unsafe.Pointer(&lapic)))
+
+	return lapic, err
+}
+
+func SetLocalAPIC(vcpuFd uintptr, lapic LAPICState) error {
+	_, err := ioctl(vcpuFd, kvmSetLAPIC, uintptr(unsafe.Pointer(&lapic)))
+
+	return err
+}
+
+type MPState struct {
+	State uint32
+}
+
+func GetMPState(vcpuFd uintptr) (MPState, error) {
+	mpState := MPState{}
+	_, err := ioctl(vcpuFd, kvmGetMPState, uintptr(unsafe.Pointer(&mpState)))
+
+	return mpState, err
+}
+
+func SetMPState(vcpuFd uintptr, mpState MPState) error {
+	_, err := ioctl(vcpuFd, kvmSetMPState, uintptr(unsafe.Pointer(&mpState)))
+
+	return err
+}
+
+// IRQChip holds the state of the in-kernel PIC or IOAPIC selected by ChipID.
+type IRQChip struct {
+	ChipID uint32
+	_      uint32
+	Chip   [512]uint8
+}
+
+func GetIRQChip(vmFd uintptr, chipID uint32) (IRQChip, error) {
+	irqChip := IRQChip{ChipID: chipID}
+	_, err := ioctl(vmFd, kvmGetIRQChip, uintptr(unsafe.Pointer(&irqChip)))
+
+	return irqChip, err
+}
+
+func SetIRQChip(vmFd uintptr, irqChip IRQChip) error {
+	_, err := ioctl(vmFd, kvmSetIRQChip, uintptr(unsafe.Pointer(&irqChip)))
+
+	return err
+}
+
+type PITChannelState struct {
+	Count         uint32
+	LatchedCount  uint16
+	CountLatched  uint8
+	StatusLatched uint8
+	Status        uint8
+	ReadState     uint8
+	WriteState    uint8
+	WriteLatch    uint8
+	RWMode        uint8
+	Mode          uint8
+	BCD           uint8
+	Gate          uint8
+	CountLoadTime int64
+}
+
+type PITState2 struct {
+	Channels [3]PITChannelState
+	Flags    uint32
+	_        [9]uint32
+}
+
+func GetPIT2(vmFd uintptr) (PITState2, error) {
+	pit := PITState2{}
+	_, err := ioctl(vmFd, kvmGetPIT2, uintptr(unsafe.Pointer(&pit)))
+
+	return pit, err
+}
+
+func SetPIT2(vmFd uintptr, pit PITState2) error {
+	_, err := ioctl(vmFd, kvmSetPIT2, uintptr(unsafe.Pointer(&pit)))
+
+	return err
+}
+
+type ClockData struct {
+	Clock    uint64
+	Flags    uint32
+	_        uint32
+	Realtime uint64
+	HostTSC  uint64
+	_        [4]uint32
+}
+
+func GetClock(vmFd uintptr) (ClockData, error) {
+	clock := ClockData{}
+	_, err := ioctl(vmFd, kvmGetClock, uintptr(unsafe.Pointer(&clock)))
+
+	return clock, err
+}
+
+func SetClock(vmFd uintptr, clock ClockData) error {
+	// Only the clock value is accepted by KVM_SET_CLOCK.
+	clock.Flags = 0
+	_, err := ioctl(vmFd, kvmSetClock, uintptr(unsafe.Pointer(&clock)))
+
+	return err
+}
+
+// GuestDebug is the argument of KVM_SET_GUEST_DEBUG. DebugReg[0-3] are the
+// addresses of the hardware breakpoints, and DebugReg[7] is DR7.
+type GuestDebug struct {
+	Control  uint32
+	_        uint32
+	DebugReg [8]uint64
+}
+
+func SetGuestDebug(vcpuFd uintptr, dbg GuestDebug) error {
+	_, err := ioctl(vcpuFd, kvmSetGuestDebug, uintptr(unsafe.Pointer(&dbg)))
+
+	return err
+}
+
+type Translation struct {
+	LinearAddress   uint64
+	PhysicalAddress uint64
+	Valid           uint8
+	Writeable       uint8
+	UserMode        uint8
+	_               [5]uint8
+}
+
+// Translate translates the linear address by the page tables of the vCPU.
+func Translate(vcpuFd uintptr, linearAddr uint64) (Translation, error) {
+	tr := Translation{LinearAddress: linearAddr}
+	_, err := ioctl(vcpuFd, kvmTranslate, uintptr(unsafe.Pointer(&tr)))
+
+	return tr, err
+}
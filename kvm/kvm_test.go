@@ -1,11 +1,13 @@
 package kvm_test
 
 import (
+	"errors"
 	"os"
 	"syscall"
 	"testing"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/eventfd"
 	"github.com/bobuhiro11/gokvm/kvm"
 )
 
@@ -231,6 +233,183 @@ func TestAddNum(t *testing.T) {
 	}
 }
 
+func TestMMIO(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+
+	defer devKVM.Close()
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+	mem, _ := syscall.Mmap(-1, 0, 0x1000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+
+	// mov byte [0x2000], 0x42; mov al, [0x2000]; hlt
+	code := []byte{0xc6, 0x06, 0x00, 0x20, 0x42, 0xa0, 0x00, 0x20, 0xf4}
+	copy(mem, code)
+
+	_ = kvm.SetUserMemoryRegion(vmFd, &kvm.UserspaceMemoryRegion{
+		Slot:          0,
+		Flags:         0,
+		GuestPhysAddr: 0x1000,
+		MemorySize:    0x1000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	})
+
+	vcpuFd, _ := kvm.CreateVCPU(vmFd, 0)
+	mmapSize, _ := kvm.GetVCPUMMmapSize(devKVM.Fd())
+
+	r, _ := syscall.Mmap(int(vcpuFd), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	run := (*kvm.RunData)(unsafe.Pointer(&r[0]))
+
+	sregs, _ := kvm.GetSregs(vcpuFd)
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+	sregs.DS.Base, sregs.DS.Selector = 0, 0
+	_ = kvm.SetSregs(vcpuFd, sregs)
+	_ = kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2})
+
+	for {
+		_ = kvm.Run(vcpuFd)
+
+		switch run.ExitReason {
+		case kvm.EXITHLT:
+			regs, _ := kvm.GetRegs(vcpuFd)
+			if regs.RAX&0xff != 0x99 {
+				t.Fatalf("unexpected rax: 0x%x", regs.RAX)
+			}
+
+			return
+		case kvm.EXITMMIO:
+			addr, data, isWrite := run.MMIO()
+			if addr != 0x2000 || len(data) != 1 {
+				t.Fatalf("unexpected mmio: addr 0x%x, len %d", addr, len(data))
+			}
+
+			if isWrite && data[0] != 0x42 {
+				t.Fatalf("unexpected data: 0x%x", data[0])
+			}
+
+			if !isWrite {
+				data[0] = 0x99
+			}
+		default:
+			t.Fatalf("Unexpected EXIT REASON = %d\n", run.ExitReason)
+		}
+	}
+}
+
+func TestImmediateExit(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+
+	defer devKVM.Close()
+
+	if ret, err := kvm.CheckExtension(devKVM.Fd(), kvm.CapImmediateExit); err != nil || ret == 0 {
+		t.Fatalf("KVM_CAP_IMMEDIATE_EXIT is not supported: %v", err)
+	}
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+	mem, _ := syscall.Mmap(-1, 0, 0x1000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+
+	// jmp $
+	copy(mem, []byte{0xeb, 0xfe})
+
+	_ = kvm.SetUserMemoryRegion(vmFd, &kvm.UserspaceMemoryRegion{
+		Slot:          0,
+		Flags:         0,
+		GuestPhysAddr: 0x1000,
+		MemorySize:    0x1000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	})
+
+	vcpuFd, _ := kvm.CreateVCPU(vmFd, 0)
+	mmapSize, _ := kvm.GetVCPUMMmapSize(devKVM.Fd())
+
+	r, _ := syscall.Mmap(int(vcpuFd), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	run := (*kvm.RunData)(unsafe.Pointer(&r[0]))
+
+	sregs, _ := kvm.GetSregs(vcpuFd)
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+	_ = kvm.SetSregs(vcpuFd, sregs)
+	_ = kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2})
+
+	// The guest spins forever, but KVM_RUN returns without entering it.
+	run.ImmediateExit = 1
+
+	if err := kvm.Run(vcpuFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if regs, _ := kvm.GetRegs(vcpuFd); regs.RIP != 0x1000 {
+		t.Fatalf("unexpected rip: 0x%x", regs.RIP)
+	}
+}
+
+func TestGuestDebug(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+
+	defer devKVM.Close()
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+	mem, _ := syscall.Mmap(-1, 0, 0x1000, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
+
+	// nop; nop; hlt
+	copy(mem, []byte{0x90, 0x90, 0xf4})
+
+	_ = kvm.SetUserMemoryRegion(vmFd, &kvm.UserspaceMemoryRegion{
+		Slot:          0,
+		Flags:         0,
+		GuestPhysAddr: 0x1000,
+		MemorySize:    0x1000,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))),
+	})
+
+	vcpuFd, _ := kvm.CreateVCPU(vmFd, 0)
+	mmapSize, _ := kvm.GetVCPUMMmapSize(devKVM.Fd())
+
+	r, _ := syscall.Mmap(int(vcpuFd), 0, int(mmapSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	run := (*kvm.RunData)(unsafe.Pointer(&r[0]))
+
+	sregs, _ := kvm.GetSregs(vcpuFd)
+	sregs.CS.Base, sregs.CS.Selector = 0, 0
+	_ = kvm.SetSregs(vcpuFd, sregs)
+	_ = kvm.SetRegs(vcpuFd, kvm.Regs{RIP: 0x1000, RFLAGS: 0x2})
+
+	// Paging is disabled in real mode, so the address is translated as is.
+	tr, err := kvm.Translate(vcpuFd, 0x1001)
+	if err != nil || tr.Valid == 0 || tr.PhysicalAddress != 0x1001 {
+		t.Fatalf("unexpected translation: %+v, %v", tr, err)
+	}
+
+	err = kvm.SetGuestDebug(vcpuFd, kvm.GuestDebug{
+		Control: kvm.GuestDebugEnable | kvm.GuestDebugSingleStep,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pc := range []uint64{0x1001, 0x1002} {
+		_ = kvm.Run(vcpuFd)
+
+		if run.ExitReason != kvm.EXITDEBUG {
+			t.Fatalf("Unexpected EXIT REASON = %d\n", run.ExitReason)
+		}
+
+		if d := run.Debug(); d.Exception != 1 || d.PC != pc {
+			t.Fatalf("unexpected debug exit: %+v", d)
+		}
+	}
+
+	_ = kvm.SetGuestDebug(vcpuFd, kvm.GuestDebug{})
+	_ = kvm.Run(vcpuFd)
+
+	if run.ExitReason != kvm.EXITHLT {
+		t.Fatalf("Unexpected EXIT REASON = %d\n", run.ExitReason)
+	}
+}
+
 func TestSetMemLogDirtyPages(t *testing.T) {
 	t.Parallel()
 
@@ -257,3 +436,246 @@ func TestIRQLine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIOEventFD(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	e, err := eventfd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	ioeventfd := kvm.IOEventFD{
+		DataMatch: 1,
+		Addr:      0xd0000050,
+		Len:       4,
+		FD:        int32(e.FD()),
+		Flags:     kvm.IOEventFDFlagDataMatch,
+	}
+
+	if err := kvm.SetIOEventFD(vmFd, &ioeventfd); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same eventfd cannot be assigned twice.
+	if err := kvm.SetIOEventFD(vmFd, &ioeventfd); err == nil {
+		t.Fatal("eventfd is assigned twice")
+	}
+
+	ioeventfd.Flags |= kvm.IOEventFDFlagDeassign
+
+	if err := kvm.SetIOEventFD(vmFd, &ioeventfd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIRQFD(t *testing.T) {
+	t.Parallel()
+
+	devKVM, _ := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := eventfd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	irqfd := kvm.IRQFD{FD: uint32(e.FD()), GSI: 5}
+
+	if err := kvm.SetIRQFD(vmFd, &irqfd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Signal(); err != nil {
+		t.Fatal(err)
+	}
+
+	irqfd.Flags = kvm.IRQFDFlagDeassign
+
+	if err := kvm.SetIRQFD(vmFd, &irqfd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStructSize(t *testing.T) {
+	t.Parallel()
+
+	for name, c := range map[string][2]uintptr{
+		"FPU":           {unsafe.Sizeof(kvm.FPU{}), 0x1a0},
+		"XSave":         {unsafe.Sizeof(kvm.XSave{}), 0x1000},
+		"XCRs":          {unsafe.Sizeof(kvm.XCRs{}), 0x188},
+		"LAPICState":    {unsafe.Sizeof(kvm.LAPICState{}), 0x400},
+		"IRQChip":       {unsafe.Sizeof(kvm.IRQChip{}), 0x208},
+		"PITState2":     {unsafe.Sizeof(kvm.PITState2{}), 0x70},
+		"ClockData":     {unsafe.Sizeof(kvm.ClockData{}), 0x30},
+		"GuestDebug":    {unsafe.Sizeof(kvm.GuestDebug{}), 0x48},
+		"Translation":   {unsafe.Sizeof(kvm.Translation{}), 0x18},
+		"DebugExitArch": {unsafe.Sizeof(kvm.DebugExitArch{}), 0x20},
+		"IOEventFD":     {unsafe.Sizeof(kvm.IOEventFD{}), 0x40},
+		"IRQFD":         {unsafe.Sizeof(kvm.IRQFD{}), 0x20},
+	} {
+		if c[0] != c[1] {
+			t.Fatalf("size of %s: expected: 0x%x, actual: 0x%x", name, c[1], c[0])
+		}
+	}
+}
+
+func TestVCPUState(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	vcpuFd, _ := kvm.CreateVCPU(vmFd, 0)
+
+	fpu, err := kvm.GetFPU(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpu.FCW = 0x37e
+
+	if err := kvm.SetFPU(vcpuFd, fpu); err != nil {
+		t.Fatal(err)
+	}
+
+	if fpu, _ = kvm.GetFPU(vcpuFd); fpu.FCW != 0x37e {
+		t.Fatalf("unexpected fcw: 0x%x", fpu.FCW)
+	}
+
+	xsave, err := kvm.GetXSave(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetXSave(vcpuFd, xsave); err != nil {
+		t.Fatal(err)
+	}
+
+	lapic, err := kvm.GetLocalAPIC(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetLocalAPIC(vcpuFd, lapic); err != nil {
+		t.Fatal(err)
+	}
+
+	mpState, err := kvm.GetMPState(vcpuFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetMPState(vcpuFd, mpState); err != nil {
+		t.Fatal(err)
+	}
+
+	indices, err := kvm.GetMSRIndexList(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// IA32_SYSENTER_CS
+	entries := []kvm.MSREntry{{Index: 0x174, Data: 0x10}}
+
+	if n, err := kvm.SetMSRs(vcpuFd, entries); n != 1 || err != nil {
+		t.Fatalf("failed to set msr: %v", err)
+	}
+
+	entries[0].Data = 0
+
+	if n, err := kvm.GetMSRs(vcpuFd, entries); n != 1 || err != nil || entries[0].Data != 0x10 {
+		t.Fatalf("failed to get msr: %v, %v", entries, err)
+	}
+
+	if len(indices) == 0 {
+		t.Fatal("no msr is supported")
+	}
+
+	// The entries must fit in struct kvm_msrs.
+	entries = make([]kvm.MSREntry, 0x401)
+
+	if _, err := kvm.GetMSRs(vcpuFd, entries); !errors.Is(err, kvm.ErrorTooManyMSRs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := kvm.SetMSRs(vcpuFd, entries); !errors.Is(err, kvm.ErrorTooManyMSRs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The error of the ioctl is returned with no entry read.
+	if n, err := kvm.GetMSRs(^uintptr(0), entries[:1]); n != 0 || err == nil {
+		t.Fatalf("unexpected number %d or error %v", n, err)
+	}
+}
+
+func TestVMState(t *testing.T) {
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, _ := kvm.CreateVM(devKVM.Fd())
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreatePIT2(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint32{kvm.IRQChipPICMaster, kvm.IRQChipPICSlave, kvm.IRQChipIOAPIC} {
+		chip, err := kvm.GetIRQChip(vmFd, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := kvm.SetIRQChip(vmFd, chip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pit, err := kvm.GetPIT2(vmFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetPIT2(vmFd, pit); err != nil {
+		t.Fatal(err)
+	}
+
+	clock, err := kvm.GetClock(vmFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.SetClock(vmFd, clock); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+var errorPageNotMapped = fmt.Errorf("page is not mapped")
+
+// SetDebugHandler sets the handler called on KVM_EXIT_DEBUG from the vCPU
+// thread. The handler returns true if the exit is caused by the debugger,
+// and then the VM is paused as by Pause before the vCPU runs again.
+// Otherwise the exception is injected into the guest.
+func (m *Machine) SetDebugHandler(h func(cpu int, exit kvm.DebugExitArch) bool) {
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+
+	m.debugHandler = h
+}
+
+// SetGuestDebug sets the breakpoints and single-stepping of the vCPU. The VM
+// should be paused.
+func (m *Machine) SetGuestDebug(cpu int, dbg kvm.GuestDebug) error {
+	if cpu < 0 || cpu >= len(m.vcpuFds) {
+		return fmt.Errorf("%w: %d", errorInvalidVCPU, cpu)
+	}
+
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+
+	if err := kvm.SetGuestDebug(m.vcpuFds[cpu], dbg); err != nil {
+		return err
+	}
+
+	m.guestDebug[cpu] = dbg
+
+	return nil
+}
+
+func (m *Machine) handleDebug(cpu int, exit kvm.DebugExitArch) error {
+	m.debugMu.Lock()
+	h := m.debugHandler
+	m.debugMu.Unlock()
+
+	if h != nil && h(cpu, exit) {
+		return m.requestPause()
+	}
+
+	// The exception is raised by the guest itself, e.g. int3 for kprobes,
+	// which is intercepted only because the debugger is attached.
+	m.debugMu.Lock()
+	defer m.debugMu.Unlock()
+
+	dbg := m.guestDebug[cpu]
+
+	switch exit.Exception {
+	case 1:
+		dbg.Control |= kvm.GuestDebugInjectDB
+	case 3:
+		dbg.Control |= kvm.GuestDebugInjectBP
+	default:
+		return nil
+	}
+
+	return kvm.SetGuestDebug(m.vcpuFds[cpu], dbg)
+}
+
+// SetVCPURegs sets the registers of the vCPU while the VM is paused.
+func (m *Machine) SetVCPURegs(i int, regs kvm.Regs) error {
+	if i < 0 || i >= len(m.vcpuFds) {
+		return fmt.Errorf("%w: %d", errorInvalidVCPU, i)
+	}
+
+	err := m.pause()
+	defer m.resume()
+
+	if err != nil {
+		return err
+	}
+
+	return kvm.SetRegs(m.vcpuFds[i], regs)
+}
+
+// ReadVirt reads the guest memory at the virtual address, which is translated
+// by the page tables of the vCPU.
+func (m *Machine) ReadVirt(cpu int, addr uint64, data []byte) error {
+	return m.accessVirt(cpu, addr, data, false)
+}
+
+// WriteVirt writes the guest memory at the virtual address, which is
+// translated by the page tables of the vCPU. Read-only pages are also
+// written, as software breakpoints are placed in the kernel text.
+func (m *Machine) WriteVirt(cpu int, addr uint64, data []byte) error {
+	return m.accessVirt(cpu, addr, data, true)
+}
+
+func (m *Machine) accessVirt(cpu int, addr uint64, data []byte, isWrite bool) error {
+	if cpu < 0 || cpu >= len(m.vcpuFds) {
+		return fmt.Errorf("%w: %d", errorInvalidVCPU, cpu)
+	}
+
+	for len(data) > 0 {
+		tr, err := kvm.Translate(m.vcpuFds[cpu], addr)
+		if err != nil {
+			return err
+		}
+
+		if tr.Valid == 0 || !m.isRAM(tr.PhysicalAddress) {
+			return fmt.Errorf("%w: 0x%x", errorPageNotMapped, addr)
+		}
+
+		// The access is split at the page boundary, since the next page
+		// may be mapped to another physical page.
+		n := pageSize - int(addr%pageSize)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		if isWrite {
+			copy(m.mem[tr.PhysicalAddress:], data[:n])
+		} else {
+			copy(data[:n], m.mem[tr.PhysicalAddress:])
+		}
+
+		data = data[n:]
+		addr += uint64(n)
+	}
+
+	return nil
+}
+
+func (m *Machine) isRAM(gpa uint64) bool {
+	for _, r := range m.memRegions {
+		if r.gpa <= gpa && gpa < r.gpa+r.size {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,17 +1,27 @@
 package machine
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/acpi"
 	"github.com/bobuhiro11/gokvm/bootparam"
 	"github.com/bobuhiro11/gokvm/ebda"
+	"github.com/bobuhiro11/gokvm/eventfd"
 	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/mmio"
 	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/rtc"
 	"github.com/bobuhiro11/gokvm/serial"
 	"github.com/bobuhiro11/gokvm/tap"
 	"github.com/bobuhiro11/gokvm/virtio"
@@ -39,38 +49,182 @@ import (
 //                               |                  |
 //                               +------------------+
 //                               |                  |
-//                 0x0f000000    +------------------+ initrd [+ 0]
+//                 initrdAddr    +------------------+ initrd [+ 0]
 //                               |                  |
 //                               |   initrd         |
 //                               |                  |
-//                               +------------------+
+//                               +------------------+ min(InitrdAddrMax + 1, end of low memory)
+//                               |                  |
+//                 min(memSize,  +------------------+
+//                  0xc0000000)  |                  |
+//                               |   PCI hole       |
+//                               |                  |
+//                 0x100000000   +------------------+
+//                               |                  |
+//                               |   high memory    |
+//                               |   (if memSize >  |
+//                               |    0xc0000000)   |
 //                               |                  |
-//                 0x40000000    +------------------+
+//                               +------------------+
 const (
-	memSize       = 1 << 30
 	bootParamAddr = 0x10000
 	cmdlineAddr   = 0x20000
 	kernelAddr    = 0x100000
-	initrdAddr    = 0xf000000
 
-	serialIRQ    = 4
-	virtioNetIRQ = 9
+	// The 32-bit PCI/MMIO hole below 4GiB. Guest memory which does not fit
+	// below pciHoleStart is placed above pciHoleEnd.
+	pciHoleStart = 0xc0000000
+	pciHoleEnd   = 1 << 32
+
+	// ioapicAddr is the address of the I/O APIC emulated by KVM, below which
+	// the BARs of the PCI devices are placed in the hole.
+	ioapicAddr = 0xfec00000
+
+	minMemSize = 1 << 26
+	pageSize   = 0x1000
+
+	virtioBlkIRQ = 10
+
+	// virtioMMIOBase is the address of the first virtio-mmio device in the
+	// PCI hole, followed by the others at intervals of virtio.MMIOSize.
+	virtioMMIOBase = 0xd0000000
+
+	// virtioPCIBase is the address of the memory BAR of the first virtio PCI
+	// device, followed by the others at intervals of virtio.PCIBARSize.
+	virtioPCIBase = 0xc0000000
+
+	// acpiSCI is the IRQ of the system control interrupt of ACPI.
+	acpiSCI = 5
+
+	// The reset control register, where writing RST_CPU resets the system.
+	resetControlPort = 0xcf9
+	resetControlCPU  = 0x04
+
+	// The command of i8042 to pulse the reset line of the CPU.
+	i8042CommandPort = 0x64
+	i8042PulseReset  = 0xfe
+
+	// kickSignal interrupts KVM_RUN to pause the vCPUs. The Go runtime
+	// handles it and does nothing unless signal.Notify is called for it.
+	kickSignal = syscall.SIGUSR1
+)
+
+// serialPorts are the I/O ports and the IRQs of COM1-COM4 on PCs.
+var serialPorts = [...]struct {
+	addr uint64
+	irq  uint32
+}{
+	{serial.COM1Addr, 4},
+	{serial.COM2Addr, 3},
+	{serial.COM3Addr, 4},
+	{serial.COM4Addr, 3},
+}
+
+// netIRQs are the IRQs of the NICs in order, which limit the number of NICs.
+// They are ISA IRQs free in the machine, which are routed to the PCI slots by
+// _PRT in DSDT.
+var netIRQs = [...]uint32{9, 11, 7, 6, 12}
+
+var (
+	errorPCIDeviceNotFoundForPort = fmt.Errorf("pci device cannot be found for port")
+	errorInvalidMemSize           = fmt.Errorf("memory size must be a multiple of 0x%x and at least 0x%x",
+		pageSize, minMemSize)
+	errorInitrdTooLarge        = fmt.Errorf("initrd does not fit in low memory")
+	errorInvalidSerialPort     = fmt.Errorf("invalid serial port")
+	errorInvalidVCPU           = fmt.Errorf("invalid vcpu")
+	errorNoKernel              = fmt.Errorf("no kernel is loaded by LoadLinux")
+	errorUnsupportedCapability = fmt.Errorf("capability is not supported by KVM")
+	errorTooManyNICs           = fmt.Errorf("too many NICs")
+	errorInvalidNIC            = fmt.Errorf("invalid NIC")
 )
 
-var errorPCIDeviceNotFoundForPort = fmt.Errorf("pci device cannot be found for port")
+// memRegion is a range of guest physical memory backed by Machine.mem. Since
+// Machine.mem also covers the PCI hole, the guest physical address can be used
+// as the offset in Machine.mem.
+type memRegion struct {
+	gpa, size uint64
+}
 
 type Machine struct {
 	kvmFd, vmFd    uintptr
 	vcpuFds        []uintptr
 	mem            []byte
+	memRegions     []memRegion
 	runs           []*kvm.RunData
 	pci            *pci.PCI
-	serial         *serial.Serial
+	serials        [len(serialPorts)]*serial.Serial
+	serialMu       sync.Mutex
+	serialLevels   [len(serialPorts)]bool
+	pm             *acpi.PM
+	rtc            *rtc.RTC
+	nets           []*virtio.Net
+	blk            *virtio.Blk
+	virtioMMIO     []*virtio.MMIO
+	virtioPCI      []*virtio.PCI
 	ioportHandlers [0x10000][2]func(m *Machine, port uint64, bytes []byte) error
+	mmioBus        *mmio.Bus
+
+	// The kernel loaded by LoadLinux, which is loaded again on reset.
+	bzImagePath, initrdPath, params string
+
+	// initial is the state just after the machine is created, which is
+	// restored on reset.
+	initial *snapshot
+
+	// poweredOff is closed when the guest powers off.
+	poweredOff     chan struct{}
+	poweredOffOnce sync.Once
+
+	// noReboot makes the VM power off instead of rebooting on the reset
+	// requested by the guest.
+	noReboot bool
+
+	// resetting is set while the reset requested by the guest is in
+	// progress, so that the requests from the other vCPUs are ignored.
+	resetMu   sync.Mutex
+	resetting bool
+
+	// pauseMu protects the fields below, which are used to park the vCPU
+	// threads running RunInfiniteLoop. The vCPUs are paused while
+	// pauseCount is positive.
+	pauseMu    sync.Mutex
+	pauseCond  *sync.Cond
+	pauseCount int
+	nRunning   int
+	nParked    int
+	vcpuTids   []int
+
+	// userPaused is set by Pause, and protected by userPauseMu.
+	userPauseMu sync.Mutex
+	userPaused  bool
+
+	// debugMu protects the fields for the debugger.
+	debugMu      sync.Mutex
+	guestDebug   []kvm.GuestDebug
+	debugHandler func(cpu int, exit kvm.DebugExitArch) bool
+}
+
+// NIC is the configuration of a network interface backed by a tap device.
+type NIC struct {
+	TapIfName string
+
+	// MAC is the MAC address, which is derived from TapIfName if nil.
+	MAC net.HardwareAddr
+
+	// Queues is the number of the queue pairs of virtio-net, each of which
+	// is backed by a queue of the tap device. 0 is the same as 1.
+	Queues int
 }
 
-func New(nCpus int, tapIfName string) (*Machine, error) {
-	m := &Machine{}
+// New creates a VM. The virtio devices are attached to the PCI bus, or to
+// virtio-mmio if virtioMMIO is true for the kernels without PCI support.
+func New(nCpus int, nics []NIC, diskPath string, memSize int, virtioMMIO bool) (*Machine, error) {
+	m := &Machine{mmioBus: mmio.New(), poweredOff: make(chan struct{})}
+	m.pauseCond = sync.NewCond(&m.pauseMu)
+
+	if memSize < minMemSize || memSize%pageSize != 0 {
+		return m, fmt.Errorf("%w: 0x%x", errorInvalidMemSize, memSize)
+	}
 
 	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
 	if err != nil {
@@ -78,9 +232,27 @@ func New(nCpus int, tapIfName string) (*Machine, error) {
 	}
 
 	m.kvmFd = devKVM.Fd()
+
+	// ImmediateExit is used to pause the vCPUs.
+	if ret, err := kvm.CheckExtension(m.kvmFd, kvm.CapImmediateExit); err != nil || ret == 0 {
+		return m, fmt.Errorf("%w: KVM_CAP_IMMEDIATE_EXIT", errorUnsupportedCapability)
+	}
+
+	// The notifications and the interrupts of the virtio devices bypass
+	// userspace by eventfds.
+	if ret, err := kvm.CheckExtension(m.kvmFd, kvm.CapIOEventFD); err != nil || ret == 0 {
+		return m, fmt.Errorf("%w: KVM_CAP_IOEVENTFD", errorUnsupportedCapability)
+	}
+
+	if ret, err := kvm.CheckExtension(m.kvmFd, kvm.CapIRQFD); err != nil || ret == 0 {
+		return m, fmt.Errorf("%w: KVM_CAP_IRQFD", errorUnsupportedCapability)
+	}
+
 	m.vmFd, err = kvm.CreateVM(m.kvmFd)
 	m.vcpuFds = make([]uintptr, nCpus)
 	m.runs = make([]*kvm.RunData, nCpus)
+	m.vcpuTids = make([]int, nCpus)
+	m.guestDebug = make([]kvm.GuestDebug, nCpus)
 
 	if err != nil {
 		return m, err
@@ -128,20 +300,33 @@ func New(nCpus int, tapIfName string) (*Machine, error) {
 		m.runs[i] = (*kvm.RunData)(unsafe.Pointer(&r[0]))
 	}
 
-	m.mem, err = syscall.Mmap(-1, 0, memSize,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS)
-	if err != nil {
-		return m, err
+	m.memRegions = []memRegion{{gpa: 0, size: uint64(memSize)}}
+	if memSize > pciHoleStart {
+		m.memRegions = []memRegion{
+			{gpa: 0, size: pciHoleStart},
+			{gpa: pciHoleEnd, size: uint64(memSize) - pciHoleStart},
+		}
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: 1 << 30,
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
+	last := m.memRegions[len(m.memRegions)-1]
+
+	// The pages in the PCI hole are never touched, so they consume no host memory.
+	m.mem, err = syscall.Mmap(-1, 0, int(last.gpa+last.size),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_ANONYMOUS|syscall.MAP_NORESERVE)
 	if err != nil {
 		return m, err
 	}
 
+	for i, r := range m.memRegions {
+		err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+			Slot: uint32(i), Flags: 0, GuestPhysAddr: r.gpa, MemorySize: r.size,
+			UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[r.gpa]))),
+		})
+		if err != nil {
+			return m, err
+		}
+	}
+
 	e, err := ebda.New(nCpus)
 	if err != nil {
 		return m, err
@@ -154,19 +339,97 @@ func New(nCpus int, tapIfName string) (*Machine, error) {
 
 	copy(m.mem[bootparam.EBDAStart:], bytes)
 
-	t, err := tap.New(tapIfName)
-	if err != nil {
-		panic(err)
+	if len(nics) > len(netIRQs) {
+		return m, fmt.Errorf("%w: up to %d", errorTooManyNICs, len(netIRQs))
 	}
 
-	v := virtio.NewNet(virtioNetIRQ, m, t, m.mem)
-	go v.TxThreadEntry()
-	go v.RxThreadEntry()
+	// The IO ports of the legacy interfaces are allocated in the order of
+	// the slots, the NICs followed by the disk.
+	for i, nic := range nics {
+		if nic.Queues == 0 {
+			nic.Queues = 1
+		}
+
+		taps, err := tap.NewMultiQueue(nic.TapIfName, nic.Queues)
+		if err != nil {
+			panic(err)
+		}
 
-	m.pci = pci.New(
-		pci.NewBridge(), // 00:00.0 for PCI bridge
-		v,               // 00:01.0 for Virtio PCI
-	)
+		if nic.MAC == nil {
+			nic.MAC = defaultMAC(nic.TapIfName)
+		}
+
+		queues := []io.ReadWriter{}
+		for _, t := range taps {
+			queues = append(queues, t)
+		}
+
+		irq, err := m.newVirtioIRQ(netIRQs[i])
+		if err != nil {
+			return m, err
+		}
+
+		n := virtio.NewMultiQueueNet(uint8(netIRQs[i]), irq, queues, m.mem)
+		n.IOBase = virtio.IOPortStart + uint64(i)*virtio.IOPortSize
+		n.SetMAC(nic.MAC)
+		m.nets = append(m.nets, n)
+
+		for j := range taps {
+			go n.QueuePairThreadEntry(j)
+		}
+	}
+
+	m.pci = pci.New(pci.NewBridge()) // 00:00.0 for PCI bridge
+
+	if diskPath != "" {
+		irq, err := m.newVirtioIRQ(virtioBlkIRQ)
+		if err != nil {
+			return m, err
+		}
+
+		if m.blk, err = virtio.NewBlk(diskPath, virtioBlkIRQ, irq, m.mem); err != nil {
+			return m, err
+		}
+
+		m.blk.IOBase = virtio.IOPortStart + uint64(len(m.nets))*virtio.IOPortSize
+
+		go m.blk.IOThreadEntry()
+	}
+
+	if virtioMMIO {
+		if err := m.attachVirtioMMIO(); err != nil {
+			return m, err
+		}
+	} else if err := m.attachVirtioPCI(); err != nil {
+		return m, err
+	}
+
+	for i, p := range serialPorts {
+		// Only COM1 is connected to the standard output by default.
+		out := ioutil.Discard
+		if i == 0 {
+			out = os.Stdout
+		}
+
+		if m.serials[i], err = serial.New(p.addr, &serialIRQLine{m: m, port: i}, out); err != nil {
+			return m, err
+		}
+	}
+
+	m.pm = acpi.NewPM(&pmPlatform{m: m})
+
+	rtcConfig := rtc.Config{LowMem: m.memRegions[0].size}
+	if len(m.memRegions) > 1 {
+		rtcConfig.HighMem = m.memRegions[1].size
+	}
+
+	m.rtc = rtc.New(m, rtcConfig)
+
+	m.initIOPortHandlers()
+
+	if m.initial, err = m.initialState(); err != nil {
+		return m, err
+	}
 
 	return m, nil
 }
@@ -176,14 +439,135 @@ func (m *Machine) RunData() []*kvm.RunData {
 	return m.runs
 }
 
-func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
-	// Load initrd
-	initrd, err := ioutil.ReadFile(initPath)
-	if err != nil {
-		return err
+// virtioDevice is a virtio device with its IRQ.
+type virtioDevice struct {
+	name string
+	dev  virtio.LegacyDevice
+	irq  uint32
+
+	// irqInjector is the IRQInjector of the device, which is replaced by the
+	// transport.
+	irqInjector *virtio.IRQInjector
+}
+
+// virtioDevices returns the virtio devices in the order of the slots, the
+// NICs followed by the disk.
+func (m *Machine) virtioDevices() []virtioDevice {
+	devs := []virtioDevice{}
+
+	for i, n := range m.nets {
+		devs = append(devs, virtioDevice{fmt.Sprintf("virtio-net%d", i), n, netIRQs[i], &n.IRQInjector})
 	}
 
-	copy(m.mem[initrdAddr:], initrd)
+	if m.blk != nil {
+		devs = append(devs, virtioDevice{"virtio-blk", m.blk, virtioBlkIRQ, &m.blk.IRQInjector})
+	}
+
+	return devs
+}
+
+// attachVirtioMMIO attaches the virtio devices to virtio-mmio transports,
+// which notify the devices of the interrupts instead of the machine.
+func (m *Machine) attachVirtioMMIO() error {
+	for i, d := range m.virtioDevices() {
+		t := virtio.NewMMIO(virtioMMIOBase+uint64(i)*virtio.MMIOSize, uint8(d.irq), d.dev, *d.irqInjector)
+		*d.irqInjector = t
+		m.virtioMMIO = append(m.virtioMMIO, t)
+
+		start, end := t.GetMMIORange()
+		if err := m.RegisterMMIO(start, end-start, t); err != nil {
+			return err
+		}
+
+		if err := m.attachNotifyFDs(t, d.dev.NumQueues(), 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attachVirtioPCI attaches the virtio devices to the PCI bus from 00:01.0
+// with the modern interface, whose memory BARs are mapped on the MMIO bus.
+func (m *Machine) attachVirtioPCI() error {
+	for i, d := range m.virtioDevices() {
+		t := virtio.NewPCI(d.dev, virtioPCIBase+uint64(i)*virtio.PCIBARSize, *d.irqInjector)
+		*d.irqInjector = t
+		m.virtioPCI = append(m.virtioPCI, t)
+		m.pci.Devices = append(m.pci.Devices, t)
+
+		start, end := t.GetMMIORange()
+		if err := m.RegisterMMIO(start, end-start, t); err != nil {
+			return err
+		}
+
+		if err := m.attachNotifyFDs(t, d.dev.NumQueues(), 0); err != nil {
+			return err
+		}
+
+		// The legacy driver notifies the queues by the IO port in BAR0.
+		if err := m.attachNotifyFDs(t.LegacyNotifier(), d.dev.NumQueues(), kvm.IOEventFDFlagPIO); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// virtioNotifier is a virtio transport which serves the notifications
+// delivered by eventfds.
+type virtioNotifier interface {
+	NotifyAddr(sel int) (uint64, uint32)
+	ServeNotifyFD(sel int, e *eventfd.EventFD)
+}
+
+// attachNotifyFDs assigns an eventfd to the notification of each virt queue
+// by KVM_IOEVENTFD, so that the vCPU does not exit to userspace on it. The
+// notification is written to the IO port instead of MMIO with
+// kvm.IOEventFDFlagPIO in flags.
+func (m *Machine) attachNotifyFDs(t virtioNotifier, nQueues int, flags uint32) error {
+	for sel := 0; sel < nQueues; sel++ {
+		e, err := eventfd.New()
+		if err != nil {
+			return err
+		}
+
+		addr, size := t.NotifyAddr(sel)
+
+		if err := kvm.SetIOEventFD(m.vmFd, &kvm.IOEventFD{
+			DataMatch: uint64(sel),
+			Addr:      addr,
+			Len:       size,
+			FD:        int32(e.FD()),
+			Flags:     kvm.IOEventFDFlagDataMatch | flags,
+		}); err != nil {
+			e.Close()
+
+			return err
+		}
+
+		go t.ServeNotifyFD(sel, e)
+	}
+
+	return nil
+}
+
+// LoadLinux loads the kernel and the initrd into the guest memory, and sets up
+// the vCPUs to boot it.
+func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
+	m.bzImagePath, m.initrdPath, m.params = bzImagePath, initPath, params
+
+	return m.loadLinux()
+}
+
+func (m *Machine) loadLinux() error {
+	bzImagePath, initPath, params := m.bzImagePath, m.initrdPath, m.params
+
+	// virtio-mmio devices are not discoverable, so they are given to the
+	// kernel by the command-line parameters.
+	for _, d := range m.virtioMMIO {
+		params += " " + d.KernelParam()
+	}
 
 	// Load kernel command-line parameters
 	copy(m.mem[cmdlineAddr:], params)
@@ -195,6 +579,19 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 		return err
 	}
 
+	// Load initrd
+	initrd, err := ioutil.ReadFile(initPath)
+	if err != nil {
+		return err
+	}
+
+	initrdAddr, err := m.initrdAddr(bootParam, len(initrd))
+	if err != nil {
+		return err
+	}
+
+	copy(m.mem[initrdAddr:], initrd)
+
 	// refs https://github.com/kvmtool/kvmtool/blob/0e1882a49f81cb15d328ef83a78849c0ea26eecc/x86/bios.c#L66-L86
 	bootParam.AddE820Entry(
 		bootparam.RealModeIvtBegin,
@@ -206,20 +603,33 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 		bootparam.VGARAMBegin-bootparam.EBDAStart,
 		bootparam.E820Reserved,
 	)
+	bootParam.AddE820Entry(
+		bootparam.ACPITablesBegin,
+		bootparam.MBBIOSBegin-bootparam.ACPITablesBegin,
+		bootparam.E820ACPI,
+	)
 	bootParam.AddE820Entry(
 		bootparam.MBBIOSBegin,
 		bootparam.MBBIOSEnd-bootparam.MBBIOSBegin,
 		bootparam.E820Reserved,
 	)
-	bootParam.AddE820Entry(
-		kernelAddr,
-		memSize-kernelAddr,
-		bootparam.E820Ram,
-	)
+
+	for i, r := range m.memRegions {
+		start := r.gpa
+		if i == 0 {
+			start = kernelAddr
+		}
+
+		bootParam.AddE820Entry(
+			start,
+			r.gpa+r.size-start,
+			bootparam.E820Ram,
+		)
+	}
 
 	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
 	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
-	bootParam.Hdr.RamdiskImage = initrdAddr                                                         // Proto 2.00+
+	bootParam.Hdr.RamdiskImage = uint32(initrdAddr)                                                 // Proto 2.00+
 	bootParam.Hdr.RamdiskSize = uint32(len(initrd))                                                 // Proto 2.00+
 	bootParam.Hdr.LoadFlags |= bootparam.CanUseHeap | bootparam.LoadedHigh | bootparam.KeepSegments // Proto 2.00+
 	bootParam.Hdr.HeapEndPtr = 0xFE00                                                               // Proto 2.01+
@@ -234,6 +644,10 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 
 	copy(m.mem[bootParamAddr:], bytes)
 
+	if err := m.loadACPITables(); err != nil {
+		return err
+	}
+
 	// Load kernel
 	bzImage, err := ioutil.ReadFile(bzImagePath)
 	if err != nil {
@@ -260,17 +674,123 @@ func (m *Machine) LoadLinux(bzImagePath, initPath, params string) error {
 		}
 	}
 
-	m.initIOPortHandlers()
+	return nil
+}
 
-	if m.serial, err = serial.New(m); err != nil {
+// loadACPITables places the ACPI tables in the BIOS area, where the kernel
+// finds RSDP.
+func (m *Machine) loadACPITables() error {
+	tables, err := acpi.New(bootparam.ACPITablesBegin, acpi.Config{
+		NumCPUs: len(m.vcpuFds),
+		SCI:     acpiSCI,
+		PCI:     m.pciConfig(),
+	})
+	if err != nil {
+		return err
+	}
+
+	bytes, err := tables.Bytes(bootparam.MBBIOSBegin - bootparam.ACPITablesBegin)
+	if err != nil {
 		return err
 	}
 
+	copy(m.mem[bootparam.ACPITablesBegin:], bytes)
+
 	return nil
 }
 
-func (m *Machine) GetInputChan() chan<- byte {
-	return m.serial.GetInputChan()
+// pciConfig returns the resources of the PCI host bridge, where the virtio
+// PCI devices are in the slots from 1.
+func (m *Machine) pciConfig() acpi.PCIConfig {
+	c := acpi.PCIConfig{
+		IOBase:   0xffff,
+		MemBase:  pciHoleStart,
+		MemLimit: ioapicAddr - 1,
+	}
+
+	devs := m.virtioDevices()
+
+	for i, d := range m.virtioPCI {
+		start, end := d.GetIORange()
+
+		if uint16(start) < c.IOBase {
+			c.IOBase = uint16(start)
+		}
+
+		if uint16(end-1) > c.IOLimit {
+			c.IOLimit = uint16(end - 1)
+		}
+
+		c.Routes = append(c.Routes, acpi.PCIRoute{Slot: uint8(i + 1), IRQ: devs[i].irq})
+	}
+
+	return c
+}
+
+// initrdAddr returns the page-aligned address to load the initrd, which is as
+// high as possible in low memory but not above the limit in the header.
+//
+// refs: https://www.kernel.org/doc/html/latest/x86/boot.html#details-of-header-fields
+func (m *Machine) initrdAddr(bootParam *bootparam.BootParam, size int) (uint64, error) {
+	end := m.memRegions[0].size
+	if max := uint64(bootParam.Hdr.InitrdAddrMax) + 1; max < end {
+		end = max
+	}
+
+	// The initrd must not overlap the kernel, which is expanded in place up to
+	// init_size bytes.
+	lowest := uint64(kernelAddr + bootParam.Hdr.InitSize)
+
+	if end < lowest || end-lowest < uint64(size) {
+		return 0, fmt.Errorf("%w: 0x%x bytes", errorInitrdTooLarge, size)
+	}
+
+	return (end - uint64(size)) &^ (pageSize - 1), nil
+}
+
+// SetSerialBackend connects the serial port (0 for COM1) to the backend. By
+// default, COM1 is connected to the standard output and the others to none.
+// If in is not nil, it is read for the input to the guest.
+func (m *Machine) SetSerialBackend(port int, out io.Writer, in io.Reader) error {
+	if port < 0 || port >= len(m.serials) {
+		return fmt.Errorf("%w: %d", errorInvalidSerialPort, port)
+	}
+
+	m.serials[port].SetOutput(out)
+
+	if in != nil {
+		go func() {
+			if err := m.serials[port].ReadInput(in); err != nil {
+				fmt.Fprintf(os.Stderr, "serial port %d: %v\n", port, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// SerialInput passes the byte typed on the standard input to the guest
+// through the serial port.
+func (m *Machine) SerialInput(port int, b byte) error {
+	if port < 0 || port >= len(m.serials) {
+		return fmt.Errorf("%w: %d", errorInvalidSerialPort, port)
+	}
+
+	m.serials[port].Receive(b)
+
+	return nil
+}
+
+// SerialBreak sends a break to the guest through the serial port, e.g. for
+// the magic SysRq key of Linux.
+func (m *Machine) SerialBreak(port int) error {
+	if port < 0 || port >= len(m.serials) {
+		return fmt.Errorf("%w: %d", errorInvalidSerialPort, port)
+	}
+
+	m.serials[port].ReceiveWithError(0, serial.Break|serial.FramingError)
+
+	return nil
 }
 
 func (m *Machine) initRegs(i int) error {
@@ -359,7 +879,12 @@ func (m *Machine) RunInfiniteLoop(i int) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	m.enterLoop(i)
+	defer m.exitLoop(i)
+
 	for {
+		m.parkIfPaused()
+
 		isContinue, err := m.RunOnce(i)
 		if err != nil {
 			return err
@@ -371,7 +896,285 @@ func (m *Machine) RunInfiniteLoop(i int) error {
 	}
 }
 
+func (m *Machine) enterLoop(i int) {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	m.vcpuTids[i] = syscall.Gettid()
+	m.nRunning++
+}
+
+func (m *Machine) exitLoop(i int) {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	m.vcpuTids[i] = 0
+	m.nRunning--
+	m.pauseCond.Broadcast()
+}
+
+func (m *Machine) parkIfPaused() {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	if m.pauseCount == 0 {
+		return
+	}
+
+	m.nParked++
+	m.pauseCond.Broadcast()
+
+	for m.pauseCount > 0 {
+		m.pauseCond.Wait()
+	}
+
+	m.nParked--
+}
+
+// Pause stops all the vCPUs until Resume is called, and waits until they are
+// stopped. It does nothing but waiting if the VM has been already paused.
+func (m *Machine) Pause() error {
+	if err := m.requestPause(); err != nil {
+		return err
+	}
+
+	m.waitParked()
+
+	return nil
+}
+
+// requestPause pauses the VM like Pause without waiting for the vCPUs, so
+// that it can be called from a vCPU thread, which is parked after it returns.
+func (m *Machine) requestPause() error {
+	m.userPauseMu.Lock()
+	defer m.userPauseMu.Unlock()
+
+	if m.userPaused {
+		return nil
+	}
+
+	if err := m.kick(); err != nil {
+		m.resume()
+
+		return err
+	}
+
+	m.userPaused = true
+
+	return nil
+}
+
+// Resume restarts the vCPUs stopped by Pause.
+func (m *Machine) Resume() {
+	m.userPauseMu.Lock()
+	defer m.userPauseMu.Unlock()
+
+	if !m.userPaused {
+		return
+	}
+
+	m.userPaused = false
+	m.resume()
+}
+
+// Paused reports whether the VM is paused by Pause.
+func (m *Machine) Paused() bool {
+	m.userPauseMu.Lock()
+	defer m.userPauseMu.Unlock()
+
+	return m.userPaused
+}
+
+// Reset reboots the VM. The vCPUs and the devices are brought back to the
+// state just after New, and the kernel given to LoadLinux is loaded again.
+// It fails for the VM restored from a snapshot, whose kernel is unknown.
+func (m *Machine) Reset() error {
+	if m.bzImagePath == "" {
+		return errorNoKernel
+	}
+
+	err := m.pause()
+	defer m.resume()
+
+	if err != nil {
+		return err
+	}
+
+	if err := m.restore(m.initial); err != nil {
+		return err
+	}
+
+	return m.loadLinux()
+}
+
+// VCPURegs returns the registers of the vCPU. The VM is paused while they are
+// read, so that they are consistent.
+func (m *Machine) VCPURegs(i int) (kvm.Regs, kvm.Sregs, error) {
+	if i < 0 || i >= len(m.vcpuFds) {
+		return kvm.Regs{}, kvm.Sregs{}, fmt.Errorf("%w: %d", errorInvalidVCPU, i)
+	}
+
+	err := m.pause()
+	defer m.resume()
+
+	if err != nil {
+		return kvm.Regs{}, kvm.Sregs{}, err
+	}
+
+	regs, err := kvm.GetRegs(m.vcpuFds[i])
+	if err != nil {
+		return regs, kvm.Sregs{}, err
+	}
+
+	sregs, err := kvm.GetSregs(m.vcpuFds[i])
+
+	return regs, sregs, err
+}
+
+// Status is the status of the VM.
+type Status struct {
+	Paused  bool
+	NumCPUs int
+	MemSize uint64
+	Devices []DeviceStatus
+}
+
+// DeviceStatus is the status of a device. DriverStatus is the device status
+// of virtio written by the driver, and 0 for the other devices.
+type DeviceStatus struct {
+	Name         string
+	IOPortStart  uint64
+	IOPortEnd    uint64
+	MMIOStart    uint64
+	MMIOEnd      uint64
+	IRQ          uint32
+	DriverStatus uint8
+}
+
+func (m *Machine) Status() Status {
+	s := Status{Paused: m.Paused(), NumCPUs: len(m.vcpuFds)}
+
+	for _, r := range m.memRegions {
+		s.MemSize += r.size
+	}
+
+	for i, p := range serialPorts {
+		s.Devices = append(s.Devices, DeviceStatus{
+			Name:        fmt.Sprintf("serial%d", i),
+			IOPortStart: p.addr,
+			IOPortEnd:   p.addr + 8,
+			IRQ:         p.irq,
+		})
+	}
+
+	s.Devices = append(s.Devices, DeviceStatus{
+		Name:        "rtc",
+		IOPortStart: rtc.IndexPort,
+		IOPortEnd:   rtc.DataPort + 1,
+		IRQ:         rtc.IRQ,
+	})
+
+	s.Devices = append(s.Devices, DeviceStatus{
+		Name:        "acpi-pm",
+		IOPortStart: acpi.PM1EventBlock,
+		IOPortEnd:   acpi.ResetRegister + 1,
+		IRQ:         acpiSCI,
+	})
+
+	for i, d := range m.virtioDevices() {
+		ds := DeviceStatus{Name: d.name, IRQ: d.irq}
+
+		if len(m.virtioMMIO) > 0 {
+			ds.MMIOStart, ds.MMIOEnd = m.virtioMMIO[i].GetMMIORange()
+			ds.DriverStatus = m.virtioMMIO[i].DriverStatus()
+		} else {
+			ds.IOPortStart, ds.IOPortEnd = m.virtioPCI[i].GetIORange()
+			ds.MMIOStart, ds.MMIOEnd = m.virtioPCI[i].GetMMIORange()
+			ds.DriverStatus = m.virtioPCI[i].DriverStatus()
+		}
+
+		s.Devices = append(s.Devices, ds)
+	}
+
+	return s
+}
+
+// pause stops all the vCPUs and waits until each of them is parked in
+// RunInfiniteLoop. A vCPU in KVM_RUN is kicked out by a signal, and
+// ImmediateExit covers the race where the signal arrives before KVM_RUN.
+// The vCPUs are kept paused until resume is called as many times as pause.
+func (m *Machine) pause() error {
+	if err := m.kick(); err != nil {
+		return err
+	}
+
+	m.waitParked()
+
+	return nil
+}
+
+// kick makes the running vCPUs exit to be parked. It must be paired with
+// resume even on error.
+func (m *Machine) kick() error {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	m.pauseCount++
+
+	if m.pauseCount > 1 {
+		return nil
+	}
+
+	for i := range m.runs {
+		m.runs[i].ImmediateExit = 1
+	}
+
+	for _, tid := range m.vcpuTids {
+		if tid == 0 {
+			continue
+		}
+
+		if err := syscall.Tgkill(syscall.Getpid(), tid, kickSignal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitParked waits until all the running vCPUs are parked, or the VM is
+// resumed meanwhile.
+func (m *Machine) waitParked() {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	for m.pauseCount > 0 && m.nParked < m.nRunning {
+		m.pauseCond.Wait()
+	}
+}
+
+func (m *Machine) resume() {
+	m.pauseMu.Lock()
+	defer m.pauseMu.Unlock()
+
+	m.pauseCount--
+
+	if m.pauseCount > 0 {
+		return
+	}
+
+	for i := range m.runs {
+		m.runs[i].ImmediateExit = 0
+	}
+
+	m.pauseCond.Broadcast()
+}
+
 func (m *Machine) RunOnce(i int) (bool, error) {
+	// KVM_RUN returns EINTR without updating the exit reason if ImmediateExit
+	// is set, so the previous exit must not be handled again.
+	m.runs[i].ExitReason = kvm.EXITUNKNOWN
+
 	err := kvm.Run(m.vcpuFds[i])
 
 	switch m.runs[i].ExitReason {
@@ -390,6 +1193,23 @@ func (m *Machine) RunOnce(i int) (bool, error) {
 			}
 		}
 
+		return true, err
+	case kvm.EXITMMIO:
+		if err := m.handleMMIO(m.runs[i].MMIO()); err != nil {
+			return false, err
+		}
+
+		return true, err
+	case kvm.EXITSHUTDOWN:
+		// The guest has caused a triple fault, on which PCs are reset.
+		m.requestReset()
+
+		return true, err
+	case kvm.EXITDEBUG:
+		if err := m.handleDebug(i, m.runs[i].Debug()); err != nil {
+			return false, err
+		}
+
 		return true, err
 	case kvm.EXITUNKNOWN:
 		return true, err
@@ -406,6 +1226,37 @@ func (m *Machine) RunOnce(i int) (bool, error) {
 	}
 }
 
+// RegisterMMIO maps the device into the guest physical address range
+// [base, base+size). Accesses to the range are dispatched to the device
+// from RunOnce.
+func (m *Machine) RegisterMMIO(base, size uint64, dev mmio.Device) error {
+	return m.mmioBus.Register(base, size, dev)
+}
+
+func (m *Machine) handleMMIO(physAddr uint64, data []byte, isWrite bool) error {
+	var err error
+
+	if isWrite {
+		err = m.mmioBus.Write(physAddr, data)
+	} else {
+		err = m.mmioBus.Read(physAddr, data)
+	}
+
+	// As on real hardware, reads from the address where no device is mapped
+	// return all ones and writes to it are discarded.
+	if errors.Is(err, mmio.ErrNoDevice) {
+		if !isWrite {
+			for i := range data {
+				data[i] = 0xff
+			}
+		}
+
+		return nil
+	}
+
+	return err
+}
+
 func (m *Machine) initIOPortHandlers() {
 	funcNone := func(m *Machine, port uint64, bytes []byte) error {
 		return nil
@@ -432,31 +1283,11 @@ func (m *Machine) initIOPortHandlers() {
 			m.ioportHandlers[port][dir] = funcNone
 		}
 
-		// CMOS clock
-		for port := 0x70; port <= 0x71; port++ {
-			m.ioportHandlers[port][dir] = funcNone
-		}
-
 		// DMA Page Registers (Commonly 74L612 Chip)
 		for port := 0x80; port <= 0x9f; port++ {
 			m.ioportHandlers[port][dir] = funcNone
 		}
 
-		// Serial port 2
-		for port := 0x2f8; port <= 0x2ff; port++ {
-			m.ioportHandlers[port][dir] = funcNone
-		}
-
-		// Serial port 3
-		for port := 0x3e8; port <= 0x3ef; port++ {
-			m.ioportHandlers[port][dir] = funcNone
-		}
-
-		// Serial port 4
-		for port := 0x2e8; port <= 0x2ef; port++ {
-			m.ioportHandlers[port][dir] = funcNone
-		}
-
 		// unknown
 		for port := 0xcfe; port <= 0xcfe; port++ {
 			m.ioportHandlers[port][dir] = funcNone
@@ -490,13 +1321,55 @@ func (m *Machine) initIOPortHandlers() {
 		m.ioportHandlers[port][kvm.EXITIOOUT] = funcNone
 	}
 
-	// Serial port 1
-	for port := serial.COM1Addr; port < serial.COM1Addr+8; port++ {
+	m.ioportHandlers[i8042CommandPort][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+		if bytes[0] == i8042PulseReset {
+			m.requestReset()
+		}
+
+		return nil
+	}
+
+	// Reset control register, which reads as zero
+	m.ioportHandlers[resetControlPort][kvm.EXITIOIN] = funcNone
+	m.ioportHandlers[resetControlPort][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+		if bytes[0]&resetControlCPU != 0 {
+			m.requestReset()
+		}
+
+		return nil
+	}
+
+	// Serial ports
+	for i, p := range serialPorts {
+		s := m.serials[i]
+
+		for port := p.addr; port < p.addr+8; port++ {
+			m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
+				return s.In(port, bytes)
+			}
+			m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+				return s.Out(port, bytes)
+			}
+		}
+	}
+
+	// CMOS clock
+	for port := rtc.IndexPort; port <= rtc.DataPort; port++ {
 		m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
-			return m.serial.In(port, bytes)
+			return m.rtc.In(port, bytes)
 		}
 		m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
-			return m.serial.Out(port, bytes)
+			return m.rtc.Out(port, bytes)
+		}
+	}
+
+	// ACPI fixed hardware
+	for port := uint64(acpi.PM1EventBlock); port <= acpi.ResetRegister; port++ {
+		m.ioportHandlers[port][kvm.EXITIOIN] = func(m *Machine, port uint64, bytes []byte) error {
+			return m.pm.In(port, bytes)
+		}
+		m.ioportHandlers[port][kvm.EXITIOOUT] = func(m *Machine, port uint64, bytes []byte) error {
+			return m.pm.Out(port, bytes)
 		}
 	}
 
@@ -554,22 +1427,192 @@ func pciOutFunc(m *Machine, port uint64, bytes []byte) error {
 	return errorPCIDeviceNotFoundForPort
 }
 
-func (m *Machine) InjectSerialIRQ() {
-	if err := kvm.IRQLine(m.vmFd, serialIRQ, 0); err != nil {
+// serialIRQLine is the interrupt line of a serial port, which is shared with
+// another port.
+type serialIRQLine struct {
+	m    *Machine
+	port int
+}
+
+func (l *serialIRQLine) SetSerialIRQ(level bool) {
+	l.m.setSerialIRQ(l.port, level)
+}
+
+// setSerialIRQ sets the level of the IRQ to that of the ports sharing it ORed.
+func (m *Machine) setSerialIRQ(port int, level bool) {
+	m.serialMu.Lock()
+	defer m.serialMu.Unlock()
+
+	m.serialLevels[port] = level
+	irq := serialPorts[port].irq
+	l := uint32(0)
+
+	for i, p := range serialPorts {
+		if p.irq == irq && m.serialLevels[i] {
+			l = 1
+		}
+	}
+
+	if err := kvm.IRQLine(m.vmFd, irq, l); err != nil {
 		panic(err)
 	}
+}
+
+// SetRTCTime sets the clock of RTC, which is the host time by default.
+func (m *Machine) SetRTCTime(t time.Time) {
+	m.rtc.SetTime(t)
+}
+
+// SetLinkUp connects or disconnects the cable of the NIC.
+func (m *Machine) SetLinkUp(nic int, up bool) error {
+	if nic < 0 || nic >= len(m.nets) {
+		return fmt.Errorf("%w: %d", errorInvalidNIC, nic)
+	}
 
-	if err := kvm.IRQLine(m.vmFd, serialIRQ, 1); err != nil {
+	m.nets[nic].SetLinkUp(up)
+
+	return nil
+}
+
+// SetRTCIRQ sets the level of IRQ 8 on behalf of RTC.
+func (m *Machine) SetRTCIRQ(level bool) {
+	l := uint32(0)
+	if level {
+		l = 1
+	}
+
+	if err := kvm.IRQLine(m.vmFd, rtc.IRQ, l); err != nil {
 		panic(err)
 	}
 }
 
-func (m *Machine) InjectVirtioNetIRQ() {
-	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 0); err != nil {
+// PressPowerButton sends the ACPI power button event to the guest, which is
+// expected to shut down.
+func (m *Machine) PressPowerButton() {
+	m.pm.PressPowerButton()
+}
+
+// PoweredOff returns the channel closed when the guest powers off, or resets
+// the system with SetNoReboot. The vCPUs are stopped then.
+func (m *Machine) PoweredOff() <-chan struct{} {
+	return m.poweredOff
+}
+
+func (m *Machine) powerOff() {
+	m.poweredOffOnce.Do(func() {
+		// The vCPUs are never resumed.
+		_ = m.kick()
+
+		close(m.poweredOff)
+	})
+}
+
+// SetNoReboot sets whether the VM powers off instead of rebooting when the
+// guest resets the system.
+func (m *Machine) SetNoReboot(noReboot bool) {
+	m.noReboot = noReboot
+}
+
+// requestReset resets the VM on the request from the guest. It is called on a
+// vCPU thread, so the reset is done in another goroutine, which waits for all
+// the vCPUs including the caller to be parked. The vCPUs are kicked here so
+// that the guest does not run any further.
+func (m *Machine) requestReset() {
+	if m.noReboot {
+		m.powerOff()
+
+		return
+	}
+
+	m.resetMu.Lock()
+	defer m.resetMu.Unlock()
+
+	if m.resetting {
+		return
+	}
+
+	if err := m.kick(); err != nil {
+		m.resume()
+		fmt.Fprintf(os.Stderr, "failed to reset: %v\n", err)
+
+		return
+	}
+
+	m.resetting = true
+
+	go func() {
+		defer m.resume()
+
+		defer func() {
+			m.resetMu.Lock()
+			m.resetting = false
+			m.resetMu.Unlock()
+		}()
+
+		if err := m.Reset(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reset, powering off: %v\n", err)
+			m.powerOff()
+		}
+	}()
+}
+
+// pmPlatform connects the ACPI fixed hardware to the machine.
+type pmPlatform struct {
+	m *Machine
+}
+
+func (p *pmPlatform) SetSCI(level bool) {
+	l := uint32(0)
+	if level {
+		l = 1
+	}
+
+	if err := kvm.IRQLine(p.m.vmFd, acpiSCI, l); err != nil {
 		panic(err)
 	}
+}
 
-	if err := kvm.IRQLine(m.vmFd, virtioNetIRQ, 1); err != nil {
+func (p *pmPlatform) PowerOff() {
+	p.m.powerOff()
+}
+
+func (p *pmPlatform) Reset() {
+	p.m.requestReset()
+}
+
+// virtioIRQ is the interrupt of a virtio device, which is injected by KVM
+// when the eventfd assigned by KVM_IRQFD is signaled.
+type virtioIRQ struct {
+	fd *eventfd.EventFD
+}
+
+// newVirtioIRQ returns the interrupt of the IRQ.
+func (m *Machine) newVirtioIRQ(irq uint32) (*virtioIRQ, error) {
+	e, err := eventfd.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := kvm.SetIRQFD(m.vmFd, &kvm.IRQFD{FD: uint32(e.FD()), GSI: irq}); err != nil {
+		e.Close()
+
+		return nil, err
+	}
+
+	return &virtioIRQ{fd: e}, nil
+}
+
+func (i *virtioIRQ) InjectIRQ() {
+	if err := i.fd.Signal(); err != nil {
 		panic(err)
 	}
 }
+
+// defaultMAC returns the locally administered MAC address derived from the
+// name of the tap interface, so that the guest sees the same address on every
+// boot.
+func defaultMAC(tapIfName string) net.HardwareAddr {
+	h := crc32.ChecksumIEEE([]byte(tapIfName))
+
+	return net.HardwareAddr{0x52, 0x54, 0x00, byte(h >> 16), byte(h >> 8), byte(h)}
+}
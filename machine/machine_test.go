@@ -1,6 +1,9 @@
 package machine_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"testing"
 	"time"
@@ -9,20 +12,21 @@ import (
 )
 
 func TestNewAndLoadLinux(t *testing.T) { // nolint:paralleltest
-	m, err := machine.New(1, "tap")
+	m, err := machine.New(1, []machine.NIC{{TapIfName: "tap"}}, "", 1<<30, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	param := `console=ttyS0 earlyprintk=serial noapic noacpi notsc ` +
-		`lapic tsc_early_khz=2000 pci=realloc=off virtio_pci.force_legacy=1`
+	param := `console=ttyS0 earlyprintk=serial notsc ` +
+		`lapic tsc_early_khz=2000 pci=realloc=off`
 
 	if err = m.LoadLinux("../bzImage", "../initrd", param); err != nil {
 		t.Fatal(err)
 	}
 
-	m.GetInputChan()
-	m.InjectSerialIRQ()
+	if err := m.SerialInput(0, '\n'); err != nil {
+		t.Fatal(err)
+	}
 	m.RunData()
 
 	go func() {
@@ -48,3 +52,206 @@ func TestNewAndLoadLinux(t *testing.T) { // nolint:paralleltest
 		t.Fatal(err)
 	}
 }
+
+func TestSaveAndRestore(t *testing.T) { // nolint:paralleltest
+	m, err := machine.New(2, []machine.NIC{{TapIfName: "tap_save"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "gokvm-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := m.Save(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := machine.New(2, []machine.NIC{{TapIfName: "tap_restore"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restored.Restore(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched, err := machine.New(1, []machine.NIC{{TapIfName: "tap_mismatch"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mismatched.Restore(f.Name()); err == nil {
+		t.Fatal("snapshot with a different number of vcpus should not be restored")
+	}
+}
+
+func TestPauseAndStatus(t *testing.T) { // nolint:paralleltest
+	m, err := machine.New(2, []machine.NIC{{TapIfName: "tap_status"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	// pausing again is allowed
+	if err := m.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.Status()
+	if !s.Paused || s.NumCPUs != 2 || s.MemSize != 1<<26 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+
+	m.Resume()
+
+	if m.Paused() {
+		t.Fatal("not resumed")
+	}
+
+	if _, _, err := m.VCPURegs(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.VCPURegs(2); err == nil {
+		t.Fatal("registers of a nonexistent vcpu should not be read")
+	}
+
+	if err := m.Reset(); err == nil {
+		t.Fatal("machine without a kernel should not be reset")
+	}
+}
+
+func TestPauseRunningVM(t *testing.T) { // nolint:paralleltest
+	m, err := machine.New(2, []machine.NIC{{TapIfName: "tap_pause"}}, "", 1<<30, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	param := `console=ttyS0 earlyprintk=serial notsc ` +
+		`lapic tsc_early_khz=2000 pci=realloc=off`
+
+	if err = m.LoadLinux("../bzImage", "../initrd", param); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			if err := m.RunInfiniteLoop(i); err != nil {
+				panic(err)
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Second)
+
+	if err := m.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _, err := m.VCPURegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	after, _, err := m.VCPURegs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before != after {
+		t.Fatalf("vcpu is running while paused: rip 0x%x -> 0x%x", before.RIP, after.RIP)
+	}
+
+	m.Resume()
+}
+
+func TestVirtioMMIO(t *testing.T) { // nolint:paralleltest
+	m, err := machine.New(1, []machine.NIC{{TapIfName: "tap_mmio"}}, "", 1<<26, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+
+	for _, d := range m.Status().Devices {
+		if d.Name == "virtio-net0" {
+			found = d.MMIOStart != 0 && d.MMIOEnd-d.MMIOStart == 0x200 && d.IOPortStart == 0
+		}
+	}
+
+	if !found {
+		t.Fatalf("virtio-net is not attached to virtio-mmio: %+v", m.Status().Devices)
+	}
+
+	f, err := ioutil.TempFile("", "gokvm-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := m.Save(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	pciMachine, err := machine.New(1, []machine.NIC{{TapIfName: "tap_mmio_pci"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range pciMachine.Status().Devices {
+		if d.Name == "virtio-net0" && (d.IOPortStart == 0 || d.MMIOEnd-d.MMIOStart != 0x4000) {
+			t.Fatalf("virtio-net has no legacy or modern PCI interface: %+v", d)
+		}
+	}
+
+	if err := pciMachine.Restore(f.Name()); err == nil {
+		t.Fatal("snapshot with virtio-mmio should not be restored to virtio-pci")
+	}
+}
+
+func TestMultipleNICs(t *testing.T) { // nolint:paralleltest
+	m, err := machine.New(1, []machine.NIC{{TapIfName: "tap_multi0"}, {TapIfName: "tap_multi1"}}, "", 1<<26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nics := map[string]machine.DeviceStatus{}
+
+	for _, d := range m.Status().Devices {
+		nics[d.Name] = d
+	}
+
+	net0, net1 := nics["virtio-net0"], nics["virtio-net1"]
+	if net0.IOPortEnd > net1.IOPortStart || net0.MMIOEnd > net1.MMIOStart || net0.IRQ == net1.IRQ {
+		t.Fatalf("NICs overlap: %+v, %+v", net0, net1)
+	}
+
+	if err := m.SetLinkUp(1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetLinkUp(2, false); err == nil {
+		t.Fatal("link of a nonexistent NIC should not be changed")
+	}
+
+	nics6 := make([]machine.NIC, 6)
+	for i := range nics6 {
+		nics6[i].TapIfName = fmt.Sprintf("tap_many%d", i)
+	}
+
+	if _, err := machine.New(1, nics6, "", 1<<26, false); err == nil {
+		t.Fatal("too many NICs should not be attached")
+	}
+}
@@ -0,0 +1,450 @@
+package machine
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/rtc"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+var errorSnapshotMismatch = errors.New("snapshot does not match the machine")
+
+// snapshot is the state of the VM except for the guest memory, which is
+// written just after the gob-encoded snapshot in the file.
+type snapshot struct {
+	MemRegions []snapshotMemRegion
+	VCPUs      []vcpuState
+	IRQChips   []kvm.IRQChip
+	PIT        kvm.PITState2
+	Clock      kvm.ClockData
+	Serials    []serial.State
+	PM         acpi.PMState
+	RTC        *rtc.State
+	Nets       []virtio.NetState
+	Blk        *virtio.BlkState
+	VirtioMMIO []virtio.TransportState
+	VirtioPCI  []virtio.TransportState
+}
+
+type snapshotMemRegion struct {
+	GPA, Size uint64
+}
+
+type vcpuState struct {
+	Regs    kvm.Regs
+	Sregs   kvm.Sregs
+	FPU     kvm.FPU
+	XSave   kvm.XSave
+	XCRs    kvm.XCRs
+	MSRs    []kvm.MSREntry
+	LAPIC   kvm.LAPICState
+	MPState kvm.MPState
+}
+
+// Save pauses the VM and writes its state, including the guest memory, into
+// the file. The VM is resumed after the snapshot is taken.
+func (m *Machine) Save(path string) error {
+	err := m.pause()
+	defer m.resume()
+
+	if err != nil {
+		return err
+	}
+
+	// Stop the device threads as well, since they write to the guest memory.
+	for _, n := range m.nets {
+		n.Lock()
+		defer n.Unlock()
+	}
+
+	if m.blk != nil {
+		m.blk.Lock()
+		defer m.blk.Unlock()
+	}
+
+	s, err := m.snapshot()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	if err := gob.NewEncoder(w).Encode(s); err != nil {
+		return err
+	}
+
+	for _, r := range m.memRegions {
+		if _, err := w.Write(m.mem[r.gpa : r.gpa+r.size]); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Restore loads the state of the VM from the file written by Save. It is used
+// instead of LoadLinux, before the vCPUs start running. The machine must be
+// created with the same number of vCPUs, memory size and devices.
+func (m *Machine) Restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	s := snapshot{}
+
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+
+	if err := m.checkSnapshot(&s); err != nil {
+		return err
+	}
+
+	for _, mr := range m.memRegions {
+		if _, err := io.ReadFull(r, m.mem[mr.gpa:mr.gpa+mr.size]); err != nil {
+			return err
+		}
+	}
+
+	return m.restore(&s)
+}
+
+// restore sets the state of the vCPUs and the devices. The guest memory must
+// be restored before calling this.
+func (m *Machine) restore(s *snapshot) error {
+	for _, chip := range s.IRQChips {
+		if err := kvm.SetIRQChip(m.vmFd, chip); err != nil {
+			return err
+		}
+	}
+
+	if err := kvm.SetPIT2(m.vmFd, s.PIT); err != nil {
+		return err
+	}
+
+	if err := kvm.SetClock(m.vmFd, s.Clock); err != nil {
+		return err
+	}
+
+	for i := range m.vcpuFds {
+		if err := m.setVCPUState(i, &s.VCPUs[i]); err != nil {
+			return fmt.Errorf("vcpu %d: %w", i, err)
+		}
+	}
+
+	for i, state := range s.Serials {
+		m.serials[i].SetState(state)
+	}
+
+	m.pm.SetState(s.PM)
+
+	if s.RTC != nil {
+		m.rtc.SetState(*s.RTC)
+	}
+
+	for i, n := range m.nets {
+		if err := n.SetState(s.Nets[i]); err != nil {
+			return fmt.Errorf("net %d: %w", i, err)
+		}
+	}
+
+	if m.blk != nil {
+		m.blk.SetState(*s.Blk)
+	}
+
+	// The transports map the virt queues again, after the devices are
+	// restored.
+	for i, d := range m.virtioMMIO {
+		if err := d.SetState(s.VirtioMMIO[i]); err != nil {
+			return err
+		}
+	}
+
+	for i, d := range m.virtioPCI {
+		if err := d.SetState(s.VirtioPCI[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Machine) checkSnapshot(s *snapshot) error {
+	if len(s.VCPUs) != len(m.vcpuFds) {
+		return fmt.Errorf("%w: %d vcpus in the snapshot", errorSnapshotMismatch, len(s.VCPUs))
+	}
+
+	if len(s.MemRegions) != len(m.memRegions) {
+		return fmt.Errorf("%w: %d memory regions in the snapshot", errorSnapshotMismatch, len(s.MemRegions))
+	}
+
+	for i, r := range s.MemRegions {
+		if r.GPA != m.memRegions[i].gpa || r.Size != m.memRegions[i].size {
+			return fmt.Errorf("%w: memory region 0x%x-0x%x in the snapshot",
+				errorSnapshotMismatch, r.GPA, r.GPA+r.Size)
+		}
+	}
+
+	if len(s.Serials) != len(m.serials) {
+		return fmt.Errorf("%w: %d serial ports in the snapshot", errorSnapshotMismatch, len(s.Serials))
+	}
+
+	if (s.Blk == nil) != (m.blk == nil) {
+		return fmt.Errorf("%w: virtio-blk", errorSnapshotMismatch)
+	}
+
+	if len(s.Nets) != len(m.nets) {
+		return fmt.Errorf("%w: %d NICs in the snapshot", errorSnapshotMismatch, len(s.Nets))
+	}
+
+	for i, n := range m.nets {
+		if len(s.Nets[i].QueuePFN) != n.NumQueues() {
+			return fmt.Errorf("%w: %d virt queues of NIC %d in the snapshot",
+				errorSnapshotMismatch, len(s.Nets[i].QueuePFN), i)
+		}
+	}
+
+	if len(s.VirtioMMIO) != len(m.virtioMMIO) {
+		return fmt.Errorf("%w: %d virtio-mmio devices in the snapshot", errorSnapshotMismatch, len(s.VirtioMMIO))
+	}
+
+	if len(s.VirtioPCI) != len(m.virtioPCI) {
+		return fmt.Errorf("%w: %d virtio PCI devices in the snapshot", errorSnapshotMismatch, len(s.VirtioPCI))
+	}
+
+	return nil
+}
+
+// initialState returns the state of the VM just after it is created.
+func (m *Machine) initialState() (*snapshot, error) {
+	for _, n := range m.nets {
+		n.Lock()
+		defer n.Unlock()
+	}
+
+	if m.blk != nil {
+		m.blk.Lock()
+		defer m.blk.Unlock()
+	}
+
+	s, err := m.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// RTC is backed by a battery, and keeps the time and NVRAM on reset.
+	s.RTC = nil
+
+	return s, nil
+}
+
+func (m *Machine) snapshot() (*snapshot, error) {
+	var err error
+
+	s := &snapshot{
+		VCPUs: make([]vcpuState, len(m.vcpuFds)),
+		PM:    m.pm.State(),
+	}
+
+	rtcState := m.rtc.State()
+	s.RTC = &rtcState
+
+	for _, port := range m.serials {
+		s.Serials = append(s.Serials, port.State())
+	}
+
+	for _, r := range m.memRegions {
+		s.MemRegions = append(s.MemRegions, snapshotMemRegion{GPA: r.gpa, Size: r.size})
+	}
+
+	for i := range m.vcpuFds {
+		if err := m.getVCPUState(i, &s.VCPUs[i]); err != nil {
+			return s, fmt.Errorf("vcpu %d: %w", i, err)
+		}
+	}
+
+	for _, id := range []uint32{kvm.IRQChipPICMaster, kvm.IRQChipPICSlave, kvm.IRQChipIOAPIC} {
+		chip, err := kvm.GetIRQChip(m.vmFd, id)
+		if err != nil {
+			return s, err
+		}
+
+		s.IRQChips = append(s.IRQChips, chip)
+	}
+
+	if s.PIT, err = kvm.GetPIT2(m.vmFd); err != nil {
+		return s, err
+	}
+
+	if s.Clock, err = kvm.GetClock(m.vmFd); err != nil {
+		return s, err
+	}
+
+	for _, n := range m.nets {
+		s.Nets = append(s.Nets, n.State())
+	}
+
+	if m.blk != nil {
+		blk := m.blk.State()
+		s.Blk = &blk
+	}
+
+	for _, d := range m.virtioMMIO {
+		s.VirtioMMIO = append(s.VirtioMMIO, d.State())
+	}
+
+	for _, d := range m.virtioPCI {
+		s.VirtioPCI = append(s.VirtioPCI, d.State())
+	}
+
+	return s, nil
+}
+
+func (m *Machine) getVCPUState(i int, s *vcpuState) error {
+	var err error
+
+	fd := m.vcpuFds[i]
+
+	if s.Regs, err = kvm.GetRegs(fd); err != nil {
+		return err
+	}
+
+	if s.Sregs, err = kvm.GetSregs(fd); err != nil {
+		return err
+	}
+
+	if s.FPU, err = kvm.GetFPU(fd); err != nil {
+		return err
+	}
+
+	if s.XSave, err = kvm.GetXSave(fd); err != nil {
+		return err
+	}
+
+	if s.XCRs, err = kvm.GetXCRs(fd); err != nil {
+		return err
+	}
+
+	if s.MSRs, err = m.getMSRs(fd); err != nil {
+		return err
+	}
+
+	if s.LAPIC, err = kvm.GetLocalAPIC(fd); err != nil {
+		return err
+	}
+
+	if s.MPState, err = kvm.GetMPState(fd); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Machine) setVCPUState(i int, s *vcpuState) error {
+	fd := m.vcpuFds[i]
+
+	// The order follows that of QEMU. In particular, the APIC base in sregs
+	// must be set before the local APIC.
+	if err := kvm.SetSregs(fd, s.Sregs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetRegs(fd, s.Regs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetFPU(fd, s.FPU); err != nil {
+		return err
+	}
+
+	if err := kvm.SetXCRs(fd, s.XCRs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetXSave(fd, s.XSave); err != nil {
+		return err
+	}
+
+	if err := setMSRs(fd, s.MSRs); err != nil {
+		return err
+	}
+
+	if err := kvm.SetLocalAPIC(fd, s.LAPIC); err != nil {
+		return err
+	}
+
+	return kvm.SetMPState(fd, s.MPState)
+}
+
+// getMSRs reads all the MSRs supported by KVM. KVM stops at the first MSR
+// which cannot be read, so such MSRs are skipped.
+func (m *Machine) getMSRs(vcpuFd uintptr) ([]kvm.MSREntry, error) {
+	indices, err := kvm.GetMSRIndexList(m.kvmFd)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []kvm.MSREntry{}
+
+	for len(indices) > 0 {
+		entries := make([]kvm.MSREntry, len(indices))
+		for i := range indices {
+			entries[i].Index = indices[i]
+		}
+
+		n, err := kvm.GetMSRs(vcpuFd, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, entries[:n]...)
+
+		if n+1 >= len(indices) {
+			break
+		}
+
+		indices = indices[n+1:]
+	}
+
+	return res, nil
+}
+
+func setMSRs(vcpuFd uintptr, entries []kvm.MSREntry) error {
+	for len(entries) > 0 {
+		n, err := kvm.SetMSRs(vcpuFd, entries)
+		if err != nil {
+			return err
+		}
+
+		if n+1 >= len(entries) {
+			break
+		}
+
+		entries = entries[n+1:]
+	}
+
+	return nil
+}
@@ -4,28 +4,78 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/bobuhiro11/gokvm/console"
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/gdbstub"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/monitor"
 	"github.com/bobuhiro11/gokvm/term"
 )
 
 func main() {
-	kernelPath, initrdPath, params, tapIfName, nCpus, err := flag.ParseArgs(os.Args)
+	c, err := flag.ParseArgs(os.Args)
 	if err != nil {
 		panic(err)
 	}
 
-	m, err := machine.New(nCpus, tapIfName)
+	nics := []machine.NIC{}
+	for _, nic := range c.NICs {
+		nics = append(nics, machine.NIC{TapIfName: nic.TapIfName, MAC: nic.MAC, Queues: nic.Queues})
+	}
+
+	m, err := machine.New(c.NCPUs, nics, c.DiskPath, c.MemSize, c.VirtioMMIO)
 	if err != nil {
 		panic(err)
 	}
 
-	if err := m.LoadLinux(kernelPath, initrdPath, params); err != nil {
+	m.SetNoReboot(c.NoReboot)
+
+	if !c.RTCBase.IsZero() {
+		m.SetRTCTime(c.RTCBase)
+	}
+
+	if c.RestorePath != "" {
+		err = m.Restore(c.RestorePath)
+	} else {
+		err = m.LoadLinux(c.Kernel, c.Initrd, c.Params)
+	}
+
+	if err != nil {
 		panic(err)
 	}
 
-	for i := 0; i < nCpus; i++ {
+	// The standard input is read below to handle Ctrl-a.
+	stdioPort := -1
+
+	for i, spec := range c.Serials {
+		if spec == "stdio" {
+			stdioPort = i
+
+			if err := m.SetSerialBackend(i, os.Stdout, nil); err != nil {
+				panic(err)
+			}
+
+			continue
+		}
+
+		out, in, err := console.Open(spec)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := m.SetSerialBackend(i, out, in); err != nil {
+			panic(err)
+		}
+	}
+
+	if c.GDBAddr != "" {
+		serveGDB(m, c.GDBAddr)
+	}
+
+	for i := 0; i < c.NCPUs; i++ {
 		go func(cpuId int) {
 			if err = m.RunInfiniteLoop(cpuId); err != nil {
 				panic(err)
@@ -33,9 +83,48 @@ func main() {
 		}(i)
 	}
 
+	// quit is closed when the monitor is requested to quit. It is nil and
+	// never closed without the monitor.
+	var quit <-chan struct{}
+
+	if c.MonitorPath != "" {
+		quit = serveMonitor(m, c.MonitorPath)
+	}
+
+	// SIGTERM shuts down the guest gracefully.
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+
+	go func() {
+		for range sigterm {
+			m.PressPowerButton()
+		}
+	}()
+
+	// stop is closed when the VM should exit.
+	stop := make(chan struct{})
+
+	go func() {
+		select {
+		case <-quit:
+		case <-m.PoweredOff():
+			fmt.Fprintf(os.Stderr, "guest stopped\r\n")
+		}
+
+		close(stop)
+	}()
+
+	if stdioPort < 0 {
+		<-stop
+
+		return
+	}
+
 	if !term.IsTerminal() {
 		fmt.Fprintln(os.Stderr, "this is not terminal and does not accept input")
-		select {}
+		<-stop
+
+		return
 	}
 
 	restoreMode, err := term.SetRawMode()
@@ -45,25 +134,114 @@ func main() {
 
 	defer restoreMode()
 
-	var before byte = 0
+	done := make(chan struct{})
 
-	in := bufio.NewReader(os.Stdin)
+	go func() {
+		var before byte = 0
 
-	for {
-		b, err := in.ReadByte()
-		if err != nil {
-			panic(err)
-		}
-		m.GetInputChan() <- b
+		in := bufio.NewReader(os.Stdin)
+
+		for {
+			b, err := in.ReadByte()
+			if err != nil {
+				panic(err)
+			}
+
+			if err := m.SerialInput(stdioPort, b); err != nil {
+				panic(err)
+			}
+
+			if before == 0x1 && b == 'x' {
+				close(done)
+
+				return
+			}
+
+			if before == 0x1 && b == 'p' {
+				togglePause(m)
+			}
+
+			if before == 0x1 && b == 'b' {
+				if err := m.SerialBreak(stdioPort); err != nil {
+					panic(err)
+				}
+			}
+
+			if before == 0x1 && b == 's' {
+				if err := m.Save(c.SnapshotPath); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to save snapshot: %v\r\n", err)
+				} else {
+					fmt.Fprintf(os.Stderr, "snapshot saved to %s\r\n", c.SnapshotPath)
+				}
+			}
 
-		if len(m.GetInputChan()) > 0 {
-			m.InjectSerialIRQ()
+			before = b
 		}
+	}()
+
+	select {
+	case <-done:
+	case <-stop:
+	}
+}
 
-		if before == 0x1 && b == 'x' {
-			break
+func togglePause(m *machine.Machine) {
+	if m.Paused() {
+		m.Resume()
+		fmt.Fprintf(os.Stderr, "resumed\r\n")
+
+		return
+	}
+
+	if err := m.Pause(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to pause: %v\r\n", err)
+
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "paused, press Ctrl-a p again to resume\r\n")
+}
+
+// serveMonitor starts the monitor on the unix domain socket, and returns the
+// channel closed when it is requested to quit.
+func serveMonitor(m *machine.Machine, path string) <-chan struct{} {
+	l, err := monitor.Listen(path)
+	if err != nil {
+		panic(err)
+	}
+
+	mon, err := monitor.New(m)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		if err := mon.Serve(l); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
+	}()
 
-		before = b
+	return mon.Quit()
+}
+
+// serveGDB starts the GDB remote stub. The VM is paused until the debugger is
+// attached and continues it, so that the kernel can be debugged from the
+// first instruction.
+func serveGDB(m *machine.Machine, addr string) {
+	l, err := gdbstub.Listen(addr)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := m.Pause(); err != nil {
+		panic(err)
 	}
+
+	fmt.Fprintf(os.Stderr, "waiting for gdb on %s\r\n", addr)
+
+	go func() {
+		if err := gdbstub.New(m).Serve(l); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
 }
@@ -0,0 +1,114 @@
+package mmio
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoDevice = errors.New("no device is mapped at the address")
+	ErrOverlap  = errors.New("address range overlaps with another device")
+)
+
+// Device is a memory-mapped device attached to the Bus. The address passed
+// to Read and Write is the guest physical address, not the offset from the
+// base of the device, in the same manner as the IO port handlers.
+type Device interface {
+	Read(addr uint64, data []byte) error
+	Write(addr uint64, data []byte) error
+}
+
+type region struct {
+	base, size uint64
+	dev        Device
+}
+
+func (r region) contains(addr uint64) bool {
+	return r.base <= addr && addr-r.base < r.size
+}
+
+// Bus dispatches MMIO accesses from the guest to the device registered for
+// the address range. Regions are kept sorted by the base address.
+type Bus struct {
+	mu      sync.RWMutex
+	regions []region
+}
+
+func New() *Bus {
+	return &Bus{}
+}
+
+// Register maps the device at [base, base+size).
+func (b *Bus) Register(base, size uint64, dev Device) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sort.Search(len(b.regions), func(i int) bool {
+		return b.regions[i].base >= base
+	})
+
+	if i < len(b.regions) && b.regions[i].base < base+size {
+		return fmt.Errorf("%w: 0x%x", ErrOverlap, base)
+	}
+
+	if i > 0 && b.regions[i-1].contains(base) {
+		return fmt.Errorf("%w: 0x%x", ErrOverlap, base)
+	}
+
+	b.regions = append(b.regions, region{})
+	copy(b.regions[i+1:], b.regions[i:])
+	b.regions[i] = region{base: base, size: size, dev: dev}
+
+	return nil
+}
+
+// Unregister removes the device mapped at base.
+func (b *Bus) Unregister(base uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := range b.regions {
+		if b.regions[i].base == base {
+			b.regions = append(b.regions[:i], b.regions[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: 0x%x", ErrNoDevice, base)
+}
+
+func (b *Bus) find(addr uint64) (Device, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	i := sort.Search(len(b.regions), func(i int) bool {
+		return b.regions[i].base > addr
+	})
+
+	if i > 0 && b.regions[i-1].contains(addr) {
+		return b.regions[i-1].dev, nil
+	}
+
+	return nil, fmt.Errorf("%w: 0x%x", ErrNoDevice, addr)
+}
+
+func (b *Bus) Read(addr uint64, data []byte) error {
+	dev, err := b.find(addr)
+	if err != nil {
+		return err
+	}
+
+	return dev.Read(addr, data)
+}
+
+func (b *Bus) Write(addr uint64, data []byte) error {
+	dev, err := b.find(addr)
+	if err != nil {
+		return err
+	}
+
+	return dev.Write(addr, data)
+}
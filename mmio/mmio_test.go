@@ -0,0 +1,107 @@
+package mmio_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/mmio"
+)
+
+type mockDevice struct {
+	lastAddr uint64
+	value    byte
+}
+
+func (d *mockDevice) Read(addr uint64, data []byte) error {
+	d.lastAddr = addr
+	data[0] = d.value
+
+	return nil
+}
+
+func (d *mockDevice) Write(addr uint64, data []byte) error {
+	d.lastAddr = addr
+	d.value = data[0]
+
+	return nil
+}
+
+func TestReadWrite(t *testing.T) {
+	t.Parallel()
+
+	b := mmio.New()
+	d1, d2 := &mockDevice{}, &mockDevice{}
+
+	if err := b.Register(0x2000, 0x1000, d2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Register(0x1000, 0x1000, d1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Write(0x1fff, []byte{0xaa}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Write(0x2000, []byte{0xbb}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte{0}
+	if err := b.Read(0x1234, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if data[0] != 0xaa || d1.lastAddr != 0x1234 {
+		t.Fatalf("unexpected read: 0x%x from 0x%x", data[0], d1.lastAddr)
+	}
+
+	if d2.value != 0xbb {
+		t.Fatalf("unexpected value: 0x%x", d2.value)
+	}
+}
+
+func TestNoDevice(t *testing.T) {
+	t.Parallel()
+
+	b := mmio.New()
+
+	if err := b.Register(0x1000, 0x1000, &mockDevice{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []uint64{0x0, 0xfff, 0x2000} {
+		if err := b.Read(addr, []byte{0}); !errors.Is(err, mmio.ErrNoDevice) {
+			t.Fatalf("addr 0x%x: expected: %v, actual: %v", addr, mmio.ErrNoDevice, err)
+		}
+	}
+
+	if err := b.Unregister(0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Write(0x1000, []byte{0}); !errors.Is(err, mmio.ErrNoDevice) {
+		t.Fatalf("expected: %v, actual: %v", mmio.ErrNoDevice, err)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	t.Parallel()
+
+	b := mmio.New()
+
+	if err := b.Register(0x1000, 0x1000, &mockDevice{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range [][2]uint64{{0x800, 0x1000}, {0x1800, 0x100}, {0x1fff, 0x10}, {0x0, 0x3000}} {
+		if err := b.Register(r[0], r[1], &mockDevice{}); !errors.Is(err, mmio.ErrOverlap) {
+			t.Fatalf("range %v: expected: %v, actual: %v", r, mmio.ErrOverlap, err)
+		}
+	}
+
+	if err := b.Register(0x2000, 0x1000, &mockDevice{}); err != nil {
+		t.Fatal(err)
+	}
+}
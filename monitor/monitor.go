@@ -0,0 +1,194 @@
+// Package monitor serves the control API of a running VM over a unix domain
+// socket. The API is JSON-RPC 1.0 provided by net/rpc/jsonrpc, so that a
+// request looks like
+//
+//	{"method": "VM.Regs", "params": [{"CPU": 0}], "id": 1}
+//
+// and each method is listed below as a method of Service.
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+)
+
+// Machine is the VM controlled by the monitor, which is implemented by
+// machine.Machine.
+type Machine interface {
+	Pause() error
+	Resume()
+	Reset() error
+	PressPowerButton()
+	VCPURegs(i int) (kvm.Regs, kvm.Sregs, error)
+	SerialInput(port int, b byte) error
+	SetLinkUp(nic int, up bool) error
+	Status() machine.Status
+}
+
+type Monitor struct {
+	server *rpc.Server
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// Empty is the arguments and the reply of the methods which need nothing.
+type Empty struct{}
+
+type RegsArgs struct {
+	CPU int
+}
+
+type RegsReply struct {
+	Regs  kvm.Regs
+	Sregs kvm.Sregs
+}
+
+type SendKeysArgs struct {
+	// Port is the serial port to which the keys are sent, 0 for COM1.
+	Port int
+	Keys string
+}
+
+type LinkArgs struct {
+	// NIC is the index of the NIC, 0 for the first -net.
+	NIC int
+
+	// Up connects the cable if true, and disconnects it otherwise.
+	Up bool
+}
+
+// Service is the set of methods exported as "VM.<method>".
+type Service struct {
+	m Machine
+}
+
+func (s *Service) Pause(_ *Empty, _ *Empty) error {
+	return s.m.Pause()
+}
+
+func (s *Service) Resume(_ *Empty, _ *Empty) error {
+	s.m.Resume()
+
+	return nil
+}
+
+// Quit makes the channel returned by Monitor.Quit closed after the reply is
+// sent.
+func (s *Service) Quit(_ *Empty, _ *Empty) error {
+	return nil
+}
+
+func (s *Service) Reset(_ *Empty, _ *Empty) error {
+	return s.m.Reset()
+}
+
+// PowerButton presses the ACPI power button to shut down the guest
+// gracefully.
+func (s *Service) PowerButton(_ *Empty, _ *Empty) error {
+	s.m.PressPowerButton()
+
+	return nil
+}
+
+func (s *Service) Regs(args *RegsArgs, reply *RegsReply) error {
+	var err error
+
+	reply.Regs, reply.Sregs, err = s.m.VCPURegs(args.CPU)
+
+	return err
+}
+
+func (s *Service) SendKeys(args *SendKeysArgs, _ *Empty) error {
+	for _, b := range []byte(args.Keys) {
+		if err := s.m.SerialInput(args.Port, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Link changes the link status of the NIC, which the guest is notified of.
+func (s *Service) Link(args *LinkArgs, _ *Empty) error {
+	return s.m.SetLinkUp(args.NIC, args.Up)
+}
+
+func (s *Service) Status(_ *Empty, reply *machine.Status) error {
+	*reply = s.m.Status()
+
+	return nil
+}
+
+func New(m Machine) (*Monitor, error) {
+	mon := &Monitor{
+		server: rpc.NewServer(),
+		quit:   make(chan struct{}),
+	}
+
+	if err := mon.server.RegisterName("VM", &Service{m: m}); err != nil {
+		return nil, err
+	}
+
+	return mon, nil
+}
+
+// Quit returns the channel closed when the client requests to quit.
+func (mon *Monitor) Quit() <-chan struct{} {
+	return mon.quit
+}
+
+// Listen removes the socket left by the previous run, if any, and listens on
+// the unix domain socket.
+func Listen(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Serve accepts the clients on the listener and serves each of them in a
+// goroutine until the listener is closed.
+func (mon *Monitor) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("monitor: %w", err)
+		}
+
+		go mon.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single client until it disconnects.
+func (mon *Monitor) ServeConn(conn io.ReadWriteCloser) {
+	mon.server.ServeCodec(&codec{ServerCodec: jsonrpc.NewServerCodec(conn), mon: mon})
+}
+
+// codec closes the quit channel after the reply to VM.Quit is written, so
+// that the client receives it before the process exits.
+type codec struct {
+	rpc.ServerCodec
+	mon *Monitor
+}
+
+func (c *codec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.ServerCodec.WriteResponse(r, body)
+
+	if r.ServiceMethod == "VM.Quit" && r.Error == "" {
+		c.mon.quitOnce.Do(func() { close(c.mon.quit) })
+	}
+
+	return err
+}
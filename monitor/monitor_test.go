@@ -0,0 +1,171 @@
+package monitor_test
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/monitor"
+)
+
+var errInvalidNIC = errors.New("invalid NIC")
+
+type mockMachine struct {
+	paused bool
+	reset  bool
+	button bool
+	input  []byte
+	linkUp bool
+}
+
+func (m *mockMachine) Pause() error {
+	m.paused = true
+
+	return nil
+}
+
+func (m *mockMachine) Resume() {
+	m.paused = false
+}
+
+func (m *mockMachine) Reset() error {
+	m.reset = true
+
+	return nil
+}
+
+func (m *mockMachine) PressPowerButton() {
+	m.button = true
+}
+
+func (m *mockMachine) VCPURegs(i int) (kvm.Regs, kvm.Sregs, error) {
+	return kvm.Regs{RIP: 0x1000 + uint64(i)}, kvm.Sregs{CR0: 1}, nil
+}
+
+func (m *mockMachine) SerialInput(port int, b byte) error {
+	m.input = append(m.input, b)
+
+	return nil
+}
+
+func (m *mockMachine) SetLinkUp(nic int, up bool) error {
+	if nic != 0 {
+		return errInvalidNIC
+	}
+
+	m.linkUp = up
+
+	return nil
+}
+
+func (m *mockMachine) Status() machine.Status {
+	return machine.Status{Paused: m.paused, NumCPUs: 2}
+}
+
+func newClient(t *testing.T, m monitor.Machine) (*monitor.Monitor, *rpc.Client) {
+	t.Helper()
+
+	mon, err := monitor.New(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+
+	go mon.ServeConn(server)
+
+	c := jsonrpc.NewClient(client)
+	t.Cleanup(func() { c.Close() })
+
+	return mon, c
+}
+
+func TestPauseAndResume(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	_, c := newClient(t, m)
+
+	if err := c.Call("VM.Pause", &monitor.Empty{}, &monitor.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := machine.Status{}
+	if err := c.Call("VM.Status", &monitor.Empty{}, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if !status.Paused || status.NumCPUs != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if err := c.Call("VM.Resume", &monitor.Empty{}, &monitor.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.paused {
+		t.Fatal("not resumed")
+	}
+}
+
+func TestRegsAndSendKeys(t *testing.T) {
+	t.Parallel()
+
+	m := &mockMachine{}
+	_, c := newClient(t, m)
+
+	reply := monitor.RegsReply{}
+	if err := c.Call("VM.Regs", &monitor.RegsArgs{CPU: 1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Regs.RIP != 0x1001 || reply.Sregs.CR0 != 1 {
+		t.Fatalf("unexpected regs: %+v", reply)
+	}
+
+	if err := c.Call("VM.SendKeys", &monitor.SendKeysArgs{Keys: "ls\n"}, &monitor.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.input) != "ls\n" {
+		t.Fatalf("unexpected input: %q", m.input)
+	}
+
+	if err := c.Call("VM.Reset", &monitor.Empty{}, &monitor.Empty{}); err != nil || !m.reset {
+		t.Fatalf("not reset: %v", err)
+	}
+
+	if err := c.Call("VM.PowerButton", &monitor.Empty{}, &monitor.Empty{}); err != nil || !m.button {
+		t.Fatalf("power button is not pressed: %v", err)
+	}
+
+	if err := c.Call("VM.Link", &monitor.LinkArgs{Up: true}, &monitor.Empty{}); err != nil || !m.linkUp {
+		t.Fatalf("link is not up: %v", err)
+	}
+
+	if err := c.Call("VM.Link", &monitor.LinkArgs{NIC: 1}, &monitor.Empty{}); err == nil {
+		t.Fatal("link of a nonexistent NIC should not be changed")
+	}
+}
+
+func TestQuit(t *testing.T) {
+	t.Parallel()
+
+	mon, c := newClient(t, &mockMachine{})
+
+	select {
+	case <-mon.Quit():
+		t.Fatal("quit before requested")
+	default:
+	}
+
+	if err := c.Call("VM.Quit", &monitor.Empty{}, &monitor.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+
+	<-mon.Quit()
+}
@@ -3,6 +3,22 @@ package pci
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+)
+
+var ErrCapabilitiesTooLarge = errors.New("capabilities do not fit in the config space")
+
+const (
+	// ConfigSpaceSize is the size of the config space of a PCI device.
+	ConfigSpaceSize = 256
+
+	// capabilitiesStart is the offset of the capability list, just after the
+	// header.
+	capabilitiesStart = 0x40
+
+	// statusCapabilities in the status register indicates that the
+	// capability list is present.
+	statusCapabilities = 0x10
 )
 
 // Configuration Space Access Mechanism #1
@@ -43,44 +59,123 @@ type Device interface {
 	GetIORange() (start, end uint64)
 }
 
+// BARDevice is a Device which uses the BARs other than BAR0, e.g. memory BARs
+// placed in the PCI hole.
+type BARDevice interface {
+	Device
+
+	// GetBARSize returns the size of the BAR, or 0 if it is not used.
+	GetBARSize(bar int) uint64
+}
+
 type DeviceHeader struct {
 	VendorID      uint16
 	DeviceID      uint16
 	Command       uint16
-	_             uint16   // status
-	_             uint8    // revisonID
-	_             [3]uint8 // classCode
-	_             uint8    // cacheLineSize
-	_             uint8    // latencyTimer
 	HeaderType    uint8
-	_             uint8 // bist
 	BAR           [6]uint32
-	_             uint32 // cardbusCISPointer
-	_             uint16 // subsystemVendorID
 	SubsystemID   uint16
-	_             uint32   // expansionROMBaseAddress
-	_             uint8    // capabilitiesPointer
-	_             [7]uint8 // reserved
 	InterruptLine uint8
 	InterruptPin  uint8
-	_             uint8 // minGnt
-	_             uint8 // maxLat
+
+	// Capabilities are placed in the config space after the header, and
+	// linked from the capabilities pointer in the order.
+	Capabilities []Capability
 }
 
+// Capability is an entry of the capability list.
+type Capability struct {
+	ID uint8
+
+	// Data follows the ID and the pointer to the next capability.
+	Data []byte
+}
+
+// configHeader is the layout of the header in the config space.
+type configHeader struct {
+	VendorID            uint16
+	DeviceID            uint16
+	Command             uint16
+	Status              uint16
+	_                   uint8    // revisonID
+	_                   [3]uint8 // classCode
+	_                   uint8    // cacheLineSize
+	_                   uint8    // latencyTimer
+	HeaderType          uint8
+	_                   uint8 // bist
+	BAR                 [6]uint32
+	_                   uint32 // cardbusCISPointer
+	_                   uint16 // subsystemVendorID
+	SubsystemID         uint16
+	_                   uint32 // expansionROMBaseAddress
+	CapabilitiesPointer uint8
+	_                   [7]uint8 // reserved
+	InterruptLine       uint8
+	InterruptPin        uint8
+	_                   uint8 // minGnt
+	_                   uint8 // maxLat
+}
+
+// Bytes returns the whole config space, which is ConfigSpaceSize bytes.
 func (h DeviceHeader) Bytes() ([]byte, error) {
+	c := configHeader{
+		VendorID:      h.VendorID,
+		DeviceID:      h.DeviceID,
+		Command:       h.Command,
+		HeaderType:    h.HeaderType,
+		BAR:           h.BAR,
+		SubsystemID:   h.SubsystemID,
+		InterruptLine: h.InterruptLine,
+		InterruptPin:  h.InterruptPin,
+	}
+
+	caps := []byte{}
+
+	for i, capability := range h.Capabilities {
+		b := append([]byte{capability.ID, 0}, capability.Data...)
+
+		// Each capability is aligned to 4 bytes.
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+
+		if i+1 < len(h.Capabilities) {
+			b[1] = uint8(capabilitiesStart + len(caps) + len(b))
+		}
+
+		caps = append(caps, b...)
+	}
+
+	if capabilitiesStart+len(caps) > ConfigSpaceSize {
+		return []byte{}, ErrCapabilitiesTooLarge
+	}
+
+	if len(caps) > 0 {
+		c.Status |= statusCapabilities
+		c.CapabilitiesPointer = capabilitiesStart
+	}
+
 	buf := new(bytes.Buffer)
 
-	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, c); err != nil {
 		return []byte{}, err
 	}
 
+	buf.Write(caps)
+	buf.Write(make([]byte, ConfigSpaceSize-buf.Len()))
+
 	return buf.Bytes(), nil
 }
 
 type PCI struct {
-	addr        address
-	isBAR0Probe bool
-	Devices     []Device
+	addr    address
+	Devices []Device
+
+	// probing is set when all 1-bits are written to the BAR probedBAR of the
+	// device in probedSlot to probe its size, and cleared once it is read.
+	probing    bool
+	probedSlot int
+	probedBAR  int
 }
 
 func New(devices ...Device) *PCI {
@@ -111,12 +206,11 @@ func (p *PCI) PciConfDataIn(port uint64, values []byte) error {
 		return nil
 	}
 
-	// Probing BAR0 Size
-	if bar := offset/4 - 4; bar == 0 && p.isBAR0Probe {
-		start, end := p.Devices[slot].GetIORange()
-		copy(values[:4], NumToBytes(SizeToBits(end-start)))
+	// Probing BAR Size
+	if bar := offset/4 - 4; p.probing && slot == p.probedSlot && bar == p.probedBAR {
+		copy(values[:4], NumToBytes(SizeToBits(barSize(p.Devices[slot], bar))))
 
-		p.isBAR0Probe = false
+		p.probing = false
 
 		return nil
 	}
@@ -153,9 +247,9 @@ func (p *PCI) PciConfDataOut(port uint64, values []byte) error {
 		return nil
 	}
 
-	// Probing BAR0 Size
-	if bar := offset/4 - 4; bar == 0 && BytesToNum(values) == 0xffffffff {
-		p.isBAR0Probe = true
+	// Probing BAR Size
+	if bar := offset/4 - 4; bar >= 0 && bar < 6 && BytesToNum(values) == 0xffffffff {
+		p.probing, p.probedSlot, p.probedBAR = true, slot, bar
 
 		return nil
 	}
@@ -163,6 +257,21 @@ func (p *PCI) PciConfDataOut(port uint64, values []byte) error {
 	return nil
 }
 
+// barSize returns the size of the BAR, where BAR0 is the IO port range.
+func barSize(dev Device, bar int) uint64 {
+	if bar == 0 {
+		start, end := dev.GetIORange()
+
+		return end - start
+	}
+
+	if d, ok := dev.(BARDevice); ok {
+		return d.GetBARSize(bar)
+	}
+
+	return 0
+}
+
 func (p *PCI) PciConfAddrIn(port uint64, values []byte) error {
 	if len(values) != 4 {
 		return nil
@@ -127,3 +127,68 @@ func TestBytes(t *testing.T) {
 		t.Fatalf("invalid vendor id")
 	}
 }
+
+func TestCapabilities(t *testing.T) {
+	t.Parallel()
+
+	dh := pci.DeviceHeader{
+		VendorID: 1,
+		Capabilities: []pci.Capability{
+			{ID: 0x09, Data: []byte{0x10, 0x01}},
+			{ID: 0x09, Data: []byte{0x14, 0x02, 0x04}},
+		},
+	}
+
+	b, err := dh.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != pci.ConfigSpaceSize {
+		t.Fatalf("invalid size of the config space: %d", len(b))
+	}
+
+	if b[0x06]&0x10 == 0 || b[0x34] != 0x40 {
+		t.Fatal("capability list is not present")
+	}
+
+	if !bytes.Equal(b[0x40:0x48], []byte{0x09, 0x44, 0x10, 0x01, 0x09, 0x00, 0x14, 0x02}) {
+		t.Fatalf("invalid capability list: %v", b[0x40:0x50])
+	}
+
+	dh.Capabilities = []pci.Capability{{ID: 0x09, Data: make([]byte, pci.ConfigSpaceSize)}}
+
+	if _, err := dh.Bytes(); err == nil {
+		t.Fatal("capabilities larger than the config space should be an error")
+	}
+}
+
+type memBARDevice struct {
+	pci.Device
+}
+
+func (d memBARDevice) GetBARSize(bar int) uint64 {
+	if bar == 4 {
+		return 0x4000
+	}
+
+	return 0
+}
+
+func TestProbingMemoryBAR(t *testing.T) {
+	t.Parallel()
+
+	p := pci.New(pci.NewBridge(), memBARDevice{Device: pci.NewBridge()})
+
+	for bar, expected := range map[uint32]uint32{4: 0xffffc000, 5: 0} {
+		_ = p.PciConfAddrOut(0x0, pci.NumToBytes(0x80000810+bar*4)) // BAR of 00:01.0
+		_ = p.PciConfDataOut(0xCFC, pci.NumToBytes(uint32(0xffffffff)))
+
+		bytes := make([]byte, 4)
+		_ = p.PciConfDataIn(0xCFC, bytes)
+
+		if actual := uint32(pci.BytesToNum(bytes)); expected != actual {
+			t.Fatalf("BAR%d: expected: 0x%x, actual: 0x%x", bar, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+// Package rtc emulates the MC146818 real-time clock and the CMOS NVRAM of PCs.
+//
+// refs: https://wiki.osdev.org/CMOS
+package rtc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	IndexPort = 0x70
+	DataPort  = 0x71
+	IRQ       = 8
+
+	// RegCentury is the register of the century, which is given in FADT.
+	RegCentury = 0x32
+
+	nvramSize = 128
+)
+
+// Registers of the clock.
+const (
+	regSeconds      = 0x00
+	regSecondsAlarm = 0x01
+	regMinutes      = 0x02
+	regMinutesAlarm = 0x03
+	regHours        = 0x04
+	regHoursAlarm   = 0x05
+	regDayOfWeek    = 0x06
+	regDayOfMonth   = 0x07
+	regMonth        = 0x08
+	regYear         = 0x09
+	regA            = 0x0a
+	regB            = 0x0b
+	regC            = 0x0c
+	regD            = 0x0d
+)
+
+// Registers of the memory size in NVRAM, as set by the BIOS of QEMU.
+const (
+	regBaseMemLo     = 0x15 // in KiB, up to 640 KiB
+	regBaseMemHi     = 0x16
+	regExtMemLo      = 0x17 // in KiB between 1 MiB and 64 MiB
+	regExtMemHi      = 0x18
+	regExtMem2Lo     = 0x30 // same as regExtMemLo
+	regExtMem2Hi     = 0x31
+	regHighMemLo     = 0x34 // in 64 KiB between 16 MiB and 4 GiB
+	regHighMemHi     = 0x35
+	regAbove4GMemLo  = 0x5b // in 64 KiB above 4 GiB, 3 bytes
+	regAbove4GMemMid = 0x5c
+	regAbove4GMemHi  = 0x5d
+)
+
+const (
+	aUIP    = 0x80 // update in progress
+	aRSMask = 0x0f // rate selection of the periodic interrupt
+
+	bSet    = 0x80 // updates are halted to set the time
+	bPIE    = 0x40
+	bAIE    = 0x20
+	bUIE    = 0x10
+	bBinary = 0x04
+	b24Hour = 0x02
+
+	cIRQF = 0x80
+	cPF   = 0x40
+	cAF   = 0x20
+	cUF   = 0x10
+
+	dVRT = 0x80 // valid RAM and time
+
+	hourPM        = 0x80
+	alarmDontCare = 0xc0
+
+	// uipDuration is how long UIP is set before each update.
+	uipDuration = 244 * time.Microsecond
+
+	// The divider of 32.768 kHz in register A for the normal operation.
+	aDivider = 0x20
+)
+
+type IRQInjector interface {
+	// SetRTCIRQ sets the level of IRQ 8.
+	SetRTCIRQ(level bool)
+}
+
+// Config is the initial state of RTC.
+type Config struct {
+	// Start is the time of the clock when it is created. The host time is
+	// used if it is zero.
+	Start time.Time
+
+	// LowMem and HighMem are the sizes of RAM below and above 4 GiB, which
+	// are reported in NVRAM.
+	LowMem, HighMem uint64
+}
+
+// RTC is the clock running in UTC. The time registers are computed from the
+// host time and the offset to it when they are read, unless the updates are
+// halted by SET in register B.
+type RTC struct {
+	mu sync.Mutex
+
+	index  byte
+	regs   [nvramSize]byte
+	offset time.Duration // the time of the clock minus the host time
+
+	irqLevel      bool
+	updateTimer   *time.Timer
+	periodicTimer *time.Timer
+
+	irqInjector IRQInjector
+}
+
+func New(irqInjector IRQInjector, c Config) *RTC {
+	r := &RTC{irqInjector: irqInjector}
+
+	r.regs[regA] = aDivider | 0x06 // 1024 Hz as set by BIOS
+	r.regs[regB] = b24Hour
+	r.regs[regD] = dVRT
+
+	if !c.Start.IsZero() {
+		r.offset = time.Until(c.Start)
+	}
+
+	r.setMemSize(c.LowMem, c.HighMem)
+	r.refresh()
+	r.armUpdate()
+
+	return r
+}
+
+func (r *RTC) setMemSize(low, high uint64) {
+	const (
+		kib = 1 << 10
+		mib = 1 << 20
+	)
+
+	set16 := func(lo, hi byte, v uint64) {
+		if v > 0xffff {
+			v = 0xffff
+		}
+
+		r.regs[lo], r.regs[hi] = byte(v), byte(v>>8)
+	}
+
+	set16(regBaseMemLo, regBaseMemHi, 640)
+
+	if low > mib {
+		set16(regExtMemLo, regExtMemHi, (low-mib)/kib)
+		set16(regExtMem2Lo, regExtMem2Hi, (low-mib)/kib)
+	}
+
+	if low > 16*mib {
+		set16(regHighMemLo, regHighMemHi, (low-16*mib)/(64*kib))
+	}
+
+	high /= 64 * kib
+	r.regs[regAbove4GMemLo] = byte(high)
+	r.regs[regAbove4GMemMid] = byte(high >> 8)
+	r.regs[regAbove4GMemHi] = byte(high >> 16)
+}
+
+// SetTime sets the clock.
+func (r *RTC) SetTime(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.offset = time.Until(t)
+	r.refresh()
+	r.armUpdate()
+}
+
+func (r *RTC) now() time.Time {
+	return time.Now().Add(r.offset).UTC()
+}
+
+// State is the state of RTC saved in a snapshot of the VM. The clock keeps
+// the offset to the host time, so it goes on while the VM is saved.
+type State struct {
+	Index  byte
+	Regs   [nvramSize]byte
+	Offset time.Duration
+}
+
+func (r *RTC) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return State{Index: r.index, Regs: r.regs, Offset: r.offset}
+}
+
+func (r *RTC) SetState(s State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.index, r.regs, r.offset = s.Index, s.Regs, s.Offset
+
+	// The line may be already high in the restored interrupt controller.
+	r.irqLevel = r.regs[regC]&cIRQF != 0
+
+	r.armUpdate()
+	r.armPeriodic()
+}
+
+func (r *RTC) binary() bool {
+	return r.regs[regB]&bBinary != 0
+}
+
+func (r *RTC) encode(v int) byte {
+	if r.binary() {
+		return byte(v)
+	}
+
+	return byte(v/10<<4 | v%10)
+}
+
+func (r *RTC) decode(b byte) int {
+	if r.binary() {
+		return int(b)
+	}
+
+	return int(b>>4)*10 + int(b&0x0f)
+}
+
+func (r *RTC) encodeHour(h int) byte {
+	if r.regs[regB]&b24Hour != 0 {
+		return r.encode(h)
+	}
+
+	h12 := h % 12
+	if h12 == 0 {
+		h12 = 12
+	}
+
+	b := r.encode(h12)
+	if h >= 12 {
+		b |= hourPM
+	}
+
+	return b
+}
+
+func (r *RTC) decodeHour(b byte) int {
+	if r.regs[regB]&b24Hour != 0 {
+		return r.decode(b)
+	}
+
+	h := r.decode(b&^hourPM) % 12
+	if b&hourPM != 0 {
+		h += 12
+	}
+
+	return h
+}
+
+// refresh sets the time registers to the current time, unless the updates
+// are halted.
+func (r *RTC) refresh() {
+	if r.regs[regB]&bSet != 0 {
+		return
+	}
+
+	t := r.now()
+
+	r.regs[regSeconds] = r.encode(t.Second())
+	r.regs[regMinutes] = r.encode(t.Minute())
+	r.regs[regHours] = r.encodeHour(t.Hour())
+	r.regs[regDayOfWeek] = r.encode(int(t.Weekday()) + 1)
+	r.regs[regDayOfMonth] = r.encode(t.Day())
+	r.regs[regMonth] = r.encode(int(t.Month()))
+	r.regs[regYear] = r.encode(t.Year() % 100)
+	r.regs[RegCentury] = r.encode(t.Year() / 100)
+}
+
+// setTimeFromRegs sets the clock to the time written in the registers.
+func (r *RTC) setTimeFromRegs() {
+	t := time.Date(
+		r.decode(r.regs[RegCentury])*100+r.decode(r.regs[regYear]),
+		time.Month(r.decode(r.regs[regMonth])),
+		r.decode(r.regs[regDayOfMonth]),
+		r.decodeHour(r.regs[regHours]),
+		r.decode(r.regs[regMinutes]),
+		r.decode(r.regs[regSeconds]),
+		0, time.UTC)
+
+	r.offset = time.Until(t)
+}
+
+func (r *RTC) isTimeReg(index byte) bool {
+	switch index {
+	case regSeconds, regMinutes, regHours, regDayOfWeek, regDayOfMonth, regMonth, regYear, RegCentury:
+		return true
+	}
+
+	return false
+}
+
+func (r *RTC) updateIRQ() {
+	if r.regs[regC]&r.regs[regB]&(cPF|cAF|cUF) != 0 {
+		r.regs[regC] |= cIRQF
+	}
+
+	level := r.regs[regC]&cIRQF != 0
+	if level == r.irqLevel {
+		return
+	}
+
+	r.irqLevel = level
+	r.irqInjector.SetRTCIRQ(level)
+}
+
+// armUpdate arms the timer of the update at the next second, which raises
+// the update-ended and the alarm flags.
+func (r *RTC) armUpdate() {
+	if r.updateTimer != nil {
+		r.updateTimer.Stop()
+	}
+
+	if r.regs[regB]&bSet != 0 {
+		return
+	}
+
+	t := r.now()
+	d := t.Truncate(time.Second).Add(time.Second).Sub(t)
+
+	r.updateTimer = time.AfterFunc(d, r.update)
+}
+
+func (r *RTC) update() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.regs[regB]&bSet != 0 {
+		return
+	}
+
+	r.refresh()
+	r.regs[regC] |= cUF
+
+	if r.alarm() {
+		r.regs[regC] |= cAF
+	}
+
+	r.updateIRQ()
+	r.armUpdate()
+}
+
+// alarm reports whether the time matches the alarm, where an alarm register
+// with the two high bits set matches any value.
+func (r *RTC) alarm() bool {
+	for _, reg := range [][2]byte{
+		{regSecondsAlarm, regSeconds},
+		{regMinutesAlarm, regMinutes},
+		{regHoursAlarm, regHours},
+	} {
+		alarm := r.regs[reg[0]]
+		if alarm&alarmDontCare != alarmDontCare && alarm != r.regs[reg[1]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// period returns the interval of the periodic interrupt, which is zero if
+// it is disabled.
+func (r *RTC) period() time.Duration {
+	rs := r.regs[regA] & aRSMask
+
+	switch rs {
+	case 0:
+		return 0
+	case 1, 2:
+		rs += 7
+	}
+
+	return time.Second * time.Duration(1<<(rs-1)) / 32768
+}
+
+// armPeriodic arms the timer of the periodic interrupt while it is enabled.
+func (r *RTC) armPeriodic() {
+	if r.periodicTimer != nil {
+		r.periodicTimer.Stop()
+		r.periodicTimer = nil
+	}
+
+	p := r.period()
+	if p == 0 || r.regs[regB]&bPIE == 0 {
+		return
+	}
+
+	r.periodicTimer = time.AfterFunc(p, r.tick)
+}
+
+func (r *RTC) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.regs[regC] |= cPF
+	r.updateIRQ()
+	r.armPeriodic()
+}
+
+// inUpdate reports whether the clock is about to be updated.
+func (r *RTC) inUpdate() bool {
+	if r.regs[regB]&bSet != 0 {
+		return false
+	}
+
+	t := r.now()
+
+	return t.Sub(t.Truncate(time.Second)) >= time.Second-uipDuration
+}
+
+func (r *RTC) In(port uint64, values []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if port == IndexPort {
+		values[0] = r.index
+
+		return nil
+	}
+
+	switch i := r.index; {
+	case r.isTimeReg(i):
+		r.refresh()
+		values[0] = r.regs[i]
+	case i == regA:
+		values[0] = r.regs[regA] &^ aUIP
+		if r.inUpdate() {
+			values[0] |= aUIP
+		}
+	case i == regC:
+		values[0] = r.regs[regC]
+		r.regs[regC] = 0
+		r.updateIRQ()
+	default:
+		values[0] = r.regs[i]
+	}
+
+	return nil
+}
+
+func (r *RTC) Out(port uint64, values []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if port == IndexPort {
+		// Bit 7 disables NMI, which is not emulated.
+		r.index = values[0] & (nvramSize - 1)
+
+		return nil
+	}
+
+	switch i := r.index; {
+	case r.isTimeReg(i):
+		// The other registers are brought up to date before one of them
+		// is written.
+		r.refresh()
+		r.regs[i] = values[0]
+
+		if r.regs[regB]&bSet == 0 {
+			r.setTimeFromRegs()
+			r.armUpdate()
+		}
+	case i == regA:
+		r.regs[regA] = values[0] &^ aUIP
+		r.armPeriodic()
+	case i == regB:
+		r.writeB(values[0])
+	case i == regC, i == regD:
+		// read only
+	default:
+		r.regs[i] = values[0]
+	}
+
+	return nil
+}
+
+func (r *RTC) writeB(b byte) {
+	old := r.regs[regB]
+
+	if old&bSet == 0 {
+		r.refresh()
+	}
+
+	// Setting SET clears UIE.
+	if b&bSet != 0 {
+		b &^= bUIE
+	}
+
+	r.regs[regB] = b
+
+	// The time written while the updates are halted takes effect.
+	if old&bSet != 0 && b&bSet == 0 {
+		r.setTimeFromRegs()
+	}
+
+	r.armUpdate()
+	r.armPeriodic()
+	r.updateIRQ()
+}
@@ -0,0 +1,178 @@
+package rtc_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/rtc"
+)
+
+type mockInjector struct {
+	mu    sync.Mutex
+	level bool
+}
+
+func (m *mockInjector) SetRTCIRQ(level bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.level = level
+}
+
+func (m *mockInjector) Level() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.level
+}
+
+func read(t *testing.T, r *rtc.RTC, index byte) byte {
+	t.Helper()
+
+	if err := r.Out(rtc.IndexPort, []byte{index}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := []byte{0}
+	if err := r.In(rtc.DataPort, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b[0]
+}
+
+func write(t *testing.T, r *rtc.RTC, index, value byte) {
+	t.Helper()
+
+	if err := r.Out(rtc.IndexPort, []byte{index}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Out(rtc.DataPort, []byte{value}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitIRQ waits until IRQ 8 is raised.
+func waitIRQ(t *testing.T, m *mockInjector) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); !m.Level(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("IRQ is not raised")
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2021, 2, 3, 13, 5, 6, 0, time.UTC)
+	r := rtc.New(&mockInjector{}, rtc.Config{Start: start})
+
+	// BCD and 24-hour by default
+	for index, want := range map[byte]byte{
+		0x02: 0x05, 0x04: 0x13, 0x06: 0x04, 0x07: 0x03, 0x08: 0x02, 0x09: 0x21, rtc.RegCentury: 0x20,
+	} {
+		if got := read(t, r, index); got != want {
+			t.Fatalf("register 0x%x: got 0x%x, want 0x%x", index, got, want)
+		}
+	}
+
+	if sec := read(t, r, 0x00); sec != 0x06 && sec != 0x07 {
+		t.Fatalf("unexpected seconds: 0x%x", sec)
+	}
+
+	// binary and 12-hour
+	write(t, r, 0x0b, 0x04)
+
+	if hour := read(t, r, 0x04); hour != 0x81 {
+		t.Fatalf("unexpected hour: 0x%x", hour)
+	}
+
+	// Set the time while the updates are halted.
+	write(t, r, 0x0b, 0x86)
+	write(t, r, 0x09, 99)
+	write(t, r, rtc.RegCentury, 19)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if year := read(t, r, 0x09); year != 99 {
+		t.Fatalf("time is updated while halted: %d", year)
+	}
+
+	write(t, r, 0x0b, 0x06)
+
+	if year := read(t, r, 0x09); year != 99 || r.State().Offset > -20*365*24*time.Hour {
+		t.Fatalf("time is not set: year %d, offset %v", year, r.State().Offset)
+	}
+
+	if d := read(t, r, 0x0d); d != 0x80 {
+		t.Fatalf("unexpected register D: 0x%x", d)
+	}
+}
+
+func TestMemSize(t *testing.T) {
+	t.Parallel()
+
+	r := rtc.New(&mockInjector{}, rtc.Config{LowMem: 1 << 30, HighMem: 1 << 32})
+
+	for index, want := range map[byte]byte{
+		0x15: 0x80, 0x16: 0x02, // 640 KiB
+		0x17: 0xff, 0x18: 0xff, // up to 64 MiB
+		0x34: 0x00, 0x35: 0x3f, // (1 GiB - 16 MiB) / 64 KiB
+		0x5b: 0x00, 0x5c: 0x00, 0x5d: 0x01, // 4 GiB / 64 KiB
+	} {
+		if got := read(t, r, index); got != want {
+			t.Fatalf("register 0x%x: got 0x%x, want 0x%x", index, got, want)
+		}
+	}
+
+	// The other bytes of NVRAM are readable and writable.
+	write(t, r, 0x40, 0x12)
+
+	if got := read(t, r, 0x40); got != 0x12 {
+		t.Fatalf("NVRAM is not written: 0x%x", got)
+	}
+}
+
+func TestInterrupts(t *testing.T) {
+	t.Parallel()
+
+	m := &mockInjector{}
+	r := rtc.New(m, rtc.Config{})
+
+	// periodic interrupt at 1024 Hz
+	write(t, r, 0x0a, 0x26)
+	write(t, r, 0x0b, 0x42)
+	waitIRQ(t, m)
+
+	if c := read(t, r, 0x0c); c&0xc0 != 0xc0 {
+		t.Fatalf("unexpected register C: 0x%x", c)
+	}
+
+	// update-ended interrupt, and the alarm for any time
+	write(t, r, 0x0b, 0x32)
+	write(t, r, 0x01, 0xc0)
+	write(t, r, 0x03, 0xc0)
+	write(t, r, 0x05, 0xc0)
+	read(t, r, 0x0c)
+
+	if m.Level() {
+		t.Fatal("IRQ is not lowered by reading register C")
+	}
+
+	waitIRQ(t, m)
+
+	if c := read(t, r, 0x0c); c&0xb0 != 0xb0 {
+		t.Fatalf("unexpected register C: 0x%x", c)
+	}
+
+	restored := rtc.New(&mockInjector{}, rtc.Config{})
+	restored.SetState(r.State())
+
+	if restored.State().Regs != r.State().Regs {
+		t.Fatal("state is not restored")
+	}
+}
@@ -1,112 +1,607 @@
 package serial
 
 import (
-	"fmt"
+	"bufio"
+	"errors"
+	"io"
+	"sync"
 )
 
 const (
 	COM1Addr = 0x03f8
+	COM2Addr = 0x02f8
+	COM3Addr = 0x03e8
+	COM4Addr = 0x02e8
+
+	// FIFOSize is the size of the receive and transmit FIFOs of 16550A.
+	FIFOSize = 16
+)
+
+// Offsets of the registers.
+const (
+	regRBR = 0 // receiver buffer (read), THR (write), DLL (DLAB=1)
+	regIER = 1 // interrupt enable, DLM (DLAB=1)
+	regIIR = 2 // interrupt identification (read), FCR (write)
+	regLCR = 3
+	regMCR = 4
+	regLSR = 5
+	regMSR = 6
+	regSCR = 7
+)
+
+const (
+	ierRDI  = 0x01 // received data available
+	ierTHRI = 0x02 // transmitter holding register empty
+	ierRLSI = 0x04 // receiver line status
+	ierMSI  = 0x08 // modem status
+	ierMask = 0x0f
+
+	iirNoInt  = 0x01
+	iirMSI    = 0x00
+	iirTHRI   = 0x02
+	iirRDI    = 0x04
+	iirRLSI   = 0x06
+	iirCTI    = 0x0c // character timeout
+	iirFIFOEn = 0xc0
+
+	fcrEnable   = 0x01
+	fcrClearRx  = 0x02
+	fcrClearTx  = 0x04
+	fcrTrigMask = 0xc0
+
+	lcrDLAB = 0x80
+
+	mcrDTR  = 0x01
+	mcrRTS  = 0x02
+	mcrOut1 = 0x04
+	mcrOut2 = 0x08
+	mcrLoop = 0x10
+	mcrMask = 0x1f
+
+	lsrDR   = 0x01 // data ready
+	lsrOE   = 0x02 // overrun error
+	lsrPE   = 0x04 // parity error
+	lsrFE   = 0x08 // framing error
+	lsrBI   = 0x10 // break interrupt
+	lsrTHRE = 0x20
+	lsrTEMT = 0x40
+	lsrFIFO = 0x80 // error in the receive FIFO
+
+	// lsrErrors are the errors of the received characters.
+	lsrErrors = lsrPE | lsrFE | lsrBI
+
+	msrDCTS = 0x01
+	msrDDSR = 0x02
+	msrTERI = 0x04
+	msrDDCD = 0x08
+	msrCTS  = 0x10
+	msrDSR  = 0x20
+	msrRI   = 0x40
+	msrDCD  = 0x80
+)
+
+// LineError is the errors detected on a received character, which the guest
+// reads in LSR when the character is at the top of the receive FIFO.
+type LineError byte
+
+const (
+	ParityError  LineError = lsrPE
+	FramingError LineError = lsrFE
+
+	// Break is detected when the line is held low for longer than a
+	// character, which is received as 0.
+	Break LineError = lsrBI
 )
 
 type IRQInjector interface {
-	InjectSerialIRQ()
+	// SetSerialIRQ sets the level of the interrupt line of the UART.
+	SetSerialIRQ(level bool)
+}
+
+// rxChar is a received character with the errors detected on it.
+type rxChar struct {
+	b   byte
+	err LineError
 }
 
+// Serial emulates 16550A. The output is moved from the transmit FIFO to the
+// backend by a goroutine, where the bytes being written are regarded as in the
+// transmitter shift register. The input from the backend is queued and moved
+// into the receive FIFO as the guest reads it.
 type Serial struct {
-	IER byte
-	LCR byte
+	mu   sync.Mutex
+	base uint64
 
-	inputChan chan byte
+	ier byte
+	lcr byte
+	mcr byte
+	lsr byte
+	msr byte
+	scr byte
+	fcr byte
+	dll byte
+	dlm byte
+
+	rx []rxChar
+	tx []byte
+
+	// transmitting is true while the goroutine writes the transmit FIFO to
+	// the backend.
+	transmitting bool
+
+	// thrEmpty is the pending interrupt of THR empty, which is cleared by
+	// reading IIR or writing THR.
+	thrEmpty bool
+	irqLevel bool
+
+	inputChan chan rxChar
+	out       io.Writer
 
 	irqInjector IRQInjector
 }
 
-func New(irqInjector IRQInjector) (*Serial, error) {
+// New creates the UART at the I/O port base, whose output is written to out.
+// The input is given by Receive or read from the backend by ReadInput.
+func New(base uint64, irqInjector IRQInjector, out io.Writer) (*Serial, error) {
 	s := &Serial{
-		IER: 0, LCR: 0,
-		inputChan:   make(chan byte, 10000),
+		base:        base,
+		dll:         0xc, // baud rate 9600
+		lsr:         lsrTHRE | lsrTEMT,
+		msr:         msrCTS | msrDSR | msrDCD,
+		inputChan:   make(chan rxChar, 10000),
+		out:         out,
 		irqInjector: irqInjector,
 	}
 
 	return s, nil
 }
 
-func (s *Serial) GetInputChan() chan<- byte {
-	return s.inputChan
+// SetOutput replaces the backend to which the output is written. It must be
+// called before the guest starts running.
+func (s *Serial) SetOutput(out io.Writer) {
+	s.out = out
+}
+
+// Receive queues the byte from the backend to the guest. It blocks while
+// the queue is full.
+func (s *Serial) Receive(b byte) {
+	s.ReceiveWithError(b, 0)
+}
+
+// ReceiveWithError queues the byte from the backend with the errors detected
+// on it, e.g. ReceiveWithError(0, Break) for a break from the backend.
+func (s *Serial) ReceiveWithError(b byte, err LineError) {
+	s.inputChan <- rxChar{b: b, err: err}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fill()
+	s.updateIRQ()
+}
+
+// ReadInput reads the backend until EOF and passes the bytes to the guest.
+func (s *Serial) ReadInput(in io.Reader) error {
+	r := bufio.NewReader(in)
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		s.Receive(b)
+	}
+}
+
+// State is the state of Serial which is saved in a snapshot of the VM. The
+// input queued but not yet received by the UART and the output being written
+// to the backend are not included.
+type State struct {
+	IER, LCR, MCR, LSR, MSR, SCR, FCR, DLL, DLM byte
+
+	// RxErrors has the errors of each byte in RxFIFO.
+	RxFIFO   []byte
+	RxErrors []byte
+	TxFIFO   []byte
+	THREmpty bool
+}
+
+func (s *Serial) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := State{
+		IER: s.ier, LCR: s.lcr, MCR: s.mcr, LSR: s.lsr, MSR: s.msr,
+		SCR: s.scr, FCR: s.fcr, DLL: s.dll, DLM: s.dlm,
+		TxFIFO:   append([]byte{}, s.tx...),
+		THREmpty: s.thrEmpty,
+	}
+
+	for _, c := range s.rx {
+		state.RxFIFO = append(state.RxFIFO, c.b)
+		state.RxErrors = append(state.RxErrors, byte(c.err))
+	}
+
+	return state
+}
+
+func (s *Serial) SetState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ier, s.lcr, s.mcr, s.lsr, s.msr = state.IER, state.LCR, state.MCR, state.LSR, state.MSR
+	s.scr, s.fcr, s.dll, s.dlm = state.SCR, state.FCR, state.DLL, state.DLM
+	s.thrEmpty = state.THREmpty
+
+	s.rx = nil
+
+	for i, b := range state.RxFIFO {
+		c := rxChar{b: b}
+		if i < len(state.RxErrors) {
+			c.err = LineError(state.RxErrors[i])
+		}
+
+		s.rx = append(s.rx, c)
+	}
+
+	// The output being written when the state was saved has been written by
+	// the saved VM, and the rest is written from here.
+	s.tx = append([]byte{}, state.TxFIFO...)
+	if len(s.tx) == 0 {
+		s.lsr |= lsrTHRE | lsrTEMT
+	} else {
+		s.lsr &^= lsrTHRE | lsrTEMT
+
+		if !s.transmitting {
+			s.startTransmit()
+		}
+	}
+
+	// The line may be already high in the restored interrupt controller.
+	s.irqLevel = s.interrupt() != iirNoInt && s.irqEnabled()
 }
 
 func (s *Serial) dlab() bool {
-	return s.LCR&0x80 != 0
+	return s.lcr&lcrDLAB != 0
+}
+
+func (s *Serial) loopback() bool {
+	return s.mcr&mcrLoop != 0
+}
+
+func (s *Serial) fifoEnabled() bool {
+	return s.fcr&fcrEnable != 0
+}
+
+// fifoLen is the capacity of the receive buffer, which is RBR itself if the
+// FIFO is disabled.
+func (s *Serial) fifoLen() int {
+	if s.fifoEnabled() {
+		return FIFOSize
+	}
+
+	return 1
+}
+
+// trigger is the number of bytes in the receive FIFO to raise the interrupt
+// of received data available.
+func (s *Serial) trigger() int {
+	if !s.fifoEnabled() {
+		return 1
+	}
+
+	return []int{1, 4, 8, 14}[s.fcr>>6]
+}
+
+// fill moves the input queued from the backend into the receive FIFO while
+// it has room. The input is not connected in the loopback mode.
+func (s *Serial) fill() {
+	if s.loopback() {
+		return
+	}
+
+	for len(s.rx) < s.fifoLen() {
+		select {
+		case c := <-s.inputChan:
+			s.rx = append(s.rx, c)
+		default:
+			return
+		}
+	}
+}
+
+// push receives the byte sent to itself in the loopback mode.
+func (s *Serial) push(b byte) {
+	if len(s.rx) >= s.fifoLen() {
+		s.lsr |= lsrOE
+
+		return
+	}
+
+	s.rx = append(s.rx, rxChar{b: b})
+}
+
+// transmit puts the byte written to THR into the transmit FIFO, which is
+// written to the backend by the goroutine. The byte is lost if the FIFO is
+// full as in the real UART, since the vCPU must not wait for the backend,
+// which may block forever (e.g. a pty nobody reads). The guest waits for THRE
+// before writing.
+func (s *Serial) transmit(b byte) {
+	if len(s.tx) >= s.fifoLen() {
+		return
+	}
+
+	s.tx = append(s.tx, b)
+	s.lsr &^= lsrTHRE | lsrTEMT
+	s.thrEmpty = false
+
+	if !s.transmitting {
+		s.startTransmit()
+	}
+}
+
+// startTransmit starts the goroutine writing the transmit FIFO to the
+// backend. THRE is set each time it takes the FIFO, and TEMT is set when the
+// FIFO is empty after the write. The caller must hold mu.
+func (s *Serial) startTransmit() {
+	s.transmitting = true
+
+	go func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for len(s.tx) > 0 {
+			out, data := s.out, s.tx
+			s.tx = nil
+
+			s.lsr |= lsrTHRE
+			s.thrEmpty = true
+			s.updateIRQ()
+
+			// The guest should not stop even if the backend is broken
+			// (e.g. the client of a socket is gone), so the error is
+			// ignored here.
+			s.mu.Unlock()
+			_, _ = out.Write(data)
+			s.mu.Lock()
+		}
+
+		s.lsr |= lsrTEMT
+		s.transmitting = false
+	}()
+}
+
+// lineStatus returns LSR, where the errors of the character at the top of the
+// receive FIFO are revealed.
+func (s *Serial) lineStatus() byte {
+	lsr := s.lsr
+
+	if len(s.rx) > 0 {
+		lsr |= lsrDR | byte(s.rx[0].err)
+	}
+
+	if !s.fifoEnabled() {
+		return lsr
+	}
+
+	for _, c := range s.rx {
+		if c.err != 0 {
+			return lsr | lsrFIFO
+		}
+	}
+
+	return lsr
+}
+
+// interrupt returns the value of IIR for the pending interrupt with the
+// highest priority, without the FIFO enabled bits.
+func (s *Serial) interrupt() byte {
+	switch {
+	case s.ier&ierRLSI != 0 && s.lineStatus()&(lsrOE|lsrErrors) != 0:
+		return iirRLSI
+	case s.ier&ierRDI != 0 && len(s.rx) >= s.trigger():
+		return iirRDI
+	case s.ier&ierRDI != 0 && len(s.rx) > 0 && len(s.inputChan) == 0:
+		// The line is regarded as idle when nothing is queued from the
+		// backend, and the bytes below the trigger level time out.
+		return iirCTI
+	case s.ier&ierTHRI != 0 && s.thrEmpty:
+		return iirTHRI
+	case s.ier&ierMSI != 0 && s.msr&(msrDCTS|msrDDSR|msrTERI|msrDDCD) != 0:
+		return iirMSI
+	}
+
+	return iirNoInt
+}
+
+// irqEnabled reports whether the interrupt reaches the interrupt controller.
+// On PCs, it is gated by OUT2, which is disconnected in the loopback mode.
+func (s *Serial) irqEnabled() bool {
+	return s.mcr&mcrOut2 != 0 && !s.loopback()
+}
+
+func (s *Serial) updateIRQ() {
+	level := s.interrupt() != iirNoInt && s.irqEnabled()
+	if level == s.irqLevel {
+		return
+	}
+
+	s.irqLevel = level
+	s.irqInjector.SetSerialIRQ(level)
+}
+
+// updateMSR sets the modem status, which reflects MCR in the loopback mode,
+// and the delta bits for the changes.
+func (s *Serial) updateMSR() {
+	status := byte(msrCTS | msrDSR | msrDCD)
+
+	if s.loopback() {
+		status = 0
+
+		if s.mcr&mcrRTS != 0 {
+			status |= msrCTS
+		}
+
+		if s.mcr&mcrDTR != 0 {
+			status |= msrDSR
+		}
+
+		if s.mcr&mcrOut1 != 0 {
+			status |= msrRI
+		}
+
+		if s.mcr&mcrOut2 != 0 {
+			status |= msrDCD
+		}
+	}
+
+	changed := (s.msr ^ status) & 0xf0
+	delta := s.msr & 0x0f
+
+	if changed&msrCTS != 0 {
+		delta |= msrDCTS
+	}
+
+	if changed&msrDSR != 0 {
+		delta |= msrDDSR
+	}
+
+	// TERI is set only on the trailing edge of RI.
+	if changed&msrRI != 0 && status&msrRI == 0 {
+		delta |= msrTERI
+	}
+
+	if changed&msrDCD != 0 {
+		delta |= msrDDCD
+	}
+
+	s.msr = status | delta
 }
 
 func (s *Serial) In(port uint64, values []byte) error {
-	port -= COM1Addr
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	port -= s.base
 
 	switch {
-	case port == 0 && !s.dlab():
-		// RBR
-		if len(s.inputChan) > 0 {
-			values[0] = <-s.inputChan
-		}
-	case port == 0 && s.dlab():
-		// DLL
-		values[0] = 0xc // baud rate 9600
-	case port == 1 && !s.dlab():
-		// IER
-		values[0] = s.IER
-	case port == 1 && s.dlab():
-		// DLM
-		values[0] = 0x0 // baud rate 9600
-	case port == 2:
-		// IIR
-	case port == 3:
-		// LCR
-	case port == 4:
-		// MCR
-	case port == 5:
-		// LSR
-		values[0] |= 0x20 // Empty Transmitter Holding Register
-		values[0] |= 0x40 // Empty Data Holding Registers
-
-		if len(s.inputChan) > 0 {
-			values[0] |= 0x1 // Data Ready
-		}
-	case port == 6:
-		// MSR
-		break
+	case port == regRBR && !s.dlab():
+		if len(s.rx) > 0 {
+			// The errors revealed at the top are kept until LSR is
+			// read.
+			values[0] = s.rx[0].b
+			s.lsr |= byte(s.rx[0].err)
+			s.rx = s.rx[1:]
+		}
+
+		s.fill()
+	case port == regRBR && s.dlab():
+		values[0] = s.dll
+	case port == regIER && !s.dlab():
+		values[0] = s.ier
+	case port == regIER && s.dlab():
+		values[0] = s.dlm
+	case port == regIIR:
+		values[0] = s.interrupt()
+
+		if values[0] == iirTHRI {
+			s.thrEmpty = false
+		}
+
+		if s.fifoEnabled() {
+			values[0] |= iirFIFOEn
+		}
+	case port == regLCR:
+		values[0] = s.lcr
+	case port == regMCR:
+		values[0] = s.mcr
+	case port == regLSR:
+		values[0] = s.lineStatus()
+
+		// Reading LSR clears the errors.
+		s.lsr &^= lsrOE | lsrErrors
+
+		if len(s.rx) > 0 {
+			s.rx[0].err = 0
+		}
+	case port == regMSR:
+		values[0] = s.msr
+		s.msr &= 0xf0
+	case port == regSCR:
+		values[0] = s.scr
 	}
 
+	s.updateIRQ()
+
 	return nil
 }
 
 func (s *Serial) Out(port uint64, values []byte) error {
-	port -= COM1Addr
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	port -= s.base
 
 	switch {
-	case port == 0 && !s.dlab():
-		// THR
-		fmt.Printf("%c", values[0])
-	case port == 0 && s.dlab():
-		// DLL
-	case port == 1 && !s.dlab():
-		// IER
-		s.IER = values[0]
-		if s.IER != 0 {
-			s.irqInjector.InjectSerialIRQ()
-		}
-	case port == 1 && s.dlab():
-		// DLM
-	case port == 2:
+	case port == regRBR && !s.dlab():
+		// THR, which is received immediately in the loopback mode.
+		if s.loopback() {
+			s.push(values[0])
+			s.thrEmpty = true
+		} else {
+			s.transmit(values[0])
+		}
+	case port == regRBR && s.dlab():
+		s.dll = values[0]
+	case port == regIER && !s.dlab():
+		// Enabling the interrupt of THR empty raises it immediately if THR
+		// is empty.
+		if s.ier&ierTHRI == 0 && values[0]&ierTHRI != 0 && s.lsr&lsrTHRE != 0 {
+			s.thrEmpty = true
+		}
+
+		s.ier = values[0] & ierMask
+	case port == regIER && s.dlab():
+		s.dlm = values[0]
+	case port == regIIR:
 		// FCR
-	case port == 3:
-		// LCR
-		s.LCR = values[0]
-	case port == 4:
-		// MCR
-	default:
-		// factory test or not used
-		break
+		if (s.fcr^values[0])&fcrEnable != 0 || values[0]&fcrClearRx != 0 {
+			s.rx = nil
+		}
+
+		// Clearing the transmit FIFO makes THR empty, which raises the
+		// interrupt unless it has been empty.
+		if (s.fcr^values[0])&fcrEnable != 0 || values[0]&fcrClearTx != 0 {
+			if s.lsr&lsrTHRE == 0 {
+				s.thrEmpty = true
+			}
+
+			s.tx = nil
+			s.lsr |= lsrTHRE
+		}
+
+		s.fcr = values[0] & (fcrEnable | fcrTrigMask)
+		s.fill()
+	case port == regLCR:
+		s.lcr = values[0]
+	case port == regMCR:
+		s.mcr = values[0] & mcrMask
+		s.updateMSR()
+		s.fill()
+	case port == regLSR:
+		// factory test
+	case port == regMSR:
+		// read only
+	case port == regSCR:
+		s.scr = values[0]
 	}
 
+	s.updateIRQ()
+
 	return nil
 }
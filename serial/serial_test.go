@@ -1,22 +1,62 @@
 package serial_test
 
 import (
+	"bytes"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/bobuhiro11/gokvm/serial"
 )
 
-type mockInjector struct{}
+type mockInjector struct {
+	level bool
+}
+
+func (m *mockInjector) SetSerialIRQ(level bool) {
+	m.level = level
+}
+
+func in(t *testing.T, s *serial.Serial, reg uint64) byte {
+	t.Helper()
+
+	values := []byte{0}
+	if err := s.In(serial.COM1Addr+reg, values); err != nil {
+		t.Fatal(err)
+	}
+
+	return values[0]
+}
+
+func out(t *testing.T, s *serial.Serial, reg uint64, value byte) {
+	t.Helper()
+
+	if err := s.Out(serial.COM1Addr+reg, []byte{value}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitLSR waits until the bit of LSR is set, e.g. 0x20 (THRE) before writing
+// THR as the driver does, or 0x40 (TEMT) after which the output has been
+// written to the backend.
+func waitLSR(t *testing.T, s *serial.Serial, bit byte) {
+	t.Helper()
 
-func (m *mockInjector) InjectSerialIRQ() {
+	deadline := time.Now().Add(time.Second)
+
+	for in(t, s, 5)&bit == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("LSR 0x%x is not set", bit)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
 }
 
 func TestNew(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
-	s.GetInputChan()
-
+	_, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -25,7 +65,7 @@ func TestNew(t *testing.T) {
 func TestIn(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +82,7 @@ func TestIn(t *testing.T) {
 func TestOut(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,3 +95,419 @@ func TestOut(t *testing.T) {
 		}
 	}
 }
+
+func TestOutput(t *testing.T) {
+	t.Parallel()
+
+	out := &bytes.Buffer{}
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []byte("hello") {
+		waitLSR(t, s, 0x20)
+
+		if err := s.Out(serial.COM1Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitLSR(t, s, 0x40)
+
+	if out.String() != "hello" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	t.Parallel()
+
+	injector := &mockInjector{}
+
+	s, err := serial.New(serial.COM1Addr, injector, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OUT2 and the interrupt of received data available
+	out(t, s, 4, 0x08)
+	out(t, s, 1, 0x01)
+
+	if err := s.ReadInput(bytes.NewReader([]byte("ab"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if !injector.level {
+		t.Fatalf("irq is not raised\n")
+	}
+
+	for _, expected := range []byte("ab") {
+		if lsr := in(t, s, 5); lsr&0x1 == 0 {
+			t.Fatalf("data is not ready: LSR 0x%x", lsr)
+		}
+
+		if iir := in(t, s, 2); iir != 0x04 {
+			t.Fatalf("unexpected IIR: 0x%x", iir)
+		}
+
+		if actual := in(t, s, 0); actual != expected {
+			t.Fatalf("expected: %c, actual: %c", expected, actual)
+		}
+	}
+
+	if injector.level {
+		t.Fatalf("irq is not lowered\n")
+	}
+
+	if iir := in(t, s, 2); iir != 0x01 {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	t.Parallel()
+
+	injector := &mockInjector{}
+
+	s, err := serial.New(serial.COM1Addr, injector, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enable the FIFO with the trigger level of 4 bytes
+	out(t, s, 2, 0x41)
+	out(t, s, 4, 0x08)
+	out(t, s, 1, 0x01)
+
+	for _, b := range []byte("abc") {
+		s.Receive(b)
+	}
+
+	// nothing follows, so the bytes below the trigger level time out
+	if iir := in(t, s, 2); iir != 0xcc || !injector.level {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+
+	s.Receive('d')
+
+	if iir := in(t, s, 2); iir != 0xc4 {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+
+	// clear the receive FIFO
+	out(t, s, 2, 0x43)
+
+	if lsr := in(t, s, 5); lsr&0x1 != 0 || injector.level {
+		t.Fatalf("FIFO is not cleared: LSR 0x%x", lsr)
+	}
+
+	// bytes beyond the FIFO are queued until the guest reads it
+	for i := 0; i < serial.FIFOSize+2; i++ {
+		s.Receive(byte(i))
+	}
+
+	for i := 0; i < serial.FIFOSize+2; i++ {
+		if actual := in(t, s, 0); actual != byte(i) {
+			t.Fatalf("expected: %d, actual: %d", i, actual)
+		}
+	}
+}
+
+func TestTHREmpty(t *testing.T) {
+	t.Parallel()
+
+	injector := &mockInjector{}
+	output := &bytes.Buffer{}
+
+	s, err := serial.New(serial.COM1Addr, injector, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 4, 0x08)
+	out(t, s, 1, 0x02)
+
+	if !injector.level {
+		t.Fatalf("irq is not raised by enabling THRI\n")
+	}
+
+	// reading IIR clears the interrupt of THR empty
+	if iir := in(t, s, 2); iir != 0x02 || injector.level {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+
+	out(t, s, 0, 'x')
+	waitLSR(t, s, 0x40)
+
+	if !injector.level || output.String() != "x" {
+		t.Fatalf("irq is not raised by writing THR\n")
+	}
+
+	// the interrupt does not reach the interrupt controller without OUT2
+	out(t, s, 4, 0x00)
+
+	if injector.level {
+		t.Fatalf("irq is not gated by OUT2\n")
+	}
+}
+
+// gateWriter blocks the writes until the gate is closed.
+type gateWriter struct {
+	gate chan struct{}
+	buf  bytes.Buffer
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+
+	return w.buf.Write(p)
+}
+
+// blockTransmitter writes the byte to THR, and waits until it is moved to the
+// shift register, whose write to the backend blocks.
+func blockTransmitter(t *testing.T, s *serial.Serial, b byte) {
+	t.Helper()
+
+	out(t, s, 0, b)
+
+	for deadline := time.Now().Add(time.Second); in(t, s, 5)&0x60 != 0x20; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("THR is not empty")
+		}
+	}
+}
+
+func TestTransmitFIFO(t *testing.T) {
+	t.Parallel()
+
+	w := &gateWriter{gate: make(chan struct{})}
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 2, 0x01)
+	blockTransmitter(t, s, 'a')
+
+	// The byte written to the full FIFO is lost without blocking.
+	for _, b := range []byte("0123456789abcdefg") {
+		out(t, s, 0, b)
+	}
+
+	if lsr := in(t, s, 5); lsr&0x60 != 0 {
+		t.Fatalf("transmitter is empty: LSR 0x%x", lsr)
+	}
+
+	close(w.gate)
+	waitLSR(t, s, 0x40)
+
+	if w.buf.String() != "a0123456789abcdef" {
+		t.Fatalf("unexpected output: %q", w.buf.String())
+	}
+}
+
+func TestClearTransmitFIFO(t *testing.T) {
+	t.Parallel()
+
+	w := &gateWriter{gate: make(chan struct{})}
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 2, 0x01)
+	out(t, s, 1, 0x02)
+	blockTransmitter(t, s, 'a')
+
+	if iir := in(t, s, 2); iir != 0xc2 {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+
+	out(t, s, 0, 'b')
+
+	if iir := in(t, s, 2); iir != 0xc1 {
+		t.Fatalf("unexpected IIR: 0x%x", iir)
+	}
+
+	// Clearing the FIFO makes THR empty and raises the interrupt.
+	out(t, s, 2, 0x05)
+
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xc2 || lsr&0x60 != 0x20 {
+		t.Fatalf("unexpected IIR 0x%x or LSR 0x%x", iir, lsr)
+	}
+
+	close(w.gate)
+	waitLSR(t, s, 0x40)
+
+	if w.buf.String() != "a" {
+		t.Fatalf("unexpected output: %q", w.buf.String())
+	}
+}
+
+func TestLineErrors(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// FIFO, OUT2 and the interrupts of received data and line status
+	out(t, s, 2, 0x01)
+	out(t, s, 4, 0x08)
+	out(t, s, 1, 0x05)
+
+	s.Receive('a')
+	s.ReceiveWithError(0, serial.Break|serial.FramingError)
+
+	// The errors are revealed when the byte is at the top of the FIFO.
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xc4 || lsr != 0xe1 {
+		t.Fatalf("unexpected IIR 0x%x or LSR 0x%x", iir, lsr)
+	}
+
+	if actual := in(t, s, 0); actual != 'a' {
+		t.Fatalf("expected: a, actual: %c", actual)
+	}
+
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xc6 || lsr != 0xf9 {
+		t.Fatalf("unexpected IIR 0x%x or LSR 0x%x", iir, lsr)
+	}
+
+	// Reading LSR clears the errors.
+	if iir, lsr := in(t, s, 2), in(t, s, 5); iir != 0xc4 || lsr != 0x61 {
+		t.Fatalf("unexpected IIR 0x%x or LSR 0x%x", iir, lsr)
+	}
+
+	if actual := in(t, s, 0); actual != 0 {
+		t.Fatalf("expected: 0, actual: %c", actual)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	t.Parallel()
+
+	injector := &mockInjector{}
+	output := &bytes.Buffer{}
+
+	s, err := serial.New(serial.COM1Addr, injector, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same test as autoconfig of the 8250 driver in Linux
+	out(t, s, 4, 0x1a)
+
+	if msr := in(t, s, 6) & 0xf0; msr != 0x90 {
+		t.Fatalf("unexpected MSR: 0x%x", msr)
+	}
+
+	out(t, s, 7, 0x55)
+
+	if scr := in(t, s, 7); scr != 0x55 {
+		t.Fatalf("unexpected SCR: 0x%x", scr)
+	}
+
+	out(t, s, 0, 'a')
+	out(t, s, 0, 'b')
+
+	if output.Len() != 0 {
+		t.Fatalf("output in the loopback mode: %q", output.String())
+	}
+
+	// the second byte overruns RBR without the FIFO
+	if lsr := in(t, s, 5); lsr&0x3 != 0x3 {
+		t.Fatalf("unexpected LSR: 0x%x", lsr)
+	}
+
+	if lsr := in(t, s, 5); lsr&0x2 != 0 {
+		t.Fatalf("overrun error is not cleared: LSR 0x%x", lsr)
+	}
+
+	if actual := in(t, s, 0); actual != 'a' {
+		t.Fatalf("expected: a, actual: %c", actual)
+	}
+
+	out(t, s, 4, 0x00)
+
+	// DSR is asserted again, and the delta bit is set
+	if msr := in(t, s, 6); msr != 0xb0|0x02 {
+		t.Fatalf("unexpected MSR: 0x%x", msr)
+	}
+
+	if msr := in(t, s, 6); msr != 0xb0 {
+		t.Fatalf("delta bits are not cleared: MSR 0x%x", msr)
+	}
+}
+
+func TestState(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 2, 0x01)
+	out(t, s, 3, 0x03)
+	s.Receive('a')
+
+	restored, err := serial.New(serial.COM1Addr, &mockInjector{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored.SetState(s.State())
+
+	if lcr := in(t, restored, 3); lcr != 0x03 {
+		t.Fatalf("unexpected LCR: 0x%x", lcr)
+	}
+
+	if actual := in(t, restored, 0); actual != 'a' {
+		t.Fatalf("expected: a, actual: %c", actual)
+	}
+}
+
+func TestBase(t *testing.T) {
+	t.Parallel()
+
+	output := &bytes.Buffer{}
+
+	s, err := serial.New(serial.COM2Addr, &mockInjector{}, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Out(serial.COM2Addr+7, []byte{0x55}); err != nil {
+		t.Fatal(err)
+	}
+
+	scr := []byte{0}
+	if err := s.In(serial.COM2Addr+7, scr); err != nil {
+		t.Fatal(err)
+	}
+
+	if scr[0] != 0x55 {
+		t.Fatalf("unexpected SCR: 0x%x", scr[0])
+	}
+
+	if err := s.Out(serial.COM2Addr, []byte{'a'}); err != nil {
+		t.Fatal(err)
+	}
+
+	// LSR of COM2
+	lsr := []byte{0}
+
+	for deadline := time.Now().Add(time.Second); lsr[0]&0x40 == 0; time.Sleep(time.Millisecond) {
+		if err := s.In(serial.COM2Addr+5, lsr); err != nil || time.Now().After(deadline) {
+			t.Fatalf("transmitter is not empty: %v", err)
+		}
+	}
+
+	if output.String() != "a" {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
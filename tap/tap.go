@@ -1,16 +1,56 @@
 package tap
 
 import (
+	"os"
+	"os/signal"
+	"sync"
 	"syscall"
 	"unsafe"
 )
 
 const ifNameSize = 0x10
 
+// Offloads given to SetOffload, which allow the kernel to read the packets
+// with the checksum or the segmentation left undone.
+//
+// refs https://github.com/torvalds/linux/blob/v5.14/include/uapi/linux/if_tun.h
+const (
+	OffloadCSum = 0x01 // TUN_F_CSUM
+	OffloadTSO4 = 0x02 // TUN_F_TSO4
+	OffloadTSO6 = 0x04 // TUN_F_TSO6
+	OffloadUFO  = 0x10 // TUN_F_UFO
+)
+
+// Flags and ioctl of the multi-queue tap interface, which are missing in
+// package syscall.
+const (
+	iffMultiQueue  = 0x0100
+	iffAttachQueue = 0x0200
+	iffDetachQueue = 0x0400
+	tunSetQueue    = 0x400454d9
+)
+
+// pollIn is POLLIN of poll(2), which is missing in package syscall.
+const pollIn = 0x1
+
 type Tap struct {
 	fd int
 }
 
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// sigio has the channels given to Notify for the tap devices. SIGIO raised
+// by any of them is handled once, and dispatched to the ones with packets.
+var sigio = struct {
+	once sync.Once
+	mu   sync.Mutex
+	chs  map[int]chan<- interface{}
+}{chs: map[int]chan<- interface{}{}}
+
 type ifReq struct {
 	Name  [ifNameSize]byte
 	Flags uint16
@@ -41,7 +81,42 @@ func fcntl(fd, op, arg uintptr) (uintptr, error) {
 	return res, err
 }
 
+// New creates the tap interface, or attaches to it if it exists. Each packet
+// read and written is preceded by struct virtio_net_hdr, whose size is 10
+// bytes unless changed by SetVnetHdrSize.
 func New(name string) (*Tap, error) {
+	return open(name, 0)
+}
+
+// NewMultiQueue creates the tap interface with n queues, or attaches to it
+// if it exists, and returns a Tap for each queue. The kernel distributes the
+// packets among the queues by their flows. It is the same as New if n is 1.
+func NewMultiQueue(name string, n int) ([]*Tap, error) {
+	if n == 1 {
+		t, err := New(name)
+
+		return []*Tap{t}, err
+	}
+
+	res := []*Tap{}
+
+	for i := 0; i < n; i++ {
+		t, err := open(name, iffMultiQueue)
+		if err != nil {
+			for _, t := range res {
+				t.Close()
+			}
+
+			return nil, err
+		}
+
+		res = append(res, t)
+	}
+
+	return res, nil
+}
+
+func open(name string, extraFlags uint16) (*Tap, error) {
 	var err error
 
 	t := &Tap{}
@@ -52,7 +127,7 @@ func New(name string) (*Tap, error) {
 
 	ifr := ifReq{
 		Name:  [ifNameSize]byte{},
-		Flags: syscall.IFF_TAP | syscall.IFF_NO_PI,
+		Flags: syscall.IFF_TAP | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR | extraFlags,
 	}
 	copy(ifr.Name[:ifNameSize-1], name)
 
@@ -81,7 +156,104 @@ func New(name string) (*Tap, error) {
 	return t, nil
 }
 
+// SetVnetHdrSize sets the size of struct virtio_net_hdr, which is 12 bytes
+// with num_buffers.
+func (t *Tap) SetVnetHdrSize(size int) error {
+	sz := int32(size)
+	_, err := ioctl(uintptr(t.fd), syscall.TUNSETVNETHDRSZ, uintptr(unsafe.Pointer(&sz)))
+
+	return err
+}
+
+// SetOffload sets the offloads of the packets read from the tap device, which
+// is a combination of Offload*. The segmentation offloads require OffloadCSum.
+func (t *Tap) SetOffload(offloads uint) error {
+	_, err := ioctl(uintptr(t.fd), syscall.TUNSETOFFLOAD, uintptr(offloads))
+
+	return err
+}
+
+// SetQueueEnabled attaches the queue of the multi-queue tap interface, or
+// detaches it so that the kernel does not deliver packets to it.
+func (t *Tap) SetQueueEnabled(enabled bool) error {
+	ifr := ifReq{Flags: iffDetachQueue}
+	if enabled {
+		ifr.Flags = iffAttachQueue
+	}
+
+	_, err := ioctl(uintptr(t.fd), tunSetQueue, uintptr(unsafe.Pointer(&ifr)))
+
+	return err
+}
+
+// Notify sends to c when packets arrive at the tap device. The send does not
+// block, and is dropped if c is not ready.
+func (t *Tap) Notify(c chan<- interface{}) {
+	sigio.once.Do(func() {
+		s := make(chan os.Signal, 1)
+		signal.Notify(s, syscall.SIGIO)
+
+		go dispatchSIGIO(s)
+	})
+
+	sigio.mu.Lock()
+	sigio.chs[t.fd] = c
+	sigio.mu.Unlock()
+}
+
+// dispatchSIGIO polls the tap devices on each SIGIO, since it does not tell
+// which one has raised it.
+func dispatchSIGIO(s <-chan os.Signal) {
+	for range s {
+		sigio.mu.Lock()
+
+		fds := []pollFd{}
+		for fd := range sigio.chs {
+			fds = append(fds, pollFd{fd: int32(fd), events: pollIn})
+		}
+
+		if err := poll(fds); err == nil {
+			for _, f := range fds {
+				if f.revents&pollIn == 0 {
+					continue
+				}
+
+				select {
+				case sigio.chs[int(f.fd)] <- true:
+				default:
+				}
+			}
+		}
+
+		sigio.mu.Unlock()
+	}
+}
+
+// poll checks the fds without blocking.
+func poll(fds []pollFd) error {
+	if len(fds) == 0 {
+		return nil
+	}
+
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_POLL, uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)), 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return errno
+		}
+
+		return nil
+	}
+}
+
 func (t *Tap) Close() error {
+	sigio.mu.Lock()
+	delete(sigio.chs, t.fd)
+	sigio.mu.Unlock()
+
 	return syscall.Close(t.fd)
 }
 
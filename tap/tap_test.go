@@ -2,9 +2,11 @@ package tap_test
 
 import (
 	"errors"
+	"net"
 	"os/exec"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bobuhiro11/gokvm/tap"
 )
@@ -31,7 +33,8 @@ func TestWrite(t *testing.T) { // nolint:paralleltest
 		t.Fatal(err)
 	}
 
-	if _, err := tap.Write(make([]byte, 20)); err != nil {
+	// struct virtio_net_hdr followed by the packet
+	if _, err := tap.Write(make([]byte, 10+20)); err != nil {
 		t.Fatal(err)
 	}
 
@@ -55,3 +58,113 @@ func TestRead(t *testing.T) { // nolint:paralleltest
 
 	_ = tap.Close()
 }
+
+func TestOffload(t *testing.T) { // nolint:paralleltest
+	tp, err := tap.New("test_offload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tp.Close()
+
+	if err := tp.SetVnetHdrSize(12); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.SetOffload(tap.OffloadCSum | tap.OffloadTSO4 | tap.OffloadTSO6); err != nil {
+		t.Fatal(err)
+	}
+
+	// The segmentation offloads are rejected without the checksum offload.
+	if err := tp.SetOffload(tap.OffloadTSO4); err == nil {
+		t.Fatal("TSO4 should not be enabled without CSUM")
+	}
+}
+
+func TestMultiQueue(t *testing.T) { // nolint:paralleltest
+	taps, err := tap.NewMultiQueue("test_mq", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(taps) != 4 {
+		t.Fatalf("unexpected number of queues: %d", len(taps))
+	}
+
+	for _, tp := range taps {
+		defer tp.Close()
+	}
+
+	if err := taps[3].SetQueueEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Detaching the queue twice fails.
+	if err := taps[3].SetQueueEnabled(false); err == nil {
+		t.Fatal("queue should be detached already")
+	}
+
+	if err := taps[3].SetQueueEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendTo transmits an ethernet frame from the host to the interface, which
+// arrives at the tap device.
+func sendTo(t *testing.T, name string) {
+	t.Helper()
+
+	ifc, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer syscall.Close(fd)
+
+	frame := make([]byte, 60)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	if err := syscall.Sendto(fd, frame, 0, &syscall.SockaddrLinklayer{Ifindex: ifc.Index}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotify(t *testing.T) { // nolint:paralleltest
+	chs := []chan interface{}{make(chan interface{}, 1), make(chan interface{}, 1)}
+
+	for i, name := range []string{"test_notify0", "test_notify1"} {
+		tp, err := tap.New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer tp.Close()
+
+		tp.Notify(chs[i])
+	}
+
+	// Only the tap device with the packet is notified, while the other is
+	// down not to receive any.
+	if err := exec.Command("ip", "link", "set", "test_notify1", "up").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendTo(t, "test_notify1")
+
+	select {
+	case <-chs[1]:
+	case <-time.After(time.Second):
+		t.Fatal("tap device is not notified")
+	}
+
+	select {
+	case <-chs[0]:
+		t.Fatal("tap device without packets is notified")
+	default:
+	}
+}
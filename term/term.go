@@ -52,7 +52,13 @@ func IsTerminal() bool {
 }
 
 func SetRawMode() (func(), error) {
-	t, err := read(0)
+	return SetRawModeFd(0)
+}
+
+// SetRawModeFd puts the terminal referred by fd into raw mode and returns the
+// function to restore the previous mode.
+func SetRawModeFd(fd int) (func(), error) {
+	t, err := read(fd)
 	if err != nil {
 		return func() {}, err
 	}
@@ -68,6 +74,6 @@ func SetRawMode() (func(), error) {
 	t.Cc[syscall.VTIME] = 0
 
 	return func() {
-		_ = write(0, oldTermios)
-	}, write(0, t)
+		_ = write(fd, oldTermios)
+	}, write(fd, t)
 }
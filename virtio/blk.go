@@ -0,0 +1,529 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+var ErrNoBlkReq = errors.New("no request for blk")
+
+const (
+	BlkIOPortStart = 0x6300
+	BlkIOPortSize  = 0x100
+
+	// refs https://github.com/torvalds/linux/blob/v5.14/include/uapi/linux/virtio_blk.h
+	SectorSize = 512
+
+	blkFFlush = 1 << 9
+
+	blkTIn    = 0
+	blkTOut   = 1
+	blkTFlush = 4
+	blkTGetID = 8
+
+	blkSOK     = 0
+	blkSIOErr  = 1
+	blkSUnsupp = 2
+
+	blkIDBytes = 20
+
+	// blkQueueSize is the size of the request queue, which is larger than
+	// that of Net so that more requests are in flight.
+	blkQueueSize = 128
+)
+
+type BlkHdr struct {
+	commonHeader commonHeader
+	blkHeader    blkHeader
+}
+
+type blkHeader struct {
+	capacity uint64
+}
+
+// struct virtio_blk_outhdr
+type blkReqHdr struct {
+	Type   uint32
+	_      uint32 // ioprio
+	Sector uint64
+}
+
+type Blk struct {
+	file *os.File
+	id   [blkIDBytes]byte
+
+	Hdr BlkHdr
+
+	// IOBase is the start of the IO port range of the legacy interface,
+	// which is BlkIOPortStart unless it is used by another device.
+	IOBase uint64
+
+	VirtQueue [1]*queue.Queue
+	Mem       []byte
+	queuePFN  [1]uint32
+
+	// driverFeatures are the features accepted by the driver, which only
+	// change how the virt queue works.
+	driverFeatures uint64
+
+	// mu is held while the virt queue is processed.
+	mu sync.Mutex
+
+	kick chan interface{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (h BlkHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (v *Blk) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1001,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 2, // Block Device
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.IOBase) | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Blk) IOInHandler(port uint64, bytes []byte) error {
+	offset := int(port - v.IOBase)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	l := len(bytes)
+	if offset+l > len(b) {
+		return nil
+	}
+
+	copy(bytes[:l], b[offset:offset+l])
+
+	// Reading ISR clears it.
+	if offset <= 19 && 19 < offset+l {
+		v.Hdr.commonHeader.isr = 0
+	}
+
+	return nil
+}
+
+func (v *Blk) IOOutHandler(port uint64, bytes []byte) error {
+	offset := int(port - v.IOBase)
+
+	switch offset {
+	case 4:
+		// The features not offered are ignored.
+		features := uint32(pci.BytesToNum(bytes)) & v.Hdr.commonHeader.hostFeatures
+
+		v.mu.Lock()
+		v.Hdr.commonHeader.guestFeatures = features
+		v.driverFeatures = uint64(features)
+		v.mu.Unlock()
+	case 8:
+		sel := v.Hdr.commonHeader.queueSEL
+		if int(sel) >= len(v.VirtQueue) {
+			return ErrInvalidSel
+		}
+
+		v.mu.Lock()
+		v.queuePFN[sel] = uint32(pci.BytesToNum(bytes))
+		v.VirtQueue[sel] = queueFromPFN(v.Mem, v.queuePFN[sel], v.QueueNumMax(), v.driverFeatures)
+		v.mu.Unlock()
+	case 14:
+		v.mu.Lock()
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+		v.mu.Unlock()
+	case 16:
+		v.Notify(int(pci.BytesToNum(bytes)))
+	case 18:
+		// The driver resets the device by writing 0.
+		if bytes[0] == 0 {
+			v.Reset()
+
+			return nil
+		}
+
+		v.mu.Lock()
+		v.Hdr.commonHeader.status = bytes[0]
+		v.mu.Unlock()
+	default:
+	}
+
+	return nil
+}
+
+func (v *Blk) GetIORange() (start, end uint64) {
+	return v.IOBase, v.IOBase + BlkIOPortSize
+}
+
+func (v *Blk) ID() uint32 {
+	return blkDeviceID
+}
+
+func (v *Blk) Features() uint64 {
+	return uint64(v.Hdr.commonHeader.hostFeatures)
+}
+
+// SetDriverFeatures sets the features, which are used by the virt queue
+// mapped afterwards.
+func (v *Blk) SetDriverFeatures(features uint64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.driverFeatures = features
+
+	return nil
+}
+
+func (v *Blk) NumQueues() int {
+	return len(v.VirtQueue)
+}
+
+// QueueNumMax returns the size of the virt queues in the legacy header.
+func (v *Blk) QueueNumMax() uint16 {
+	return v.Hdr.commonHeader.queueNUM
+}
+
+func (v *Blk) SetQueue(sel int, size uint16, desc, avail, used uint64) error {
+	if sel < 0 || sel >= len(v.VirtQueue) {
+		return fmt.Errorf("%w: %d", ErrInvalidSel, sel)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vq := (*queue.Queue)(nil)
+
+	if desc != 0 {
+		var err error
+		if vq, err = queue.New(v.Mem, size, desc, avail, used, v.driverFeatures); err != nil {
+			return err
+		}
+	}
+
+	v.VirtQueue[sel] = vq
+
+	return nil
+}
+
+func (v *Blk) Notify(sel int) {
+	if sel != 0 {
+		return
+	}
+
+	// The kick is dropped if the IO thread has another pending, since it
+	// serves all the requests available.
+	select {
+	case v.kick <- true:
+	default:
+	}
+}
+
+func (v *Blk) ReadConfig(offset uint64, data []byte) error {
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	readConfig(b[configOffset:], offset, data)
+
+	return nil
+}
+
+func (v *Blk) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.VirtQueue = [1]*queue.Queue{}
+	v.queuePFN = [1]uint32{}
+	v.driverFeatures = 0
+	v.Hdr.commonHeader.guestFeatures = 0
+	v.Hdr.commonHeader.queueSEL = 0
+	v.Hdr.commonHeader.status = 0
+	v.Hdr.commonHeader.isr = 0
+}
+
+func (v *Blk) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// IO serves all the requests available in the virt queue. Each request
+// consists of a descriptor chain: a read-only header, zero or more data
+// buffers and a single writable status byte at the end.
+func (v *Blk) IO() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vq := v.VirtQueue[0]
+
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	// The driver need not notify the device while the requests are served.
+	vq.DisableNotification()
+
+	served := 0
+
+	for {
+		c, err := vq.Pop()
+		if errors.Is(err, queue.ErrEmpty) {
+			break
+		}
+
+		// The malformed chain is also given back to the driver, so that the
+		// requests behind it are not stalled.
+		written := uint32(0)
+		if err == nil {
+			written = v.serve(c)
+		}
+
+		// This structure is holding both the index of the descriptor chain and the
+		// number of bytes that were written to the memory as part of serving the request.
+		vq.Push(c.Head, written)
+		served++
+	}
+
+	if served > 0 {
+		v.publish(vq)
+	}
+
+	if vq.EnableNotification() || served > 0 {
+		return nil
+	}
+
+	return ErrNoBlkReq
+}
+
+// publish publishes the used ring of the virt queue, and interrupts the
+// driver unless it is suppressed.
+func (v *Blk) publish(vq *queue.Queue) {
+	vq.Publish()
+
+	if vq.NeedsInterrupt() {
+		v.Hdr.commonHeader.isr = 0x1
+		v.IRQInjector.InjectIRQ()
+	}
+}
+
+// serve handles the request in the descriptor chain and returns the number
+// of bytes written to the guest memory. The request is completed with an
+// error status if it is malformed, and nothing is written without the status
+// byte.
+func (v *Blk) serve(c queue.Chain) uint32 {
+	bufs := [][]byte{}
+	for _, b := range c.Buffers {
+		bufs = append(bufs, b.Data)
+	}
+
+	if len(bufs) < 2 || !c.Buffers[len(bufs)-1].Writable || len(bufs[len(bufs)-1]) < 1 {
+		return 0
+	}
+
+	data := bufs[1 : len(bufs)-1]
+	status := &bufs[len(bufs)-1][0]
+	written := uint32(0)
+
+	hdr := blkReqHdr{}
+	if err := binary.Read(bytes.NewReader(bufs[0]), binary.LittleEndian, &hdr); err != nil {
+		*status = blkSIOErr
+
+		return 1
+	}
+
+	*status = blkSOK
+
+	// The reads and the writes must be within the disk, and the sector is
+	// checked before it is converted to the offset not to overflow.
+	off := int64(0)
+
+	if hdr.Type == blkTIn || hdr.Type == blkTOut {
+		size := uint64(0)
+		for _, b := range data {
+			size += uint64(len(b))
+		}
+
+		capacity := v.Hdr.blkHeader.capacity
+		if hdr.Sector > capacity || size > (capacity-hdr.Sector)*SectorSize {
+			*status = blkSIOErr
+
+			return 1
+		}
+
+		off = int64(hdr.Sector * SectorSize)
+	}
+
+	switch hdr.Type {
+	case blkTIn:
+		for _, b := range data {
+			n, err := v.file.ReadAt(b, off)
+			if err != nil && n != len(b) {
+				*status = blkSIOErr
+
+				break
+			}
+
+			off += int64(n)
+			written += uint32(n)
+		}
+	case blkTOut:
+		for _, b := range data {
+			n, err := v.file.WriteAt(b, off)
+			if err != nil {
+				*status = blkSIOErr
+
+				break
+			}
+
+			off += int64(n)
+		}
+	case blkTFlush:
+		if err := v.file.Sync(); err != nil {
+			*status = blkSIOErr
+		}
+	case blkTGetID:
+		for _, b := range data {
+			n := copy(b, v.id[written:])
+			written += uint32(n)
+		}
+	default:
+		*status = blkSUnsupp
+	}
+
+	// the status byte is also written to the guest memory.
+	return written + 1
+}
+
+func NewBlk(path string, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	res := &Blk{
+		file: f,
+		Hdr: BlkHdr{
+			commonHeader: commonHeader{
+				hostFeatures: blkFFlush | ringFeatures,
+				queueNUM:     blkQueueSize,
+				isr:          0x0,
+			},
+			blkHeader: blkHeader{
+				capacity: uint64(fi.Size()) / SectorSize,
+			},
+		},
+		IOBase:      BlkIOPortStart,
+		irq:         irq,
+		IRQInjector: irqInjector,
+		kick:        make(chan interface{}, 1),
+		Mem:         mem,
+		VirtQueue:   [1]*queue.Queue{},
+	}
+
+	// The serial number of the disk reported by VIRTIO_BLK_T_GET_ID.
+	copy(res.id[:], filepath.Base(path))
+
+	return res, nil
+}
+
+// BlkState is the state of Blk which is saved in a snapshot of the VM.
+type BlkState struct {
+	QueuePFN      [1]uint32
+	QueueSel      uint16
+	ISR           uint8
+	Status        uint8
+	GuestFeatures uint32
+}
+
+// Lock stops processing the virt queue until Unlock is called, so that
+// the device state and the guest memory can be saved consistently.
+func (v *Blk) Lock() {
+	v.mu.Lock()
+}
+
+func (v *Blk) Unlock() {
+	v.mu.Unlock()
+}
+
+// State returns the device state. The caller should hold the lock by Lock.
+func (v *Blk) State() BlkState {
+	return BlkState{
+		QueuePFN:      v.queuePFN,
+		QueueSel:      v.Hdr.commonHeader.queueSEL,
+		ISR:           v.Hdr.commonHeader.isr,
+		Status:        v.Hdr.commonHeader.status,
+		GuestFeatures: v.Hdr.commonHeader.guestFeatures,
+	}
+}
+
+// SetState restores the device state. The guest memory must be restored
+// before calling this, since the virt queue is placed in it.
+func (v *Blk) SetState(s BlkState) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.guestFeatures = s.GuestFeatures
+	v.driverFeatures = uint64(s.GuestFeatures)
+
+	for i := range v.VirtQueue {
+		v.queuePFN[i] = s.QueuePFN[i]
+		v.VirtQueue[i] = queueFromPFN(v.Mem, s.QueuePFN[i], v.QueueNumMax(), v.driverFeatures)
+	}
+
+	v.Hdr.commonHeader.queueSEL = s.QueueSel
+	v.Hdr.commonHeader.isr = s.ISR
+	v.Hdr.commonHeader.status = s.Status
+}
+
+// DriverStatus returns the device status written by the driver, which has
+// DRIVER_OK (0x4) set once the device is ready.
+func (v *Blk) DriverStatus() uint8 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.commonHeader.status
+}
+
+func (v *Blk) Close() error {
+	return v.file.Close()
+}
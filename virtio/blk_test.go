@@ -0,0 +1,299 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+func newTestBlk(t *testing.T, image []byte, mem []byte) *virtio.Blk {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "gokvm-blk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	if _, err := f.Write(image); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	v, err := virtio.NewBlk(f.Name(), 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { v.Close() })
+
+	return v
+}
+
+// putBlkReq places a request with a header, a data buffer and a status
+// byte in the guest memory and makes it available in the virt queue.
+func putBlkReq(mem []byte, vq driverQueue, typ uint32, sector uint64, dataLen uint32) {
+	binary.LittleEndian.PutUint32(mem[0x100:], typ)
+	binary.LittleEndian.PutUint64(mem[0x108:], sector)
+
+	// The data buffer is writable for reading the disk.
+	dataFlags := uint16(0x1)
+	if typ != 1 {
+		dataFlags |= 0x2
+	}
+
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: 16, Flags: 0x1, Next: 1})
+	vq.setDesc(1, queue.Desc{Addr: 0x200, Len: dataLen, Flags: dataFlags, Next: 2})
+	vq.setDesc(2, queue.Desc{Addr: 0x1000, Len: 1, Flags: 0x2})
+	vq.makeAvailable(0)
+}
+
+func TestBlkGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := newTestBlk(t, make([]byte, 4*virtio.SectorSize), []byte{})
+	expected := uint16(0x1001)
+	actual := v.GetDeviceHeader().DeviceID
+
+	if actual != expected {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestBlkCapacity(t *testing.T) {
+	t.Parallel()
+
+	v := newTestBlk(t, make([]byte, 4*virtio.SectorSize), []byte{})
+
+	// device specific configuration starts at offset 20
+	actual := make([]byte, 8)
+	_ = v.IOInHandler(virtio.BlkIOPortStart+20, actual)
+
+	if expected := uint64(4); binary.LittleEndian.Uint64(actual) != expected {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestBlkReadWrite(t *testing.T) {
+	t.Parallel()
+
+	image := make([]byte, 4*virtio.SectorSize)
+	copy(image[virtio.SectorSize:], []byte{0xaa, 0xbb, 0xcc, 0xdd})
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, image, mem)
+	vq := mapQueue(t, v, mem, 0, 0x8000)
+
+	// read the sector #1
+	putBlkReq(mem, vq, 0, 1, virtio.SectorSize)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x1000] != 0 {
+		t.Fatalf("unexpected status: %d", mem[0x1000])
+	}
+
+	if !bytes.Equal(mem[0x200:0x204], []byte{0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Fatalf("unexpected data: %v", mem[0x200:0x204])
+	}
+
+	if _, l := vq.usedElem(0); vq.usedIdx() != 1 || l != virtio.SectorSize+1 {
+		t.Fatalf("unexpected used idx %d or length %d", vq.usedIdx(), l)
+	}
+
+	if !v.IRQInjector.(*mockInjector).called {
+		t.Fatalf("irqInjected = false\n")
+	}
+
+	// write it back to the sector #3
+	putBlkReq(mem, vq, 1, 3, virtio.SectorSize)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and read the sector #3 again
+	copy(mem[0x200:0x204], []byte{0, 0, 0, 0})
+	putBlkReq(mem, vq, 0, 3, virtio.SectorSize)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(mem[0x200:0x204], []byte{0xaa, 0xbb, 0xcc, 0xdd}) {
+		t.Fatalf("unexpected data: %v", mem[0x200:0x204])
+	}
+}
+
+func TestBlkOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, make([]byte, 4*virtio.SectorSize), mem)
+	vq := mapQueue(t, v, mem, 0, 0x8000)
+
+	for _, tc := range []struct {
+		typ     uint32
+		sector  uint64
+		dataLen uint32
+	}{
+		{1, 4, virtio.SectorSize},
+		{1, 3, 2 * virtio.SectorSize},
+		{0, 3, 2 * virtio.SectorSize},
+		{1, 1 << 60, virtio.SectorSize},
+	} {
+		mem[0x1000] = 0xff
+		putBlkReq(mem, vq, tc.typ, tc.sector, tc.dataLen)
+
+		if err := v.IO(); err != nil {
+			t.Fatal(err)
+		}
+
+		if mem[0x1000] != 1 {
+			t.Fatalf("unexpected status for %+v: %d", tc, mem[0x1000])
+		}
+	}
+}
+
+func TestBlkMalformedRequest(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, make([]byte, 4*virtio.SectorSize), mem)
+	vq := mapQueue(t, v, mem, 0, 0x8000)
+
+	// a request without the status byte
+	vq.setDesc(3, queue.Desc{Addr: 0x100, Len: 16, Flags: 0x0})
+	vq.makeAvailable(3)
+
+	// a request with the header too short
+	mem[0x1100] = 0xff
+	vq.setDesc(4, queue.Desc{Addr: 0x100, Len: 8, Flags: 0x1, Next: 5})
+	vq.setDesc(5, queue.Desc{Addr: 0x1100, Len: 1, Flags: 0x2})
+	vq.makeAvailable(4)
+
+	// The valid request behind them is also served.
+	putBlkReq(mem, vq, 0, 1, virtio.SectorSize)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if vq.usedIdx() != 3 {
+		t.Fatalf("unexpected used idx: %d", vq.usedIdx())
+	}
+
+	for i, expected := range [][2]uint32{{3, 0}, {4, 1}, {0, virtio.SectorSize + 1}} {
+		if id, l := vq.usedElem(uint16(i)); id != expected[0] || l != expected[1] {
+			t.Fatalf("unexpected used element %d: id %d, length %d", i, id, l)
+		}
+	}
+
+	if mem[0x1100] != 1 || mem[0x1000] != 0 {
+		t.Fatalf("unexpected status: %d, %d", mem[0x1100], mem[0x1000])
+	}
+}
+
+func TestBlkLegacyReset(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, make([]byte, 4*virtio.SectorSize), mem)
+
+	_ = v.IOOutHandler(virtio.BlkIOPortStart+18, []byte{0x7})
+	_ = v.IOOutHandler(virtio.BlkIOPortStart+8, []byte{0x8, 0x0, 0x0, 0x0})
+
+	putBlkReq(mem, legacyQueue(mem, 0x8, v.QueueNumMax()), 0, 1, virtio.SectorSize)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading ISR clears it.
+	isr := make([]byte, 1)
+	if _ = v.IOInHandler(virtio.BlkIOPortStart+19, isr); isr[0] != 0x1 {
+		t.Fatalf("unexpected ISR: 0x%x", isr[0])
+	}
+
+	if _ = v.IOInHandler(virtio.BlkIOPortStart+19, isr); isr[0] != 0 {
+		t.Fatalf("ISR is not cleared: 0x%x", isr[0])
+	}
+
+	// The driver resets the device by writing 0 to the status.
+	_ = v.IOOutHandler(virtio.BlkIOPortStart+18, []byte{0x0})
+
+	if v.VirtQueue[0] != nil || v.DriverStatus() != 0 {
+		t.Fatal("device is not reset")
+	}
+}
+
+func TestBlkQueueNumMax(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, make([]byte, virtio.SectorSize), mem)
+	d := virtio.NewMMIO(mmioBase, 10, v, &mockInjector{})
+
+	// The request queue is larger than the queues of Net.
+	if n := mmioRead(t, d, 0x034); n != 128 || v.QueueNumMax() != 128 {
+		t.Fatalf("unexpected max size of the queue: %d", n)
+	}
+
+	// A larger queue is not ready and the device needs reset.
+	mmioWrite(t, d, 0x038, 256)
+	mmioWrite(t, d, 0x080, 0x1000)
+	mmioWrite(t, d, 0x090, 0x2000)
+	mmioWrite(t, d, 0x0a0, 0x3000)
+	mmioWrite(t, d, 0x044, 1)
+
+	if mmioRead(t, d, 0x044) != 0 || mmioRead(t, d, 0x070)&0x40 == 0 {
+		t.Fatal("queue larger than the maximum is ready")
+	}
+}
+
+func TestBlkFlushAndGetID(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	v := newTestBlk(t, make([]byte, virtio.SectorSize), mem)
+	vq := mapQueue(t, v, mem, 0, 0x8000)
+
+	putBlkReq(mem, vq, 4, 0, 0)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x1000] != 0 {
+		t.Fatalf("unexpected status for flush: %d", mem[0x1000])
+	}
+
+	putBlkReq(mem, vq, 8, 0, 20)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x1000] != 0 || !bytes.HasPrefix(mem[0x200:0x214], []byte("gokvm-blk")) {
+		t.Fatalf("unexpected id: %s", mem[0x200:0x214])
+	}
+
+	putBlkReq(mem, vq, 0xff, 0, 0)
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x1000] != 2 {
+		t.Fatalf("unexpected status for unsupported request: %d", mem[0x1000])
+	}
+}
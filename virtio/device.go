@@ -0,0 +1,115 @@
+package virtio
+
+import (
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+// FeatureVersion1 (VIRTIO_F_VERSION_1) indicates compliance with the virtio
+// 1.0 specification, which is required by the modern transports such as
+// virtio-mmio version 2.
+const FeatureVersion1 = 1 << 32
+
+// ringFeatures are the features of the virt queues offered by every device,
+// which are handled by package queue.
+const ringFeatures = queue.FeatureIndirectDesc | queue.FeatureEventIdx
+
+// Bits of the device status written by the driver.
+const (
+	statusDriverOK   = 0x4
+	statusFeaturesOK = 0x8
+
+	// statusNeedsReset is set by the device when the driver has made an
+	// error it cannot recover from without resetting the device.
+	statusNeedsReset = 0x40
+)
+
+// Device IDs of virtio.
+const (
+	netDeviceID = 1
+	blkDeviceID = 2
+)
+
+// configOffset is the offset of the device specific configuration in the
+// header of the legacy interface.
+const configOffset = 20
+
+// Device is a virtio device independent of the transport, which is either
+// the legacy PCI interface built into each device or MMIO.
+type Device interface {
+	// ID returns the virtio device ID, e.g. 1 for a network card.
+	ID() uint32
+
+	// Features returns the device specific features offered to the driver.
+	Features() uint64
+
+	// SetDriverFeatures is called with the features accepted by the driver,
+	// and fails if the device cannot use them.
+	SetDriverFeatures(features uint64) error
+
+	NumQueues() int
+
+	// QueueNumMax returns the maximum number of entries of each virt queue,
+	// which is the size of the virt queues in the legacy interface.
+	QueueNumMax() uint16
+
+	// SetQueue maps the virt queue sel of size entries at the guest
+	// physical addresses of the descriptor table, the available ring and
+	// the used ring. The queue is released if desc is 0.
+	SetQueue(sel int, size uint16, desc, avail, used uint64) error
+
+	// Notify is called when the driver makes buffers available in the virt
+	// queue sel.
+	Notify(sel int)
+
+	// ReadConfig reads the device specific configuration at the offset.
+	ReadConfig(offset uint64, data []byte) error
+
+	// Reset releases the virt queues and forgets the negotiated features.
+	Reset()
+}
+
+// IRQInjector injects the interrupt of a device, which is given to each
+// device for its own interrupt line.
+type IRQInjector interface {
+	InjectIRQ()
+}
+
+// ConfigIRQInjector is an IRQInjector which tells the driver that the
+// interrupt is for a configuration change, which the transports implement.
+type ConfigIRQInjector interface {
+	InjectConfigIRQ()
+}
+
+// queueFromPFN returns the virt queue of size entries placed at the page frame
+// number written by the legacy driver with the features accepted by it, or nil
+// if it is out of the guest memory. The driver writes 0 to release the queue.
+func queueFromPFN(mem []byte, pfn uint32, size uint16, features uint64) *queue.Queue {
+	if pfn == 0 {
+		return nil
+	}
+
+	// In the legacy interface, the rings are contiguous from the page frame
+	// with the used ring aligned to the page (4096 bytes).
+	desc := uint64(pfn) * 4096
+	avail := desc + 16*uint64(size)
+	used := (avail + 6 + 2*uint64(size) + 4095) &^ 4095
+
+	vq, err := queue.New(mem, size, desc, avail, used, features)
+	if err != nil {
+		return nil
+	}
+
+	return vq
+}
+
+// readConfig copies the device specific configuration at the offset, where
+// the bytes out of the configuration are read as zero.
+func readConfig(config []byte, offset uint64, data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+
+	if offset < uint64(len(config)) {
+		copy(data, config[offset:])
+	}
+}
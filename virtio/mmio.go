@@ -0,0 +1,190 @@
+package virtio
+
+import (
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// MMIOSize is the size of the register space of a virtio-mmio device.
+const MMIOSize = 0x200
+
+// Registers of virtio-mmio version 2.
+//
+// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-1460002
+const (
+	mmioMagicValue        = 0x000
+	mmioVersion           = 0x004
+	mmioDeviceID          = 0x008
+	mmioVendorID          = 0x00c
+	mmioDeviceFeatures    = 0x010
+	mmioDeviceFeaturesSel = 0x014
+	mmioDriverFeatures    = 0x020
+	mmioDriverFeaturesSel = 0x024
+	mmioQueueSel          = 0x030
+	mmioQueueNumMax       = 0x034
+	mmioQueueNum          = 0x038
+	mmioQueueReady        = 0x044
+	mmioQueueNotify       = 0x050
+	mmioInterruptStatus   = 0x060
+	mmioInterruptACK      = 0x064
+	mmioStatus            = 0x070
+	mmioQueueDescLow      = 0x080
+	mmioQueueDescHigh     = 0x084
+	mmioQueueDriverLow    = 0x090
+	mmioQueueDriverHigh   = 0x094
+	mmioQueueDeviceLow    = 0x0a0
+	mmioQueueDeviceHigh   = 0x0a4
+	mmioConfigGeneration  = 0x0fc
+	mmioConfig            = 0x100
+
+	mmioMagic  = 0x74726976 // "virt"
+	mmioVendor = 0x1AF4
+)
+
+// MMIO is the virtio-mmio transport of a virtio device, which is used by the
+// guest kernels without PCI support. The device is not discoverable, so it
+// is given to the kernel by the command-line parameter from KernelParam.
+type MMIO struct {
+	transport
+
+	base uint64
+	irq  uint8
+}
+
+func NewMMIO(base uint64, irq uint8, dev Device, irqInjector IRQInjector) *MMIO {
+	return &MMIO{
+		transport: newTransport(dev, irqInjector),
+		base:      base,
+		irq:       irq,
+	}
+}
+
+// KernelParam returns the kernel command-line parameter to probe the device.
+func (d *MMIO) KernelParam() string {
+	return fmt.Sprintf("virtio_mmio.device=0x%x@0x%x:%d", MMIOSize, d.base, d.irq)
+}
+
+func (d *MMIO) GetMMIORange() (start, end uint64) {
+	return d.base, d.base + MMIOSize
+}
+
+// NotifyAddr returns the address and the size of the write by which the
+// driver notifies the virt queue sel. The value written is sel.
+func (d *MMIO) NotifyAddr(sel int) (uint64, uint32) {
+	return d.base + mmioQueueNotify, 4
+}
+
+func (d *MMIO) Read(addr uint64, data []byte) error {
+	offset := addr - d.base
+
+	if offset >= mmioConfig {
+		return d.dev.ReadConfig(offset-mmioConfig, data)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := uint32(0)
+
+	switch offset {
+	case mmioMagicValue:
+		v = mmioMagic
+	case mmioVersion:
+		v = 2
+	case mmioDeviceID:
+		v = d.dev.ID()
+	case mmioVendorID:
+		v = mmioVendor
+	case mmioDeviceFeatures:
+		v = d.deviceFeatures()
+	case mmioQueueNumMax:
+		if d.queue() != nil {
+			v = uint32(d.dev.QueueNumMax())
+		}
+	case mmioQueueReady:
+		if q := d.queue(); q != nil && q.Ready {
+			v = 1
+		}
+	case mmioInterruptStatus:
+		v = d.interruptStatus(false)
+	case mmioStatus:
+		v = d.s.Status
+	case mmioConfigGeneration:
+		// The configuration changed by the device, i.e. the link
+		// status of Net, is read by a single access.
+	default:
+	}
+
+	copy(data, pci.NumToBytes(v))
+
+	return nil
+}
+
+func (d *MMIO) Write(addr uint64, data []byte) error {
+	offset := addr - d.base
+	v := uint32(pci.BytesToNum(data))
+
+	switch offset {
+	case mmioQueueNotify:
+		d.notify(v)
+
+		return nil
+	case mmioInterruptACK:
+		d.ackInterrupt(v)
+
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	q := d.queue()
+
+	switch offset {
+	case mmioDeviceFeaturesSel:
+		d.s.DeviceFeaturesSel = v
+	case mmioDriverFeatures:
+		d.setDriverFeatures(v)
+	case mmioDriverFeaturesSel:
+		d.s.DriverFeaturesSel = v
+	case mmioQueueSel:
+		d.s.QueueSel = v
+	case mmioQueueReady:
+		d.setQueueReady(v == 1)
+	case mmioStatus:
+		d.setStatus(v)
+	case mmioQueueNum, mmioQueueDescLow, mmioQueueDescHigh, mmioQueueDriverLow,
+		mmioQueueDriverHigh, mmioQueueDeviceLow, mmioQueueDeviceHigh:
+		// The registers of a nonexistent queue are ignored.
+		if q != nil {
+			setQueueReg(q, offset, v)
+		}
+	default:
+		// The device specific configuration is read-only.
+	}
+
+	return nil
+}
+
+func setQueueReg(q *QueueConfig, offset uint64, v uint32) {
+	setLow := func(reg *uint64) { *reg = *reg&^0xffffffff | uint64(v) }
+	setHigh := func(reg *uint64) { *reg = *reg&0xffffffff | uint64(v)<<32 }
+
+	switch offset {
+	case mmioQueueNum:
+		q.Num = v
+	case mmioQueueDescLow:
+		setLow(&q.Desc)
+	case mmioQueueDescHigh:
+		setHigh(&q.Desc)
+	case mmioQueueDriverLow:
+		setLow(&q.Driver)
+	case mmioQueueDriverHigh:
+		setHigh(&q.Driver)
+	case mmioQueueDeviceLow:
+		setLow(&q.Device)
+	case mmioQueueDeviceHigh:
+		setHigh(&q.Device)
+	}
+}
@@ -0,0 +1,271 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/eventfd"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+const mmioBase = 0xd0000000
+
+// syncBuffer is the tap device written by the Tx thread.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Read(p)
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func mmioRead(t *testing.T, d *virtio.MMIO, offset uint64) uint32 {
+	t.Helper()
+
+	b := make([]byte, 4)
+	if err := d.Read(mmioBase+offset, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint32(b)
+}
+
+func mmioWrite(t *testing.T, d *virtio.MMIO, offset uint64, v uint32) {
+	t.Helper()
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+
+	if err := d.Write(mmioBase+offset, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupQueue places the virt queue sel at addr in the same way as Linux.
+func setupQueue(t *testing.T, d *virtio.MMIO, mem []byte, sel uint32, addr uint64) driverQueue {
+	t.Helper()
+
+	mmioWrite(t, d, 0x030, sel)
+
+	if ready := mmioRead(t, d, 0x044); ready != 0 {
+		t.Fatalf("queue %d is already ready", sel)
+	}
+
+	mmioWrite(t, d, 0x038, mmioRead(t, d, 0x034))
+	mmioWrite(t, d, 0x080, uint32(addr))
+	mmioWrite(t, d, 0x090, uint32(addr+16*virtio.QueueSize))
+	mmioWrite(t, d, 0x0a0, uint32(addr+0x1000))
+	mmioWrite(t, d, 0x044, 1)
+
+	return driverQueue{
+		mem: mem, size: virtio.QueueSize,
+		desc: addr, avail: addr + 16*virtio.QueueSize, used: addr + 0x1000,
+	}
+}
+
+func TestMMIOProbe(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), make([]byte, 0x10000))
+	d := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+
+	if p := d.KernelParam(); p != "virtio_mmio.device=0x200@0xd0000000:9" {
+		t.Fatalf("unexpected kernel parameter: %s", p)
+	}
+
+	if magic, version, id := mmioRead(t, d, 0x000), mmioRead(t, d, 0x004), mmioRead(t, d, 0x008); magic != 0x74726976 ||
+		version != 2 || id != 1 {
+		t.Fatalf("unexpected magic 0x%x, version %d or device id %d", magic, version, id)
+	}
+
+	mmioWrite(t, d, 0x014, 1)
+
+	if hi := mmioRead(t, d, 0x010); hi&1 == 0 {
+		t.Fatal("VERSION_1 is not offered")
+	}
+
+	// Features which are not offered are rejected.
+	mmioWrite(t, d, 0x024, 1)
+	mmioWrite(t, d, 0x020, 3)
+	mmioWrite(t, d, 0x070, 0xb)
+
+	if status := mmioRead(t, d, 0x070); status != 0x3 {
+		t.Fatalf("FEATURES_OK is set for the invalid features: 0x%x", status)
+	}
+
+	mmioWrite(t, d, 0x020, 1)
+	mmioWrite(t, d, 0x070, 0xb)
+
+	if status := mmioRead(t, d, 0x070); status != 0xb {
+		t.Fatalf("FEATURES_OK is not set: 0x%x", status)
+	}
+
+	// The descriptor table must be aligned to 16 bytes.
+	mmioWrite(t, d, 0x038, virtio.QueueSize)
+	mmioWrite(t, d, 0x080, 0x1008)
+
+	// The misaligned queue makes the device need reset instead of failing
+	// the VM.
+	mmioWrite(t, d, 0x044, 1)
+
+	if mmioRead(t, d, 0x044) != 0 || mmioRead(t, d, 0x070)&0x40 == 0 {
+		t.Fatal("the misaligned queue should not be ready")
+	}
+
+	// DEVICE_NEEDS_RESET is not cleared by the driver.
+	mmioWrite(t, d, 0x070, 0xf)
+
+	if status := mmioRead(t, d, 0x070); status != 0x4f {
+		t.Fatalf("unexpected status: 0x%x", status)
+	}
+
+	setupQueue(t, d, v.Mem, 0, 0x1000)
+
+	if v.VirtQueue[0] == nil {
+		t.Fatal("queue is not mapped")
+	}
+
+	// The driver resets the device by writing 0.
+	mmioWrite(t, d, 0x070, 0)
+
+	if v.VirtQueue[0] != nil || mmioRead(t, d, 0x044) != 0 || mmioRead(t, d, 0x070) != 0 {
+		t.Fatal("device is not reset")
+	}
+
+	if mmioRead(t, d, 0x034) != virtio.QueueSize {
+		t.Fatal("unexpected max size of the queue")
+	}
+
+	mmioWrite(t, d, 0x030, 2)
+
+	if mmioRead(t, d, 0x034) != 0 {
+		t.Fatal("nonexistent queue is available")
+	}
+
+	// The writes to the nonexistent queue are ignored.
+	mmioWrite(t, d, 0x038, virtio.QueueSize)
+	mmioWrite(t, d, 0x044, 1)
+
+	if mmioRead(t, d, 0x044) != 0 {
+		t.Fatal("nonexistent queue is ready")
+	}
+}
+
+func TestMMIONotify(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	tap := &syncBuffer{}
+	v := virtio.NewNet(9, &mockInjector{}, tap, mem)
+	d := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+	v.IRQInjector = d
+
+	go v.QueuePairThreadEntry(0)
+
+	mmioWrite(t, d, 0x024, 1)
+	mmioWrite(t, d, 0x020, 1)
+	mmioWrite(t, d, 0x070, 0xb)
+	vq := setupQueue(t, d, mem, 1, 0x2000)
+	mmioWrite(t, d, 0x070, 0xf)
+
+	// struct virtio_net_hdr has num_buffers with VERSION_1.
+	const K = 12
+
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	mmioWrite(t, d, 0x050, 1)
+
+	for deadline := time.Now().Add(time.Second); mmioRead(t, d, 0x060) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("interrupt status is not set")
+		}
+	}
+
+	if !bytes.Equal(tap.Bytes(), []byte{0xaa, 0xbb}) {
+		t.Fatalf("unexpected packet: %v", tap.Bytes())
+	}
+
+	mmioWrite(t, d, 0x064, 1)
+
+	if isr := mmioRead(t, d, 0x060); isr != 0 {
+		t.Fatalf("interrupt is not acknowledged: 0x%x", isr)
+	}
+
+	restored := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+	if err := restored.SetState(d.State()); err != nil {
+		t.Fatal(err)
+	}
+
+	if desc, _, _ := v.VirtQueue[1].Addrs(); restored.DriverStatus() != 0xf || desc != vq.desc {
+		t.Fatal("state is not restored")
+	}
+}
+
+func TestMMIONotifyFD(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	tap := &syncBuffer{}
+	v := virtio.NewNet(9, &mockInjector{}, tap, mem)
+	d := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+	v.IRQInjector = d
+
+	go v.QueuePairThreadEntry(0)
+
+	if addr, size := d.NotifyAddr(1); addr != mmioBase+0x050 || size != 4 {
+		t.Fatalf("unexpected notify address 0x%x or size %d", addr, size)
+	}
+
+	e, err := eventfd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.ServeNotifyFD(1, e)
+
+	mmioWrite(t, d, 0x070, 0xb)
+	vq := setupQueue(t, d, mem, 1, 0x2000)
+	mmioWrite(t, d, 0x070, 0xf)
+
+	const K = 10
+
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	// KVM signals the eventfd instead of the write to QueueNotify.
+	if err := e.Signal(); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); !bytes.Equal(tap.Bytes(), []byte{0xaa, 0xbb}); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected packet: %v", tap.Bytes())
+		}
+	}
+}
@@ -6,21 +6,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"os/signal"
-	"syscall"
-	"unsafe"
+	"net"
+	"sync"
 
 	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/tap"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
 )
 
 var (
-	ErrInvalidSel  = errors.New("queue sel is invalid")
-	ErrIONotPermit = errors.New("IO is not permitted for virtio device")
-	ErrNoTxPacket  = errors.New("no packet for tx")
-	ErrNoRxPacket  = errors.New("no packet for rx")
-	ErrVQNotInit   = errors.New("vq not initialized")
-	ErrNoRxBuf     = errors.New("no buffer found for rx")
+	ErrInvalidSel   = errors.New("queue sel is invalid")
+	ErrIONotPermit  = errors.New("IO is not permitted for virtio device")
+	ErrNoTxPacket   = errors.New("no packet for tx")
+	ErrNoRxPacket   = errors.New("no packet for rx")
+	ErrVQNotInit    = errors.New("vq not initialized")
+	ErrNoRxBuf      = errors.New("no buffer found for rx")
+	ErrInvalidQueue = errors.New("virt queue is invalid")
 )
 
 const (
@@ -33,33 +34,139 @@ const (
 	//
 	// refs https://github.com/torvalds/linux/blob/5859a2b/drivers/net/virtio_net.c#L1754
 	QueueSize = 32
+
+	// Indexes of the virt queues in each queue pair of Net. The queue pairs
+	// are followed by the control virt queue with MQ.
+	netRxQueue = 0
+	netTxQueue = 1
+
+	// Feature bits of virtio-net.
+	//
+	// refs https://github.com/torvalds/linux/blob/v5.14/include/uapi/linux/virtio_net.h
+	netFCSum      = 1 << 0
+	netFGuestCSum = 1 << 1
+	netFMAC       = 1 << 5
+	netFGuestTSO4 = 1 << 7
+	netFGuestTSO6 = 1 << 8
+	netFGuestUFO  = 1 << 10
+	netFHostTSO4  = 1 << 11
+	netFHostTSO6  = 1 << 12
+	netFHostUFO   = 1 << 14
+	netFMrgRxBuf  = 1 << 15
+	netFStatus    = 1 << 16
+	netFCtrlVQ    = 1 << 17
+	netFMQ        = 1 << 22
+
+	// netFeatures are the features offered by Net. MAC is offered once the
+	// address is given by SetMAC.
+	netFeatures = netFCSum | netFMrgRxBuf | netFStatus | ringFeatures
+
+	// netOffloadFeatures are offered in addition if the tap device does the
+	// offloads.
+	netOffloadFeatures = netFGuestCSum | netFGuestTSO4 | netFGuestTSO6 | netFGuestUFO |
+		netFHostTSO4 | netFHostTSO6 | netFHostUFO
+
+	// netMaxPacketSize is the size of the largest packet from the tap
+	// device, which is a GSO packet of 64KiB with the Ethernet header.
+	netMaxPacketSize = 0x10000 + 14
+
+	// netStatusLinkUp in the status of the configuration indicates that the
+	// link is up.
+	netStatusLinkUp = 1
+
+	// netHdrFNeedsCSum in the flags of struct virtio_net_hdr indicates that
+	// the checksum of the packet is partial.
+	netHdrFNeedsCSum = 1
+
+	// Class and command of the control virt queue to set the number of the
+	// queue pairs, and the acks of the commands.
+	netCtrlMQ           = 4
+	netCtrlMQVQPairsSet = 0
+	netCtrlOK           = 0
+	netCtrlErr          = 1
 )
 
-type IRQInjector interface {
-	InjectVirtioNetIRQ()
+// notifyTap is a tap device which tells the arrival of packets. It is
+// implemented by tap.Tap.
+type notifyTap interface {
+	Notify(c chan<- interface{})
+}
+
+// offloadTap is a tap device which carries struct virtio_net_hdr with each
+// packet, so that the offloads negotiated with the driver are done by the
+// host kernel. It is implemented by tap.Tap.
+type offloadTap interface {
+	io.ReadWriter
+	SetVnetHdrSize(size int) error
+	SetOffload(offloads uint) error
+}
+
+// multiQueueTap is a queue of a multi-queue tap device, which is detached
+// while the queue pair is not used by the driver. It is implemented by
+// tap.Tap.
+type multiQueueTap interface {
+	SetQueueEnabled(enabled bool) error
 }
 
 type Hdr struct {
 	commonHeader commonHeader
-	_            netHeader
+	netHeader    netHeader
 }
 
 type Net struct {
 	Hdr Hdr
 
-	VirtQueue    [2]*VirtQueue
-	Mem          []byte
-	LastAvailIdx [2]uint16
+	// IOBase is the start of the IO port range of the legacy interface,
+	// which is IOPortStart unless another NIC uses it.
+	IOBase uint64
 
-	tap io.ReadWriter
+	// VirtQueue has the rx and tx virt queues of each queue pair in order,
+	// followed by the control virt queue with more than one queue pair.
+	VirtQueue []*queue.Queue
+	Mem       []byte
+	queuePFN  []uint32
 
-	txKick chan interface{}
-	rxKick chan os.Signal
+	driverFeatures uint64
+
+	// mu protects the configuration of the device. The locks of all the
+	// queue pairs are held as well when the configuration used by them is
+	// changed, so that each queue pair is processed only with its own lock.
+	mu sync.Mutex
+
+	// isrMu protects the ISR in Hdr, which is set by the queue pairs.
+	isrMu sync.Mutex
+
+	pairs []*netQueuePair
+
+	// queuePairs is the number of the queue pairs used by the driver.
+	queuePairs uint16
+
+	// offload is true if the tap device does the offloads.
+	offload bool
 
 	irq         uint8
 	IRQInjector IRQInjector
 }
 
+// netQueuePair is a pair of the rx and tx virt queues, which is backed by a
+// queue of the tap device and processed by its own worker.
+type netQueuePair struct {
+	// mu is held while the virt queues of the pair are processed.
+	mu sync.Mutex
+
+	tap    io.ReadWriter
+	txKick chan interface{}
+	rxKick chan interface{}
+
+	// pending is the packet read from the tap device, which is kept until
+	// the driver adds enough buffers to the rx queue.
+	pending []byte
+
+	// rxDropped is the number of the packets dropped since they do not fit
+	// in a descriptor chain without MRG_RXBUF.
+	rxDropped uint64
+}
+
 func (h Hdr) Bytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -71,23 +178,23 @@ func (h Hdr) Bytes() ([]byte, error) {
 }
 
 type commonHeader struct {
-	_        uint32 // hostFeatures
-	_        uint32 // guestFeatures
-	_        uint32 // queuePFN
-	queueNUM uint16
-	queueSEL uint16
-	_        uint16 // queueNotify
-	_        uint8  // status
-	isr      uint8
+	hostFeatures  uint32
+	guestFeatures uint32
+	_             uint32 // queuePFN
+	queueNUM      uint16
+	queueSEL      uint16
+	_             uint16 // queueNotify
+	status        uint8
+	isr           uint8
 }
 
 type netHeader struct {
-	_ [6]uint8 // mac
-	_ uint16   // netStatus
-	_ uint16   // maxVirtQueuePairs
+	mac               [6]uint8
+	netStatus         uint16
+	maxVirtQueuePairs uint16
 }
 
-func (v Net) GetDeviceHeader() pci.DeviceHeader {
+func (v *Net) GetDeviceHeader() pci.DeviceHeader {
 	return pci.DeviceHeader{
 		DeviceID:    0x1000,
 		VendorID:    0x1AF4,
@@ -95,7 +202,7 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 		SubsystemID: 1, // Network Card
 		Command:     1, // Enable IO port
 		BAR: [6]uint32{
-			IOPortStart | 0x1,
+			uint32(v.IOBase) | 0x1,
 		},
 		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
 		InterruptPin: 1,
@@ -104,8 +211,14 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 	}
 }
 
-func (v Net) IOInHandler(port uint64, bytes []byte) error {
-	offset := int(port - IOPortStart)
+func (v *Net) IOInHandler(port uint64, bytes []byte) error {
+	offset := int(port - v.IOBase)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.isrMu.Lock()
+	defer v.isrMu.Unlock()
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
@@ -113,228 +226,813 @@ func (v Net) IOInHandler(port uint64, bytes []byte) error {
 	}
 
 	l := len(bytes)
+	if offset+l > len(b) {
+		return nil
+	}
+
 	copy(bytes[:l], b[offset:offset+l])
 
+	// Reading ISR clears it.
+	if offset <= 19 && 19 < offset+l {
+		v.Hdr.commonHeader.isr = 0
+	}
+
 	return nil
 }
 
-func (v *Net) RxThreadEntry() {
-	for range v.rxKick {
-		for v.Rx() == nil {
+// QueuePairThreadEntry processes the virt queues of the queue pair, the tx
+// queue when the driver notifies it and the rx queue when a packet arrives
+// at the tap device or the driver adds buffers.
+func (v *Net) QueuePairThreadEntry(pair int) {
+	p := v.pairs[pair]
+
+	for {
+		select {
+		case <-p.txKick:
+			for v.Tx(pair) == nil {
+			}
+		case <-p.rxKick:
+			for v.Rx(pair) == nil {
+			}
 		}
 	}
 }
 
-func (v *Net) Rx() error {
-	// read raw packet from tap device
-	packet := make([]byte, 4096)
+// Rx receives a packet from the tap device into the rx queue of the queue
+// pair. The tap device is not read while the rx queue is empty, and the
+// packet which does not fit in the buffers available with MRG_RXBUF is kept
+// until the driver adds more. Without MRG_RXBUF, the packet is dropped and
+// counted if it does not fit in the descriptor chain.
+func (v *Net) Rx(pair int) error {
+	p := v.pairs[pair]
 
-	n, err := v.tap.Read(packet)
-	if err != nil {
-		return ErrNoRxPacket
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vq := v.VirtQueue[2*pair+netRxQueue]
+
+	if vq == nil {
+		return ErrVQNotInit
 	}
 
-	packet = packet[:n]
+	if !vq.Available() {
+		return ErrNoRxBuf
+	}
+
+	packet := p.pending
+	p.pending = nil
 
-	// append struct virtio_net_hdr
-	packet = append(make([]byte, 10), packet...)
+	if packet == nil {
+		var err error
+		if packet, err = v.readPacket(p); err != nil {
+			return err
+		}
+	}
 
-	sel := 0
+	if v.driverFeatures&netFMrgRxBuf != 0 {
+		err := v.rxMergeable(vq, packet)
+		if errors.Is(err, ErrNoRxBuf) {
+			p.pending = packet
+		}
 
-	if v.VirtQueue[sel] == nil {
-		return ErrVQNotInit
+		return err
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	// Without MRG_RXBUF, the packet is written into a single descriptor
+	// chain, which the driver makes large enough for the GSO packets by
+	// chaining pages. The packet is dropped if it does not fit, since the
+	// driver never makes the chain larger, and the chain is left for the
+	// next packet.
+	c, err := vq.Pop()
+	if err == nil && c.WritableLen() < len(packet) {
+		vq.Rewind(1)
+		p.rxDropped++
+
+		return nil
+	}
 
-	if v.LastAvailIdx[sel] == availRing.Idx {
-		return ErrNoRxBuf
+	// An invalid chain is returned to the driver with nothing written.
+	written := uint32(0)
+	if err == nil {
+		written = c.Write(packet)
 	}
 
-	const NONE = uint16(256)
-	headDescID := NONE
-	prevDescID := NONE
+	vq.Push(c.Head, written)
+	v.publish(vq)
 
-	for len(packet) > 0 {
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	return err
+}
 
-		// head of vring chain
-		if headDescID == NONE {
-			headDescID = descID
+// RxDropped returns the number of the packets dropped since they do not fit
+// in the rx buffers of the driver.
+func (v *Net) RxDropped() uint64 {
+	n := uint64(0)
 
-			// This structure is holding both the index of the descriptor chain and the
-			// number of bytes that were written to the memory as part of serving the request.
-			usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
-			usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
-		}
+	for _, p := range v.pairs {
+		p.mu.Lock()
+		n += p.rxDropped
+		p.mu.Unlock()
+	}
+
+	return n
+}
+
+// readPacket reads a packet from the tap device of the queue pair after
+// struct virtio_net_hdr, which is read together if the tap device does the
+// offloads.
+func (v *Net) readPacket(p *netQueuePair) ([]byte, error) {
+	hdrLen := v.hdrLen()
+	packet := make([]byte, hdrLen+netMaxPacketSize)
 
-		desc := &v.VirtQueue[sel].DescTable[descID]
-		l := uint32(len(packet))
+	start := hdrLen
+	if v.offload {
+		start = 0
+	}
+
+	n, err := p.tap.Read(packet[start:])
+	if err != nil {
+		return nil, ErrNoRxPacket
+	}
+
+	packet = packet[:start+n]
+
+	if hdrLen > 10 {
+		binary.LittleEndian.PutUint16(packet[10:], 1) // num_buffers
+	}
+
+	return packet, nil
+}
 
-		if l > desc.Len {
-			l = desc.Len
+// rxMergeable writes the packet into as many buffers of the rx queue as
+// needed with MRG_RXBUF, where each buffer is returned in its own used
+// element and num_buffers in the header tells their number. It returns
+// ErrNoRxBuf without consuming any buffer if the packet does not fit. The
+// caller must hold the lock of the queue pair.
+func (v *Net) rxMergeable(vq *queue.Queue, packet []byte) error {
+	// Make sure that the whole packet fits in the available buffers before
+	// consuming any of them.
+	chains := []queue.Chain{}
+
+	for size := 0; size < len(packet); {
+		c, err := vq.Pop()
+		if errors.Is(err, queue.ErrEmpty) {
+			vq.Rewind(uint16(len(chains)))
+
+			return ErrNoRxBuf
 		}
 
-		copy(v.Mem[desc.Addr:desc.Addr+uint64(l)], packet[:l])
-		packet = packet[l:]
-		desc.Len = l
+		if err != nil {
+			for _, c := range append(chains, c) {
+				vq.Push(c.Head, 0)
+			}
 
-		usedRing.Ring[usedRing.Idx%QueueSize].Len += l
+			v.publish(vq)
 
-		if prevDescID != NONE {
-			v.VirtQueue[sel].DescTable[prevDescID].Flags |= 0x1
-			v.VirtQueue[sel].DescTable[prevDescID].Next = descID
+			return err
 		}
 
-		prevDescID = descID
-		v.LastAvailIdx[sel]++
+		chains = append(chains, c)
+		size += c.WritableLen()
 	}
 
-	usedRing.Idx++
+	binary.LittleEndian.PutUint16(packet[10:], uint16(len(chains))) // num_buffers
+
+	for _, c := range chains {
+		l := c.Write(packet)
+		packet = packet[l:]
+
+		vq.Push(c.Head, l)
+	}
 
-	v.Hdr.commonHeader.isr = 0x1
-	v.IRQInjector.InjectVirtioNetIRQ()
+	// The used elements are published at once after they are written.
+	v.publish(vq)
 
 	return nil
 }
 
-func (v *Net) TxThreadEntry() {
-	for range v.txKick {
-		for v.Tx() == nil {
+// Tx sends the packets in the tx queue of the queue pair to the tap device.
+func (v *Net) Tx(pair int) error {
+	p := v.pairs[pair]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vq := v.VirtQueue[2*pair+netTxQueue]
+
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	// The driver need not notify the device while the packets are sent.
+	vq.DisableNotification()
+
+	sent := 0
+
+	for {
+		c, err := vq.Pop()
+		if errors.Is(err, queue.ErrEmpty) {
+			break
 		}
+
+		if err == nil {
+			err = v.send(p, c.Readable())
+		}
+
+		// The packet is returned to the driver even if it is not sent,
+		// since it would not be sent by retrying either.
+		vq.Push(c.Head, 0)
+		sent++
+
+		if err != nil {
+			v.publish(vq)
+			vq.EnableNotification()
+
+			return err
+		}
+	}
+
+	if sent > 0 {
+		v.publish(vq)
 	}
+
+	if vq.EnableNotification() || sent > 0 {
+		return nil
+	}
+
+	return ErrNoTxPacket
 }
 
-func (v *Net) Tx() error {
-	sel := v.Hdr.commonHeader.queueSEL
-	if sel == 0 {
-		return ErrInvalidSel
+// send writes the packet from the driver to the tap device of the queue pair.
+func (v *Net) send(p *netQueuePair, buf []byte) error {
+	if len(buf) < v.hdrLen() {
+		return fmt.Errorf("%w: %d bytes", ErrNoTxPacket, len(buf))
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	// Skip struct virtio_net_hdr unless the tap device does the offloads
+	// described in it.
+	// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
+	if !v.offload {
+		hdr := buf[:v.hdrLen()]
+		buf = buf[v.hdrLen():]
 
-	if v.LastAvailIdx[sel] == availRing.Idx {
-		return ErrNoTxPacket
+		// With CSUM, the driver leaves the checksum to the device.
+		if hdr[0]&netHdrFNeedsCSum != 0 {
+			completeChecksum(buf, binary.LittleEndian.Uint16(hdr[6:]), binary.LittleEndian.Uint16(hdr[8:]))
+		}
 	}
 
-	for v.LastAvailIdx[sel] != availRing.Idx {
-		buf := []byte{}
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	_, err := p.tap.Write(buf)
 
-		// This structure is holding both the index of the descriptor chain and the
-		// number of bytes that were written to the memory as part of serving the request.
-		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
-		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+	return err
+}
 
-		for {
-			desc := v.VirtQueue[sel].DescTable[descID]
+// ctrl serves the commands in the control virt queue. Only the command to
+// set the number of the queue pairs is supported, and the others fail.
+func (v *Net) ctrl() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
 
-			b := make([]byte, desc.Len)
-			copy(b, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
-			buf = append(buf, b...)
+	vq := v.VirtQueue[2*len(v.pairs)]
 
-			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
+	if vq == nil || !vq.Available() {
+		return
+	}
 
-			if desc.Flags&0x1 != 0 {
-				descID = desc.Next
-			} else {
-				break
-			}
+	for {
+		c, err := vq.Pop()
+		if errors.Is(err, queue.ErrEmpty) {
+			break
+		}
+
+		// The command is read from the device-readable buffers, and the
+		// ack is written to the device-writable one at the end.
+		written := uint32(0)
+		if err == nil && c.WritableLen() > 0 {
+			written = c.Write([]byte{v.ctrlCommand(c.Readable())})
 		}
 
-		// Skip struct virtio_net_hdr
-		// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
-		buf = buf[10:]
+		vq.Push(c.Head, written)
+	}
 
-		if _, err := v.tap.Write(buf); err != nil {
-			return err
+	v.publish(vq)
+}
+
+// ctrlCommand executes the command of the control virt queue, which is
+// struct virtio_net_ctrl_hdr followed by the data, and returns the ack. The
+// caller must hold mu.
+func (v *Net) ctrlCommand(cmd []byte) uint8 {
+	if len(cmd) < 4 || cmd[0] != netCtrlMQ || cmd[1] != netCtrlMQVQPairsSet {
+		return netCtrlErr
+	}
+
+	n := binary.LittleEndian.Uint16(cmd[2:])
+	if n < 1 || int(n) > len(v.pairs) {
+		return netCtrlErr
+	}
+
+	if err := v.setQueuePairs(n); err != nil {
+		return netCtrlErr
+	}
+
+	return netCtrlOK
+}
+
+// setQueuePairs sets the number of the queue pairs used by the driver, and
+// detaches the queues of the tap device for the others so that the packets
+// are not delivered to them. The number is not changed if the tap device
+// fails, while some queues may have been changed. The caller must hold mu.
+func (v *Net) setQueuePairs(n uint16) error {
+	for i, p := range v.pairs {
+		enabled := i < int(n)
+
+		t, ok := p.tap.(multiQueueTap)
+		if !ok || enabled == (i < int(v.queuePairs)) {
+			continue
+		}
+
+		if err := t.SetQueueEnabled(enabled); err != nil {
+			return fmt.Errorf("queue %d of the tap device: %w", i, err)
 		}
-		usedRing.Idx++
-		v.LastAvailIdx[sel]++
 	}
 
-	v.Hdr.commonHeader.isr = 0x1
-	v.IRQInjector.InjectVirtioNetIRQ()
+	v.queuePairs = n
 
 	return nil
 }
 
+// publish publishes the used ring of the virt queue, and interrupts the
+// driver unless it is suppressed.
+func (v *Net) publish(vq *queue.Queue) {
+	vq.Publish()
+
+	if !vq.NeedsInterrupt() {
+		return
+	}
+
+	v.isrMu.Lock()
+	v.Hdr.commonHeader.isr |= interruptVring
+	v.isrMu.Unlock()
+
+	v.IRQInjector.InjectIRQ()
+}
+
 func (v *Net) IOOutHandler(port uint64, bytes []byte) error {
-	offset := int(port - IOPortStart)
+	offset := int(port - v.IOBase)
 
 	switch offset {
+	case 4:
+		// The features not offered are ignored.
+		features := uint32(pci.BytesToNum(bytes)) & v.Hdr.commonHeader.hostFeatures
+
+		v.lock()
+		v.Hdr.commonHeader.guestFeatures = features
+
+		// The legacy interface has no way to reject the features, and the
+		// failure is only recorded in the status.
+		if err := v.setDriverFeatures(uint64(features)); err != nil {
+			v.Hdr.commonHeader.status |= statusNeedsReset
+		}
+
+		v.unlock()
 	case 8:
-		// Queue PFN is aligned to page (4096 bytes)
-		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		v.lock()
+		defer v.unlock()
+
+		sel := v.Hdr.commonHeader.queueSEL
+		if int(sel) >= len(v.VirtQueue) {
+			return ErrInvalidSel
+		}
+
+		v.queuePFN[sel] = uint32(pci.BytesToNum(bytes))
+		v.VirtQueue[sel] = queueFromPFN(v.Mem, v.queuePFN[sel], v.QueueNumMax(), v.driverFeatures)
 	case 14:
+		v.mu.Lock()
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+		v.mu.Unlock()
 	case 16:
-		v.Hdr.commonHeader.isr = 0x0
-		v.txKick <- true
-	case 19:
-		fmt.Printf("ISR was written!\r\n")
+		v.Notify(int(pci.BytesToNum(bytes)))
+	case 18:
+		// The driver resets the device by writing 0, e.g. when it is
+		// unloaded.
+		if bytes[0] == 0 {
+			v.Reset()
+
+			return nil
+		}
+
+		v.mu.Lock()
+		v.Hdr.commonHeader.status = bytes[0] | v.Hdr.commonHeader.status&statusNeedsReset
+		v.mu.Unlock()
 	default:
 	}
 
 	return nil
 }
 
-func (v Net) GetIORange() (start, end uint64) {
-	return IOPortStart, IOPortStart + IOPortSize
+func (v *Net) GetIORange() (start, end uint64) {
+	return v.IOBase, v.IOBase + IOPortSize
+}
+
+// hdrLen returns the size of struct virtio_net_hdr, which has num_buffers at
+// the end with MRG_RXBUF or in the virtio 1.0 interface.
+func (v *Net) hdrLen() int {
+	if v.driverFeatures&(FeatureVersion1|netFMrgRxBuf) != 0 {
+		return 12
+	}
+
+	return 10
+}
+
+func (v *Net) ID() uint32 {
+	return netDeviceID
+}
+
+func (v *Net) Features() uint64 {
+	return uint64(v.Hdr.commonHeader.hostFeatures)
+}
+
+func (v *Net) SetDriverFeatures(features uint64) error {
+	v.lock()
+	defer v.unlock()
+
+	return v.setDriverFeatures(features)
+}
+
+// setDriverFeatures sets the features, and the size of struct virtio_net_hdr
+// and the offloads of the tap device accordingly. The caller must hold the
+// locks by lock.
+func (v *Net) setDriverFeatures(features uint64) error {
+	v.driverFeatures = features
+
+	if !v.offload {
+		return nil
+	}
+
+	// The segmentation offloads of the packets to the driver are allowed
+	// only with the checksum offload.
+	offloads := uint(0)
+
+	if features&netFGuestCSum != 0 {
+		offloads |= tap.OffloadCSum
+
+		for f, o := range map[uint64]uint{
+			netFGuestTSO4: tap.OffloadTSO4,
+			netFGuestTSO6: tap.OffloadTSO6,
+			netFGuestUFO:  tap.OffloadUFO,
+		} {
+			if features&f != 0 {
+				offloads |= o
+			}
+		}
+	}
+
+	for _, p := range v.pairs {
+		t, _ := p.tap.(offloadTap)
+
+		if err := t.SetVnetHdrSize(v.hdrLen()); err != nil {
+			return fmt.Errorf("size of the vnet header: %w", err)
+		}
+
+		if err := t.SetOffload(offloads); err != nil {
+			return fmt.Errorf("offloads 0x%x: %w", offloads, err)
+		}
+	}
+
+	return nil
+}
+
+func (v *Net) NumQueues() int {
+	return len(v.VirtQueue)
+}
+
+// QueueNumMax returns the size of the virt queues in the legacy header.
+func (v *Net) QueueNumMax() uint16 {
+	return v.Hdr.commonHeader.queueNUM
+}
+
+func (v *Net) SetQueue(sel int, size uint16, desc, avail, used uint64) error {
+	if sel < 0 || sel >= len(v.VirtQueue) {
+		return fmt.Errorf("%w: %d", ErrInvalidSel, sel)
+	}
+
+	v.lock()
+	defer v.unlock()
+
+	vq := (*queue.Queue)(nil)
+
+	if desc != 0 {
+		var err error
+		if vq, err = queue.New(v.Mem, size, desc, avail, used, v.driverFeatures); err != nil {
+			return err
+		}
+	}
+
+	v.VirtQueue[sel] = vq
+
+	return nil
+}
+
+// Notify kicks the worker of the queue pair, or serves the commands in the
+// control virt queue.
+func (v *Net) Notify(sel int) {
+	if sel < 0 || sel >= len(v.VirtQueue) {
+		return
+	}
+
+	if sel == 2*len(v.pairs) {
+		v.ctrl()
+
+		return
+	}
+
+	// The kick is dropped if the worker has another pending, since it
+	// processes all the buffers available.
+	p := v.pairs[sel/2]
+
+	if sel%2 == netTxQueue {
+		select {
+		case p.txKick <- true:
+		default:
+		}
+	} else {
+		select {
+		case p.rxKick <- true:
+		default:
+		}
+	}
+}
+
+func (v *Net) ReadConfig(offset uint64, data []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.isrMu.Lock()
+	defer v.isrMu.Unlock()
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	readConfig(b[configOffset:], offset, data)
+
+	return nil
+}
+
+func (v *Net) Reset() {
+	v.lock()
+	defer v.unlock()
+
+	for i := range v.VirtQueue {
+		v.VirtQueue[i] = nil
+		v.queuePFN[i] = 0
+	}
+
+	// The packets kept for the old rx queues are dropped.
+	for _, p := range v.pairs {
+		p.pending = nil
+	}
+
+	// The failures of the tap device are told to the driver when it sets
+	// the features and the queue pairs again.
+	_ = v.setDriverFeatures(0)
+	_ = v.setQueuePairs(1)
+	v.Hdr.commonHeader.guestFeatures = 0
+	v.Hdr.commonHeader.queueSEL = 0
+	v.Hdr.commonHeader.status = 0
+
+	v.isrMu.Lock()
+	v.Hdr.commonHeader.isr = 0
+	v.isrMu.Unlock()
+}
+
+// SetMAC sets the MAC address given to the driver, which is random if this
+// is not called before the driver starts.
+func (v *Net) SetMAC(mac net.HardwareAddr) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	copy(v.Hdr.netHeader.mac[:], mac)
+	v.Hdr.commonHeader.hostFeatures |= netFMAC
+}
+
+// SetLinkUp changes the link status, and notifies the driver of it by the
+// interrupt of a configuration change.
+func (v *Net) SetLinkUp(up bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if up {
+		v.Hdr.netHeader.netStatus |= netStatusLinkUp
+	} else {
+		v.Hdr.netHeader.netStatus &^= netStatusLinkUp
+	}
+
+	v.isrMu.Lock()
+	v.Hdr.commonHeader.isr |= interruptConfig
+	v.isrMu.Unlock()
+
+	if ci, ok := v.IRQInjector.(ConfigIRQInjector); ok {
+		ci.InjectConfigIRQ()
+	} else {
+		v.IRQInjector.InjectIRQ()
+	}
+}
+
+// LinkUp returns whether the link is up.
+func (v *Net) LinkUp() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.netHeader.netStatus&netStatusLinkUp != 0
 }
 
 func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *Net {
+	return NewMultiQueueNet(irq, irqInjector, []io.ReadWriter{tap}, mem)
+}
+
+// NewMultiQueueNet returns Net with a queue pair for each queue of the tap
+// device. MQ is offered with more than one queue pair, and the driver uses
+// only the first one until it sets the number by the control virt queue.
+func NewMultiQueueNet(irq uint8, irqInjector IRQInjector, taps []io.ReadWriter, mem []byte) *Net {
+	nQueues := 2 * len(taps)
+	if len(taps) > 1 {
+		nQueues++
+	}
+
 	res := &Net{
 		Hdr: Hdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: netFeatures,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			netHeader: netHeader{
+				netStatus: netStatusLinkUp,
 			},
 		},
-		irq:          irq,
-		IRQInjector:  irqInjector,
-		txKick:       make(chan interface{}),
-		rxKick:       make(chan os.Signal),
-		tap:          tap,
-		Mem:          mem,
-		VirtQueue:    [2]*VirtQueue{},
-		LastAvailIdx: [2]uint16{0, 0},
+		IOBase:      IOPortStart,
+		irq:         irq,
+		IRQInjector: irqInjector,
+		Mem:         mem,
+		VirtQueue:   make([]*queue.Queue, nQueues),
+		queuePFN:    make([]uint32, nQueues),
+		queuePairs:  uint16(len(taps)),
 	}
 
-	signal.Notify(res.rxKick, syscall.SIGIO)
+	for _, t := range taps {
+		p := &netQueuePair{
+			tap:    t,
+			txKick: make(chan interface{}, 1),
+			rxKick: make(chan interface{}, 1),
+		}
+
+		if n, ok := t.(notifyTap); ok {
+			n.Notify(p.rxKick)
+		}
+
+		res.pairs = append(res.pairs, p)
+	}
+
+	if len(taps) > 1 {
+		res.Hdr.commonHeader.hostFeatures |= netFCtrlVQ | netFMQ
+		res.Hdr.netHeader.maxVirtQueuePairs = uint16(len(taps))
+	}
+
+	if _, ok := taps[0].(offloadTap); ok {
+		res.offload = true
+		res.Hdr.commonHeader.hostFeatures |= netOffloadFeatures
+		_ = res.setDriverFeatures(0)
+	}
+
+	_ = res.setQueuePairs(1)
 
 	return res
 }
 
-// refs: https://wiki.osdev.org/Virtio#Virtual_Queue_Descriptor
-type VirtQueue struct {
-	DescTable [QueueSize]struct {
-		Addr  uint64
-		Len   uint32
-		Flags uint16
-		Next  uint16
+// NetState is the state of Net which is saved in a snapshot of the VM.
+type NetState struct {
+	QueuePFN      []uint32
+	QueueSel      uint16
+	ISR           uint8
+	Status        uint8
+	GuestFeatures uint32
+	NetStatus     uint16
+
+	// QueuePairs is the number of the queue pairs used by the driver, which
+	// is 0 in the snapshots taken before MQ is supported.
+	QueuePairs uint16
+}
+
+// Lock stops processing the virt queues until Unlock is called, so that
+// the device state and the guest memory can be saved consistently.
+func (v *Net) Lock() {
+	v.lock()
+}
+
+func (v *Net) Unlock() {
+	v.unlock()
+}
+
+// lock locks the configuration and all the queue pairs.
+func (v *Net) lock() {
+	v.mu.Lock()
+
+	for _, p := range v.pairs {
+		p.mu.Lock()
+	}
+}
+
+func (v *Net) unlock() {
+	for _, p := range v.pairs {
+		p.mu.Unlock()
+	}
+
+	v.mu.Unlock()
+}
+
+// State returns the device state. The caller should hold the lock by Lock.
+func (v *Net) State() NetState {
+	return NetState{
+		QueuePFN:      append([]uint32{}, v.queuePFN...),
+		QueueSel:      v.Hdr.commonHeader.queueSEL,
+		ISR:           v.Hdr.commonHeader.isr,
+		Status:        v.Hdr.commonHeader.status,
+		GuestFeatures: v.Hdr.commonHeader.guestFeatures,
+		NetStatus:     v.Hdr.netHeader.netStatus,
+		QueuePairs:    v.queuePairs,
+	}
+}
+
+// SetState restores the device state. The guest memory must be restored
+// before calling this, since the virt queues are placed in it. The state
+// must have the same number of the virt queues.
+func (v *Net) SetState(s NetState) error {
+	v.lock()
+	defer v.unlock()
+
+	v.Hdr.commonHeader.guestFeatures = s.GuestFeatures
+	if err := v.setDriverFeatures(uint64(s.GuestFeatures)); err != nil {
+		return err
+	}
+
+	copy(v.queuePFN, s.QueuePFN)
+
+	for i := range v.VirtQueue {
+		v.VirtQueue[i] = queueFromPFN(v.Mem, v.queuePFN[i], v.QueueNumMax(), v.driverFeatures)
 	}
 
-	AvailRing struct {
-		Flags     uint16
-		Idx       uint16
-		Ring      [QueueSize]uint16
-		UsedEvent uint16
+	v.Hdr.commonHeader.queueSEL = s.QueueSel
+	v.Hdr.commonHeader.status = s.Status
+	v.Hdr.netHeader.netStatus = s.NetStatus
+
+	if s.QueuePairs == 0 {
+		s.QueuePairs = 1
+	}
+
+	if err := v.setQueuePairs(s.QueuePairs); err != nil {
+		return err
+	}
+
+	v.isrMu.Lock()
+	v.Hdr.commonHeader.isr = s.ISR
+	v.isrMu.Unlock()
+
+	return nil
+}
+
+// DriverStatus returns the device status written by the driver, which has
+// DRIVER_OK (0x4) set once the device is ready.
+func (v *Net) DriverStatus() uint8 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.commonHeader.status
+}
+
+// completeChecksum stores the internet checksum of the packet from start at
+// start+offset, where the driver has put the checksum of the pseudo header.
+//
+// refs https://datatracker.ietf.org/doc/html/rfc1071
+func completeChecksum(packet []byte, start, offset uint16) {
+	pos := int(start) + int(offset)
+	if pos+2 > len(packet) {
+		return
 	}
 
-	// padding for 4096 byte alignment
-	_ [4096 - ((16*QueueSize + 6 + 2*QueueSize) % 4096)]uint8
+	sum := uint32(0)
 
-	UsedRing struct {
-		Flags uint16
-		Idx   uint16
-		Ring  [QueueSize]struct {
-			Idx uint32
-			Len uint32
+	for i := int(start); i < len(packet); i += 2 {
+		if i+1 < len(packet) {
+			sum += uint32(packet[i])<<8 | uint32(packet[i+1])
+		} else {
+			sum += uint32(packet[i]) << 8
 		}
-		availEvent uint16
 	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	binary.BigEndian.PutUint16(packet[pos:], ^uint16(sum))
 }
@@ -2,20 +2,101 @@ package virtio_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
 	"testing"
-	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/tap"
 	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
 )
 
 type mockInjector struct {
 	called bool
 }
 
-func (m *mockInjector) InjectVirtioNetIRQ() {
+func (m *mockInjector) InjectIRQ() {
 	m.called = true
 }
 
+// driverQueue is the driver side of a virt queue of size entries in the
+// guest memory.
+type driverQueue struct {
+	mem               []byte
+	size              uint16
+	desc, avail, used uint64
+}
+
+// mapQueue maps the virt queue sel of the device at addr in the legacy layout.
+func mapQueue(t *testing.T, dev virtio.Device, mem []byte, sel int, addr uint64) driverQueue {
+	t.Helper()
+
+	q := driverQueue{
+		mem: mem, size: virtio.QueueSize,
+		desc: addr, avail: addr + 16*virtio.QueueSize, used: addr + 0x1000,
+	}
+
+	if err := dev.SetQueue(sel, virtio.QueueSize, q.desc, q.avail, q.used); err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+// legacyQueue returns the virt queue of size entries placed at the page frame
+// number by the legacy driver.
+func legacyQueue(mem []byte, pfn uint64, size uint16) driverQueue {
+	desc := pfn * 4096
+	avail := desc + 16*uint64(size)
+
+	return driverQueue{mem: mem, size: size, desc: desc, avail: avail, used: (avail + 6 + 2*uint64(size) + 4095) &^ 4095}
+}
+
+func (q driverQueue) setDesc(id uint16, d queue.Desc) {
+	b := q.mem[q.desc+16*uint64(id):]
+	binary.LittleEndian.PutUint64(b, d.Addr)
+	binary.LittleEndian.PutUint32(b[8:], d.Len)
+	binary.LittleEndian.PutUint16(b[12:], d.Flags)
+	binary.LittleEndian.PutUint16(b[14:], d.Next)
+}
+
+func (q driverQueue) getDesc(id uint16) queue.Desc {
+	b := q.mem[q.desc+16*uint64(id):]
+
+	return queue.Desc{
+		Addr:  binary.LittleEndian.Uint64(b),
+		Len:   binary.LittleEndian.Uint32(b[8:]),
+		Flags: binary.LittleEndian.Uint16(b[12:]),
+		Next:  binary.LittleEndian.Uint16(b[14:]),
+	}
+}
+
+// makeAvailable puts the descriptor chains from the heads in the available
+// ring.
+func (q driverQueue) makeAvailable(heads ...uint16) {
+	idx := binary.LittleEndian.Uint16(q.mem[q.avail+2:])
+
+	for _, head := range heads {
+		binary.LittleEndian.PutUint16(q.mem[q.avail+4+2*uint64(idx%q.size):], head)
+		idx++
+	}
+
+	binary.LittleEndian.PutUint16(q.mem[q.avail+2:], idx)
+}
+
+func (q driverQueue) usedIdx() uint16 {
+	return binary.LittleEndian.Uint16(q.mem[q.used+2:])
+}
+
+// usedElem returns the id and the length of the used element i.
+func (q driverQueue) usedElem(i uint16) (uint32, uint32) {
+	b := q.mem[q.used+4+8*uint64(i%q.size):]
+
+	return binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+}
+
 func TestGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
@@ -51,6 +132,13 @@ func TestIOInHandler(t *testing.T) {
 	if !bytes.Equal(expected, actual) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
+
+	// The ports beyond the header are ignored.
+	actual = make([]byte, 4)
+	if err := v.IOInHandler(virtio.IOPortStart+virtio.IOPortSize-2, actual); err != nil ||
+		!bytes.Equal(actual, make([]byte, 4)) {
+		t.Fatalf("unexpected error %v or bytes %v", err, actual)
+	}
 }
 
 func TestSetQueuePhysAddr(t *testing.T) {
@@ -58,12 +146,7 @@ func TestSetQueuePhysAddr(t *testing.T) {
 
 	mem := make([]byte, 0x1000000)
 	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
-	base := uint32(uintptr(unsafe.Pointer(&(v.Mem[0]))))
-
-	expected := [2]uint32{
-		base + 0x00345000,
-		base + 0x0089a000,
-	}
+	expected := [2]uint64{0x00345000, 0x0089a000}
 
 	_ = v.IOOutHandler(virtio.IOPortStart+14, []byte{0x0, 0x0})              // Select Queue #0
 	_ = v.IOOutHandler(virtio.IOPortStart+8, []byte{0x45, 0x03, 0x00, 0x00}) // Set Phys Address
@@ -71,13 +154,12 @@ func TestSetQueuePhysAddr(t *testing.T) {
 	_ = v.IOOutHandler(virtio.IOPortStart+14, []byte{0x1, 0x0})              // Select Queue #1
 	_ = v.IOOutHandler(virtio.IOPortStart+8, []byte{0x9a, 0x08, 0x00, 0x00}) // Set Phys Address
 
-	actual := [2]uint32{
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[0]))),
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[1]))),
-	}
+	actual := [2]uint64{}
+	actual[0], _, _ = v.VirtQueue[0].Addrs()
+	actual[1], _, _ = v.VirtQueue[1].Addrs()
 
 	for i := 0; i < 2; i++ {
-		if expected[0] != actual[0] {
+		if expected[i] != actual[i] {
 			t.Fatalf("expected[%d]: 0x%x, actual[%d]: 0x%x\n", i, expected[i], i, actual[i])
 		}
 	}
@@ -103,20 +185,12 @@ func TestQueueNotifyHandler(t *testing.T) {
 	_ = v.IOOutHandler(virtio.IOPortStart+14, []byte{sel, 0x0})
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
+	vq := mapQueue(t, v, mem, int(sel), 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2, Flags: 0x1, Next: 1})
+	vq.setDesc(1, queue.Desc{Addr: 0x200, Len: 2})
+	vq.makeAvailable(0)
 
-	vq.DescTable[0].Addr = 0x100
-	vq.DescTable[0].Len = K + 2
-	vq.DescTable[0].Flags = 0x1
-	vq.DescTable[0].Next = 0x1
-
-	vq.DescTable[1].Addr = 0x200
-	vq.DescTable[1].Len = 2
-
-	vq.AvailRing.Idx = 1
-	v.VirtQueue[sel] = &vq
-
-	if err := v.Tx(); err != nil {
+	if err := v.Tx(0); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
@@ -137,16 +211,14 @@ func TestRx(t *testing.T) {
 	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(expected), mem)
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
-	vq.AvailRing.Idx = 1
-	vq.DescTable[0].Addr = 0x100
-	vq.DescTable[0].Len = 0x200
-	v.VirtQueue[0] = &vq
+	vq := mapQueue(t, v, mem, 0, 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: 0x200, Flags: 0x2})
+	vq.makeAvailable(0)
 
 	// Size of struct virtio_net_hdr
 	const K = 10
 
-	if err := v.Rx(); err != nil {
+	if err := v.Rx(0); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
@@ -159,3 +231,497 @@ func TestRx(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestNetState(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+
+	_ = v.IOOutHandler(virtio.IOPortStart+14, []byte{0x1, 0x0})              // Select Queue #1
+	_ = v.IOOutHandler(virtio.IOPortStart+8, []byte{0x45, 0x03, 0x00, 0x00}) // Set Phys Address
+
+	// The device has sent 3 packets.
+	vq := legacyQueue(mem, 0x345, virtio.QueueSize)
+	binary.LittleEndian.PutUint16(mem[vq.used+2:], 3)
+
+	v.Lock()
+	s := v.State()
+	v.Unlock()
+
+	restored := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+	if err := restored.SetState(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if desc, _, _ := restored.VirtQueue[1].Addrs(); restored.VirtQueue[0] != nil || desc != vq.desc {
+		t.Fatalf("unexpected virt queue: %v", restored.VirtQueue)
+	}
+
+	// The virt queue resumes from the used ring.
+	if idx := restored.VirtQueue[1].LastAvailIdx(); idx != 3 {
+		t.Fatalf("unexpected last avail idx: %d", idx)
+	}
+}
+
+func TestNetFeatures(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+
+	host := make([]byte, 4)
+	_ = v.IOInHandler(virtio.IOPortStart, host)
+
+	if host[0]&0x1 == 0 || host[1]&0x80 == 0 {
+		t.Fatalf("CSUM and MRG_RXBUF are not offered: %v", host)
+	}
+
+	// The features not offered are not accepted.
+	_ = v.IOOutHandler(virtio.IOPortStart+4, []byte{0x01, 0x80, 0x00, 0x80})
+
+	guest := make([]byte, 4)
+	_ = v.IOInHandler(virtio.IOPortStart+4, guest)
+
+	if !bytes.Equal(guest, []byte{0x01, 0x80, 0x00, 0x00}) {
+		t.Fatalf("unexpected guest features: %v", guest)
+	}
+
+	_ = v.IOOutHandler(virtio.IOPortStart+14, []byte{0x1, 0x0})              // Select Queue #1
+	_ = v.IOOutHandler(virtio.IOPortStart+8, []byte{0x45, 0x03, 0x00, 0x00}) // Set Phys Address
+	_ = v.IOOutHandler(virtio.IOPortStart+18, []byte{0x7})
+
+	// The driver resets the device on unloading.
+	_ = v.IOOutHandler(virtio.IOPortStart+18, []byte{0x0})
+
+	_ = v.IOInHandler(virtio.IOPortStart+4, guest)
+
+	if v.VirtQueue[1] != nil || v.DriverStatus() != 0 || !bytes.Equal(guest, []byte{0, 0, 0, 0}) {
+		t.Fatalf("device is not reset: queue %v, status %d, features %v", v.VirtQueue[1], v.DriverStatus(), guest)
+	}
+}
+
+func TestTxChecksum(t *testing.T) {
+	t.Parallel()
+
+	b := bytes.NewBuffer([]byte{})
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, b, mem)
+	_ = v.SetDriverFeatures(1)
+
+	// struct virtio_net_hdr with NEEDS_CSUM, csum_start 0 and csum_offset 4,
+	// followed by a packet whose checksum field has 0x0001.
+	const K = 10
+
+	copy(mem[0x100:], []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 0})
+	copy(mem[0x100+K:], []byte{0x12, 0x34, 0x56, 0x78, 0x00, 0x01, 0x9a})
+
+	vq := mapQueue(t, v, mem, 1, 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 7})
+	vq.makeAvailable(0)
+
+	if err := v.Tx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// ^(0x1234 + 0x5678 + 0x0001 + 0x9a00) = ^0x02ae (with the carry)
+	expected := []byte{0x12, 0x34, 0x56, 0x78, 0xfd, 0x51, 0x9a}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, b.Bytes())
+	}
+}
+
+func TestRxMergeable(t *testing.T) {
+	t.Parallel()
+
+	packet := bytes.Repeat([]byte{0xaa}, 30)
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(packet), mem)
+	_ = v.SetDriverFeatures(1 << 15)
+
+	vq := mapQueue(t, v, mem, 0, 0x10000)
+
+	for i := uint16(0); i < 3; i++ {
+		vq.setDesc(i, queue.Desc{Addr: 0x100 * uint64(i+1), Len: 16, Flags: 0x2})
+		vq.makeAvailable(i)
+	}
+
+	if err := v.Rx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The 12-byte header and the packet fill 3 buffers.
+	if vq.usedIdx() != 3 || mem[0x100+10] != 3 {
+		t.Fatalf("unexpected used idx %d or num_buffers %d", vq.usedIdx(), mem[0x100+10])
+	}
+
+	for i, l := range []uint32{16, 16, 10} {
+		if id, actual := vq.usedElem(uint16(i)); id != uint32(i) || actual != l {
+			t.Fatalf("unexpected used element %d: %d, %d", i, id, actual)
+		}
+	}
+
+	if d := vq.getDesc(0); d.Flags != 0x2 || d.Len != 16 {
+		t.Fatal("descriptor is modified")
+	}
+}
+
+func TestRxOversized(t *testing.T) {
+	t.Parallel()
+
+	tp := bytes.NewBuffer(bytes.Repeat([]byte{0xaa}, 30))
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, tp, mem)
+
+	vq := mapQueue(t, v, mem, 0, 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: 16, Flags: 0x2})
+	vq.makeAvailable(0)
+
+	// Without MRG_RXBUF, the packet larger than the chain is dropped.
+	if err := v.Rx(0); err != nil || vq.usedIdx() != 0 || v.RxDropped() != 1 {
+		t.Fatalf("unexpected error %v, used idx %d or dropped %d", err, vq.usedIdx(), v.RxDropped())
+	}
+
+	// The chain is left for the next packet.
+	tp.Write([]byte{0xbb})
+
+	if err := v.Rx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, l := vq.usedElem(0); vq.usedIdx() != 1 || l != 11 || mem[0x100+10] != 0xbb {
+		t.Fatalf("unexpected used idx %d or length %d", vq.usedIdx(), l)
+	}
+}
+
+func TestRxPending(t *testing.T) {
+	t.Parallel()
+
+	packet := bytes.Repeat([]byte{0xaa}, 30)
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(packet), mem)
+	_ = v.SetDriverFeatures(1 << 15)
+
+	vq := mapQueue(t, v, mem, 0, 0x10000)
+
+	for i := uint16(0); i < 3; i++ {
+		vq.setDesc(i, queue.Desc{Addr: 0x100 * uint64(i+1), Len: 16, Flags: 0x2})
+	}
+
+	vq.makeAvailable(0)
+
+	if err := v.Rx(0); !errors.Is(err, virtio.ErrNoRxBuf) || vq.usedIdx() != 0 {
+		t.Fatalf("unexpected error %v or used idx %d", err, vq.usedIdx())
+	}
+
+	// The packet read from the tap device is delivered when the driver
+	// adds enough buffers, although the tap device is now empty.
+	vq.makeAvailable(1)
+	vq.makeAvailable(2)
+
+	if err := v.Rx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if vq.usedIdx() != 3 || !bytes.Equal(mem[0x300:0x30a], packet[20:]) {
+		t.Fatalf("unexpected used idx %d", vq.usedIdx())
+	}
+}
+
+func TestNetLink(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), make([]byte, 0x10000))
+
+	if v.Features()&(1<<5) != 0 {
+		t.Fatal("MAC is offered without the address")
+	}
+
+	v.SetMAC(net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+
+	config := make([]byte, 8)
+	if err := v.ReadConfig(0, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(config, []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56, 1, 0}) || v.Features()&(1<<5|1<<16) != 1<<5|1<<16 {
+		t.Fatalf("unexpected config %v or features 0x%x", config, v.Features())
+	}
+
+	d := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+	v.IRQInjector = d
+
+	v.SetLinkUp(false)
+
+	if v.LinkUp() || mmioRead(t, d, 0x100+6) != 0 {
+		t.Fatal("link is not down")
+	}
+
+	if isr := mmioRead(t, d, 0x060); isr != 0x2 {
+		t.Fatalf("configuration change is not notified: 0x%x", isr)
+	}
+
+	// ISR of the legacy interface is cleared only on reading, not by the
+	// queue notify.
+	_ = v.IOOutHandler(virtio.IOPortStart+16, []byte{0x1, 0x0})
+
+	isr := make([]byte, 1)
+	if _ = v.IOInHandler(virtio.IOPortStart+19, isr); isr[0] != 0x2 {
+		t.Fatalf("unexpected ISR: 0x%x", isr[0])
+	}
+
+	_ = v.IOInHandler(virtio.IOPortStart+19, isr)
+
+	if isr[0] != 0 {
+		t.Fatalf("ISR is not cleared: 0x%x", isr[0])
+	}
+}
+
+// offloadTap is a tap device which carries struct virtio_net_hdr. The
+// offloads fail with err if it is set.
+type offloadTap struct {
+	bytes.Buffer
+	hdrSize  int
+	offloads uint
+	err      error
+}
+
+func (t *offloadTap) SetVnetHdrSize(size int) error {
+	t.hdrSize = size
+
+	return nil
+}
+
+func (t *offloadTap) SetOffload(offloads uint) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	t.offloads = offloads
+
+	return nil
+}
+
+func TestNetOffload(t *testing.T) {
+	t.Parallel()
+
+	tp := &offloadTap{}
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, tp, mem)
+
+	// GUEST_CSUM, GUEST_TSO4 and HOST_TSO4 are offered.
+	if f := v.Features(); f&(1<<1|1<<7|1<<11) != 1<<1|1<<7|1<<11 {
+		t.Fatalf("offloads are not offered: 0x%x", f)
+	}
+
+	if err := v.SetDriverFeatures(1<<1 | 1<<7 | 1<<15); err != nil {
+		t.Fatal(err)
+	}
+
+	if tp.hdrSize != 12 || tp.offloads != tap.OffloadCSum|tap.OffloadTSO4 {
+		t.Fatalf("unexpected vnet header size %d or offloads 0x%x", tp.hdrSize, tp.offloads)
+	}
+
+	// struct virtio_net_hdr with GSO_TCPV4 is passed to the tap device.
+	const K = 12
+
+	hdr := []byte{1, 1, 54, 0, 0xa8, 0x05, 34, 0, 16, 0, 0, 0}
+	copy(mem[0x100:], hdr)
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+
+	vq := mapQueue(t, v, mem, 1, 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	if err := v.Tx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := append(hdr, 0xaa, 0xbb); !bytes.Equal(tp.Bytes(), expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, tp.Bytes())
+	}
+
+	// The header from the tap device is given to the driver.
+	tp.Reset()
+	tp.Write([]byte{1, 0, 0, 0, 0, 0, 34, 0, 16, 0, 0, 0, 0xcc})
+
+	vq = mapQueue(t, v, mem, 0, 0x20000)
+	vq.setDesc(0, queue.Desc{Addr: 0x200, Len: 0x100, Flags: 0x2})
+	vq.makeAvailable(0)
+
+	if err := v.Rx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []byte{1, 0, 0, 0, 0, 0, 34, 0, 16, 0, 1, 0, 0xcc}; !bytes.Equal(mem[0x200:0x200+13], expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, mem[0x200:0x200+13])
+	}
+
+	// The offloads are disabled on reset.
+	v.Reset()
+
+	if tp.hdrSize != 10 || tp.offloads != 0 {
+		t.Fatalf("offloads are not reset: %d, 0x%x", tp.hdrSize, tp.offloads)
+	}
+}
+
+func TestNetOffloadFailure(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, &offloadTap{err: errors.New("test")}, make([]byte, 0x10000))
+	d := virtio.NewMMIO(mmioBase, 9, v, &mockInjector{})
+
+	// The device fails to use the features, and needs reset instead of
+	// accepting them.
+	mmioWrite(t, d, 0x024, 1)
+	mmioWrite(t, d, 0x020, 1)
+	mmioWrite(t, d, 0x070, 0xb)
+
+	if status := mmioRead(t, d, 0x070); status != 0x43 {
+		t.Fatalf("unexpected status: 0x%x", status)
+	}
+
+	// The legacy interface records the failure in the status.
+	_ = v.IOOutHandler(virtio.IOPortStart+4, []byte{0x2, 0x0, 0x0, 0x0})
+
+	status := make([]byte, 1)
+	if _ = v.IOInHandler(virtio.IOPortStart+18, status); status[0]&0x40 == 0 {
+		t.Fatalf("unexpected legacy status: 0x%x", status[0])
+	}
+}
+
+// mqTap is a queue of a multi-queue tap device.
+type mqTap struct {
+	bytes.Buffer
+	enabled bool
+}
+
+func (t *mqTap) SetQueueEnabled(enabled bool) error {
+	t.enabled = enabled
+
+	return nil
+}
+
+func TestNetMultiQueue(t *testing.T) {
+	t.Parallel()
+
+	taps := []*mqTap{{enabled: true}, {enabled: true}}
+	mem := make([]byte, 0x100000)
+	v := virtio.NewMultiQueueNet(9, &mockInjector{}, []io.ReadWriter{taps[0], taps[1]}, mem)
+
+	// CTRL_VQ and MQ are offered with max_virtqueue_pairs.
+	config := make([]byte, 2)
+	if err := v.ReadConfig(8, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Features()&(1<<17|1<<22) != 1<<17|1<<22 || v.NumQueues() != 5 || config[0] != 2 {
+		t.Fatalf("unexpected features 0x%x, %d queues or config %v", v.Features(), v.NumQueues(), config)
+	}
+
+	// Only the first queue pair is used by default.
+	if !taps[0].enabled || taps[1].enabled {
+		t.Fatal("second queue of the tap device is not detached")
+	}
+
+	// The packet in the tx queue of the second pair goes to its queue.
+	const K = 10
+
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+
+	vq := mapQueue(t, v, mem, 3, 0x10000)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	if err := v.Tx(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if taps[0].Len() != 0 || !bytes.Equal(taps[1].Bytes(), []byte{0xaa, 0xbb}) {
+		t.Fatalf("unexpected packets: %v, %v", taps[0].Bytes(), taps[1].Bytes())
+	}
+
+	// VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET with 2 and 3 queue pairs, where the
+	// latter fails.
+	vq = mapQueue(t, v, mem, 4, 0x20000)
+
+	for i, pairs := range []byte{2, 3} {
+		cmd, ack := uint64(0x200+0x10*i), uint64(0x300+0x10*i)
+		copy(mem[cmd:], []byte{4, 0, pairs, 0})
+		mem[ack] = 0xff
+
+		vq.setDesc(uint16(2*i), queue.Desc{Addr: cmd, Len: 4, Flags: 0x1, Next: uint16(2*i + 1)})
+		vq.setDesc(uint16(2*i+1), queue.Desc{Addr: ack, Len: 1, Flags: 0x2})
+		vq.makeAvailable(uint16(2 * i))
+
+		v.Notify(4)
+	}
+
+	if mem[0x300] != 0 || mem[0x310] != 1 || vq.usedIdx() != 2 {
+		t.Fatalf("unexpected acks %d, %d or used idx %d", mem[0x300], mem[0x310], vq.usedIdx())
+	}
+
+	if !taps[1].enabled {
+		t.Fatal("second queue of the tap device is not attached")
+	}
+
+	// The number of the queue pairs is kept in the state.
+	v.Lock()
+	s := v.State()
+	v.Unlock()
+
+	if s.QueuePairs != 2 || len(s.QueuePFN) != 5 {
+		t.Fatalf("unexpected state: %+v", s)
+	}
+
+	v.Reset()
+
+	if taps[1].enabled {
+		t.Fatal("second queue of the tap device is not detached on reset")
+	}
+}
+
+func TestRxChain(t *testing.T) {
+	t.Parallel()
+
+	packet := make([]byte, 5000)
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+
+	tp := bytes.NewBuffer(packet)
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, tp, mem)
+
+	vq := mapQueue(t, v, mem, 0, 0x10000)
+
+	// The packet is kept in the tap device while there is no buffer.
+	if err := v.Rx(0); err == nil || tp.Len() != len(packet) {
+		t.Fatalf("packet is consumed without buffers: %v", err)
+	}
+
+	// A chain of 3 pages, 5 -> 2 -> 7, as big packets of Linux.
+	const K = 10
+
+	vq.setDesc(5, queue.Desc{Addr: 0x100000, Len: 0x800, Flags: 0x3, Next: 2})
+	vq.setDesc(2, queue.Desc{Addr: 0x200000, Len: 0x800, Flags: 0x3, Next: 7})
+	vq.setDesc(7, queue.Desc{Addr: 0x300000, Len: 0x800, Flags: 0x2})
+	vq.makeAvailable(5)
+
+	if err := v.Rx(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, l := vq.usedElem(0); vq.usedIdx() != 1 || id != 5 || l != K+5000 {
+		t.Fatalf("unexpected used idx %d or element %d, %d", vq.usedIdx(), id, l)
+	}
+
+	actual := append(append(mem[0x100000+K:0x100800], mem[0x200000:0x200800]...), mem[0x300000:0x300000+5000-(0x1000-K)]...)
+	if !bytes.Equal(actual, packet) {
+		t.Fatal("packet is not written across the chain")
+	}
+
+	if d := vq.getDesc(7); d.Flags != 0x2 || d.Len != 0x800 {
+		t.Fatalf("descriptor is modified: %+v", d)
+	}
+}
@@ -0,0 +1,325 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bobuhiro11/gokvm/eventfd"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	// PCIBARSize is the size of the memory BAR of the modern interface.
+	PCIBARSize = 0x4000
+
+	// pciBAR is the index of the memory BAR, which has the regions of the
+	// common configuration, ISR, the device specific configuration and the
+	// notifications at intervals of 4KiB.
+	pciBAR          = 4
+	pciCommonCfg    = 0x0000
+	pciISRCfg       = 0x1000
+	pciDeviceCfg    = 0x2000
+	pciNotifyCfg    = 0x3000
+	pciRegionSize   = 0x1000
+	pciNotifyOffMul = 4
+
+	// Capability ID and the types of the vendor specific capabilities.
+	pciCapVendor    = 0x09
+	pciCapCommonCfg = 1
+	pciCapNotifyCfg = 2
+	pciCapISRCfg    = 3
+	pciCapDeviceCfg = 4
+
+	pciCommandIO     = 0x1
+	pciCommandMemory = 0x2
+
+	// legacyQueueNotify is the offset of the queue notify register in the
+	// IO port BAR0 of the legacy interface.
+	legacyQueueNotify = 16
+
+	// msiNoVector is read from the MSI-X vectors, since MSI-X is not
+	// supported and the interrupts are delivered by INTx.
+	msiNoVector = 0xffff
+)
+
+// Offsets of the fields in struct virtio_pci_common_cfg.
+const (
+	pciDeviceFeatureSelect = 0x00
+	pciDriverFeature       = 0x0c
+	pciDriverFeatureSelect = 0x08
+	pciDeviceStatus        = 0x14
+	pciQueueSelect         = 0x16
+	pciQueueSize           = 0x18
+	pciQueueEnable         = 0x1c
+	pciQueueDesc           = 0x20
+	pciQueueDriver         = 0x28
+	pciQueueDevice         = 0x30
+)
+
+// pciCommonCfgLayout is struct virtio_pci_common_cfg.
+type pciCommonCfgLayout struct {
+	DeviceFeatureSelect uint32
+	DeviceFeature       uint32
+	DriverFeatureSelect uint32
+	DriverFeature       uint32
+	MSIXConfig          uint16
+	NumQueues           uint16
+	DeviceStatus        uint8
+	ConfigGeneration    uint8
+	QueueSelect         uint16
+	QueueSize           uint16
+	QueueMSIXVector     uint16
+	QueueEnable         uint16
+	QueueNotifyOff      uint16
+	QueueDesc           uint64
+	QueueDriver         uint64
+	QueueDevice         uint64
+}
+
+// LegacyDevice is a Device with the legacy PCI interface built in.
+type LegacyDevice interface {
+	Device
+	pci.Device
+
+	// DriverStatus returns the device status written by the legacy driver.
+	DriverStatus() uint8
+}
+
+// PCI is the transitional virtio PCI transport of a virtio device. The
+// legacy interface of the device is kept in the IO port BAR0, and the modern
+// interface is added in the memory BAR4 described by the vendor specific
+// capabilities. The driver uses either of them.
+type PCI struct {
+	transport
+
+	legacy LegacyDevice
+	bar    uint64
+}
+
+// NewPCI returns the transport, whose memory BAR is placed at bar.
+func NewPCI(dev LegacyDevice, bar uint64, irqInjector IRQInjector) *PCI {
+	return &PCI{
+		transport: newTransport(dev, irqInjector),
+		legacy:    dev,
+		bar:       bar,
+	}
+}
+
+// pciCap returns struct virtio_pci_cap for the region in the memory BAR.
+func pciCap(cfgType uint8, offset, length uint32, extra ...byte) pci.Capability {
+	data := []byte{uint8(16 + len(extra)), cfgType, pciBAR, 0, 0, 0}
+	data = append(data, pci.NumToBytes(offset)...)
+	data = append(data, pci.NumToBytes(length)...)
+
+	return pci.Capability{ID: pciCapVendor, Data: append(data, extra...)}
+}
+
+func (d *PCI) GetDeviceHeader() pci.DeviceHeader {
+	h := d.legacy.GetDeviceHeader()
+	h.Command = pciCommandIO | pciCommandMemory
+	h.BAR[pciBAR] = uint32(d.bar)
+	h.Capabilities = []pci.Capability{
+		pciCap(pciCapCommonCfg, pciCommonCfg, pciRegionSize),
+		pciCap(pciCapNotifyCfg, pciNotifyCfg, pciRegionSize, pci.NumToBytes(uint32(pciNotifyOffMul))...),
+		pciCap(pciCapISRCfg, pciISRCfg, pciRegionSize),
+		pciCap(pciCapDeviceCfg, pciDeviceCfg, pciRegionSize),
+	}
+
+	return h
+}
+
+func (d *PCI) IOInHandler(port uint64, bytes []byte) error {
+	return d.legacy.IOInHandler(port, bytes)
+}
+
+func (d *PCI) IOOutHandler(port uint64, bytes []byte) error {
+	return d.legacy.IOOutHandler(port, bytes)
+}
+
+func (d *PCI) GetIORange() (start, end uint64) {
+	return d.legacy.GetIORange()
+}
+
+func (d *PCI) GetBARSize(bar int) uint64 {
+	if bar == pciBAR {
+		return PCIBARSize
+	}
+
+	return 0
+}
+
+// GetMMIORange returns the range of the memory BAR, where Read and Write are
+// called.
+func (d *PCI) GetMMIORange() (start, end uint64) {
+	return d.bar, d.bar + PCIBARSize
+}
+
+// NotifyAddr returns the address and the size of the write by which the
+// modern driver notifies the virt queue sel. The value written is sel.
+func (d *PCI) NotifyAddr(sel int) (uint64, uint32) {
+	return d.bar + pciNotifyCfg + uint64(sel)*pciNotifyOffMul, 2
+}
+
+// LegacyNotifier returns the notifications of the legacy interface.
+func (d *PCI) LegacyNotifier() *LegacyNotifier {
+	return &LegacyNotifier{dev: d.legacy}
+}
+
+// LegacyNotifier serves the notifications written by the legacy driver to the
+// queue notify register in the IO port BAR0.
+type LegacyNotifier struct {
+	dev LegacyDevice
+}
+
+// NotifyAddr returns the IO port and the size of the write by which the
+// legacy driver notifies the virt queue sel. The value written is sel.
+func (n *LegacyNotifier) NotifyAddr(sel int) (uint64, uint32) {
+	start, _ := n.dev.GetIORange()
+
+	return start + legacyQueueNotify, 2
+}
+
+// ServeNotifyFD notifies the device of the virt queue sel each time the
+// eventfd is signaled, which KVM does on the write to NotifyAddr instead of
+// exiting to userspace. It returns when waiting for the eventfd fails.
+func (n *LegacyNotifier) ServeNotifyFD(sel int, e *eventfd.EventFD) {
+	for {
+		if _, err := e.Wait(); err != nil {
+			return
+		}
+
+		n.dev.Notify(sel)
+	}
+}
+
+// DriverStatus returns the device status written by either the modern or the
+// legacy driver.
+func (d *PCI) DriverStatus() uint8 {
+	if s := d.transport.DriverStatus(); s != 0 {
+		return s
+	}
+
+	return d.legacy.DriverStatus()
+}
+
+func (d *PCI) Read(addr uint64, data []byte) error {
+	offset := addr - d.bar
+
+	switch {
+	case offset < pciCommonCfg+pciRegionSize:
+		return d.readCommonCfg(offset-pciCommonCfg, data)
+	case offset < pciISRCfg+pciRegionSize:
+		// Reading ISR clears it.
+		copy(data, pci.NumToBytes(uint8(d.interruptStatus(true))))
+	case offset < pciDeviceCfg+pciRegionSize:
+		return d.dev.ReadConfig(offset-pciDeviceCfg, data)
+	}
+
+	return nil
+}
+
+func (d *PCI) Write(addr uint64, data []byte) error {
+	offset := addr - d.bar
+
+	switch {
+	case offset < pciCommonCfg+pciRegionSize:
+		return d.writeCommonCfg(offset-pciCommonCfg, data)
+	case offset >= pciNotifyCfg && offset < pciNotifyCfg+pciRegionSize:
+		d.notify(uint32((offset - pciNotifyCfg) / pciNotifyOffMul))
+	}
+
+	// ISR and the device specific configuration are read-only.
+	return nil
+}
+
+func (d *PCI) readCommonCfg(offset uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := pciCommonCfgLayout{
+		DeviceFeatureSelect: d.s.DeviceFeaturesSel,
+		DeviceFeature:       d.deviceFeatures(),
+		DriverFeatureSelect: d.s.DriverFeaturesSel,
+		MSIXConfig:          msiNoVector,
+		NumQueues:           uint16(len(d.s.Queues)),
+		DeviceStatus:        uint8(d.s.Status),
+		QueueSelect:         uint16(d.s.QueueSel),
+		QueueMSIXVector:     msiNoVector,
+	}
+
+	if d.s.DriverFeaturesSel < 2 {
+		c.DriverFeature = uint32(d.s.DriverFeatures >> (32 * d.s.DriverFeaturesSel))
+	}
+
+	if q := d.queue(); q != nil {
+		c.QueueSize = uint16(q.Num)
+		c.QueueNotifyOff = uint16(d.s.QueueSel)
+		c.QueueDesc, c.QueueDriver, c.QueueDevice = q.Desc, q.Driver, q.Device
+
+		if q.Ready {
+			c.QueueEnable = 1
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, c); err != nil {
+		return err
+	}
+
+	readConfig(buf.Bytes(), offset, data)
+
+	return nil
+}
+
+func (d *PCI) writeCommonCfg(offset uint64, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := uint32(pci.BytesToNum(data))
+	q := d.queue()
+
+	switch offset {
+	case pciDeviceFeatureSelect:
+		d.s.DeviceFeaturesSel = v
+	case pciDriverFeatureSelect:
+		d.s.DriverFeaturesSel = v
+	case pciDriverFeature:
+		d.setDriverFeatures(v)
+	case pciDeviceStatus:
+		d.setStatus(v)
+	case pciQueueSelect:
+		d.s.QueueSel = v
+	case pciQueueEnable:
+		d.setQueueReady(v == 1)
+	case pciQueueSize:
+		// The fields of a nonexistent queue are ignored.
+		if q != nil {
+			q.Num = v
+		}
+	case pciQueueDesc, pciQueueDesc + 4, pciQueueDriver, pciQueueDriver + 4, pciQueueDevice, pciQueueDevice + 4:
+		if q != nil {
+			setQueueAddr(q, offset, data)
+		}
+	default:
+		// The other fields are read-only.
+	}
+
+	return nil
+}
+
+// setQueueAddr sets the 64-bit address of the virt queue, which may be written
+// by two 32-bit accesses.
+func setQueueAddr(q *QueueConfig, offset uint64, data []byte) {
+	reg, start := &q.Desc, uint64(pciQueueDesc)
+
+	switch {
+	case offset >= pciQueueDevice:
+		reg, start = &q.Device, pciQueueDevice
+	case offset >= pciQueueDriver:
+		reg, start = &q.Driver, pciQueueDriver
+	}
+
+	b := pci.NumToBytes(*reg)
+	copy(b[offset-start:], data)
+	*reg = pci.BytesToNum(b)
+}
@@ -0,0 +1,235 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/eventfd"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+const pciBARBase = 0xc0000000
+
+func pciRead(t *testing.T, d *virtio.PCI, offset uint64, size int) uint64 {
+	t.Helper()
+
+	b := make([]byte, 8)
+	if err := d.Read(pciBARBase+offset, b[:size]); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint64(b)
+}
+
+func pciWrite(t *testing.T, d *virtio.PCI, offset uint64, size int, v uint64) {
+	t.Helper()
+
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	if err := d.Write(pciBARBase+offset, b[:size]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPCICapabilities(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), []byte{})
+	d := virtio.NewPCI(v, pciBARBase, &mockInjector{})
+
+	b, err := d.GetDeviceHeader().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bar := binary.LittleEndian.Uint32(b[0x10+4*4:]); bar != pciBARBase {
+		t.Fatalf("unexpected BAR4: 0x%x", bar)
+	}
+
+	if d.GetBARSize(4) != virtio.PCIBARSize || d.GetBARSize(1) != 0 {
+		t.Fatal("unexpected size of the BARs")
+	}
+
+	// struct virtio_pci_cap of each configuration, whose offset in BAR4 is
+	// indexed by cfg_type.
+	offsets := map[uint8]uint32{}
+
+	for p := b[0x34]; p != 0; p = b[p+1] {
+		if b[p] != 0x09 || b[p+4] != 4 {
+			t.Fatalf("unexpected capability at 0x%x: %v", p, b[p:p+16])
+		}
+
+		offsets[b[p+3]] = binary.LittleEndian.Uint32(b[p+8:])
+
+		if b[p+3] == 2 && binary.LittleEndian.Uint32(b[p+16:]) != 4 {
+			t.Fatal("unexpected notify_off_multiplier")
+		}
+	}
+
+	expected := map[uint8]uint32{1: 0x0000, 2: 0x3000, 3: 0x1000, 4: 0x2000}
+	for cfgType, offset := range expected {
+		if offsets[cfgType] != offset {
+			t.Fatalf("unexpected offset of cfg_type %d: 0x%x", cfgType, offsets[cfgType])
+		}
+	}
+}
+
+func TestPCIInvalidQueue(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewNet(9, &mockInjector{}, &syncBuffer{}, make([]byte, 0x10000))
+	d := virtio.NewPCI(v, pciBARBase, &mockInjector{})
+	v.IRQInjector = d
+
+	pciWrite(t, d, 0x14, 1, 0xb)
+
+	// The fields of a nonexistent queue are ignored.
+	pciWrite(t, d, 0x16, 2, 5)
+	pciWrite(t, d, 0x18, 2, 8)
+	pciWrite(t, d, 0x20, 8, 0x2000)
+	pciWrite(t, d, 0x1c, 2, 1)
+
+	if ready := pciRead(t, d, 0x1c, 2); ready != 0 {
+		t.Fatal("nonexistent queue is enabled")
+	}
+
+	// The queue of no entries makes the device need reset.
+	pciWrite(t, d, 0x16, 2, 0)
+	pciWrite(t, d, 0x18, 2, 0)
+	pciWrite(t, d, 0x1c, 2, 1)
+
+	if ready, status := pciRead(t, d, 0x1c, 2), pciRead(t, d, 0x14, 1); ready != 0 || status&0x40 == 0 {
+		t.Fatalf("unexpected queue_enable %d or device status 0x%x", ready, status)
+	}
+}
+
+func TestPCINotify(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	tap := &syncBuffer{}
+	v := virtio.NewNet(9, &mockInjector{}, tap, mem)
+	d := virtio.NewPCI(v, pciBARBase, &mockInjector{})
+	v.IRQInjector = d
+
+	go v.QueuePairThreadEntry(0)
+
+	if n := pciRead(t, d, 0x12, 2); n != 2 {
+		t.Fatalf("unexpected number of queues: %d", n)
+	}
+
+	pciWrite(t, d, 0x08, 4, 1)
+	pciWrite(t, d, 0x0c, 4, 1)
+	pciWrite(t, d, 0x14, 1, 0xb)
+
+	if status := pciRead(t, d, 0x14, 1); status != 0xb {
+		t.Fatalf("FEATURES_OK is not set: 0x%x", status)
+	}
+
+	// Linux allocates the parts of the queue separately, and writes the
+	// addresses by two 32-bit accesses.
+	pciWrite(t, d, 0x16, 2, 1)
+	pciWrite(t, d, 0x18, 2, pciRead(t, d, 0x18, 2))
+	pciWrite(t, d, 0x20, 4, 0x2000)
+	pciWrite(t, d, 0x24, 4, 0)
+	pciWrite(t, d, 0x28, 4, 0x3040)
+	pciWrite(t, d, 0x2c, 4, 0)
+	pciWrite(t, d, 0x30, 8, 0x4000)
+	pciWrite(t, d, 0x1c, 2, 1)
+
+	if notifyOff := pciRead(t, d, 0x1e, 2); notifyOff != 1 {
+		t.Fatalf("unexpected queue_notify_off: %d", notifyOff)
+	}
+
+	pciWrite(t, d, 0x14, 1, 0xf)
+
+	const K = 12
+
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+
+	vq := driverQueue{mem: mem, size: virtio.QueueSize, desc: 0x2000, avail: 0x3040, used: 0x4000}
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	if desc, avail, used := v.VirtQueue[1].Addrs(); desc != vq.desc || avail != vq.avail || used != vq.used {
+		t.Fatalf("unexpected addresses of the queue: 0x%x, 0x%x, 0x%x", desc, avail, used)
+	}
+
+	pciWrite(t, d, 0x3000+4, 2, 1)
+
+	// Reading ISR clears it.
+	for deadline := time.Now().Add(time.Second); pciRead(t, d, 0x1000, 1) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("interrupt status is not set")
+		}
+	}
+
+	if isr := pciRead(t, d, 0x1000, 1); isr != 0 {
+		t.Fatalf("interrupt status is not cleared: 0x%x", isr)
+	}
+
+	if !bytes.Equal(tap.Bytes(), []byte{0xaa, 0xbb}) {
+		t.Fatalf("unexpected packet: %v", tap.Bytes())
+	}
+
+	// The device is reset by writing 0.
+	pciWrite(t, d, 0x14, 1, 0)
+
+	if v.VirtQueue[1] != nil || d.DriverStatus() != 0 {
+		t.Fatal("device is not reset")
+	}
+}
+
+func TestPCILegacyNotifier(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	tap := &syncBuffer{}
+	v := virtio.NewNet(9, &mockInjector{}, tap, mem)
+	d := virtio.NewPCI(v, pciBARBase, &mockInjector{})
+	n := d.LegacyNotifier()
+
+	go v.QueuePairThreadEntry(0)
+
+	if addr, size := n.NotifyAddr(1); addr != virtio.IOPortStart+16 || size != 2 {
+		t.Fatalf("unexpected notify port 0x%x or size %d", addr, size)
+	}
+
+	e, err := eventfd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go n.ServeNotifyFD(1, e)
+
+	_ = d.IOOutHandler(virtio.IOPortStart+14, []byte{1, 0})
+	_ = d.IOOutHandler(virtio.IOPortStart+8, []byte{0x8, 0, 0, 0})
+	_ = d.IOOutHandler(virtio.IOPortStart+18, []byte{0x7})
+
+	const K = 10
+
+	copy(mem[0x100+K:], []byte{0xaa, 0xbb})
+
+	vq := legacyQueue(mem, 0x8, virtio.QueueSize)
+	vq.setDesc(0, queue.Desc{Addr: 0x100, Len: K + 2})
+	vq.makeAvailable(0)
+
+	// KVM signals the eventfd instead of the write to the IO port.
+	if err := e.Signal(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for !bytes.Equal(tap.Bytes(), []byte{0xaa, 0xbb}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected packet: %v", tap.Bytes())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
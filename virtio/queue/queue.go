@@ -0,0 +1,412 @@
+// Package queue implements the device side of the split virt queues of
+// virtio, whose descriptor table, available ring and used ring are placed in
+// the guest memory by the driver.
+//
+// refs https://docs.oasis-open.org/virtio/virtio/v1.1/cs01/virtio-v1.1-cs01.html#x1-240006
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+var (
+	ErrInvalidSize  = errors.New("queue size is invalid")
+	ErrInvalidAddr  = errors.New("address is out of the guest memory")
+	ErrInvalidChain = errors.New("descriptor chain is invalid")
+	ErrEmpty        = errors.New("no buffer is available")
+)
+
+// Features of the virt queues, which the device offers to the driver and
+// passes the accepted ones to New.
+const (
+	// FeatureIndirectDesc (VIRTIO_RING_F_INDIRECT_DESC) allows the driver to
+	// put a table of descriptors in a buffer, and refer to it by a
+	// descriptor with DescFIndirect.
+	FeatureIndirectDesc = 1 << 28
+
+	// FeatureEventIdx (VIRTIO_RING_F_EVENT_IDX) replaces the flags of the
+	// rings by used_event and avail_event, by which each side tells the index
+	// at which it wants the next interrupt or notification.
+	FeatureEventIdx = 1 << 29
+)
+
+const (
+	// MaxSize is the largest size of a split virt queue.
+	MaxSize = 32768
+
+	// Flags of the descriptors.
+	DescFNext     = 0x1
+	DescFWrite    = 0x2
+	DescFIndirect = 0x4
+
+	// availFNoInterrupt in the flags of the available ring tells the device
+	// not to interrupt the driver.
+	availFNoInterrupt = 0x1
+
+	// usedFNoNotify in the flags of the used ring tells the driver not to
+	// notify the device.
+	usedFNoNotify = 0x1
+
+	descSize     = 16
+	usedElemSize = 8
+)
+
+// Desc is struct virtq_desc.
+type Desc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// Buffer is a buffer in the guest memory described by a descriptor.
+type Buffer struct {
+	Data []byte
+
+	// Writable is true if the device writes to the buffer, and false if the
+	// device reads from it.
+	Writable bool
+}
+
+// Chain is a descriptor chain taken from the available ring, where the
+// device-readable buffers are followed by the device-writable ones.
+type Chain struct {
+	// Head is the index of the first descriptor, by which the chain is
+	// returned to the driver.
+	Head    uint16
+	Buffers []Buffer
+}
+
+// Readable returns the data in the device-readable buffers.
+func (c Chain) Readable() []byte {
+	res := []byte{}
+
+	for _, b := range c.Buffers {
+		if !b.Writable {
+			res = append(res, b.Data...)
+		}
+	}
+
+	return res
+}
+
+// WritableLen returns the total size of the device-writable buffers.
+func (c Chain) WritableLen() int {
+	n := 0
+
+	for _, b := range c.Buffers {
+		if b.Writable {
+			n += len(b.Data)
+		}
+	}
+
+	return n
+}
+
+// Write writes the data into the device-writable buffers as far as they have
+// space, and returns the number of bytes written.
+func (c Chain) Write(data []byte) uint32 {
+	written := 0
+
+	for _, b := range c.Buffers {
+		if b.Writable && written < len(data) {
+			written += copy(b.Data, data[written:])
+		}
+	}
+
+	return uint32(written)
+}
+
+// Queue is a split virt queue. It is not safe for concurrent use, and the
+// device must serialize the accesses to each queue.
+type Queue struct {
+	mem               []byte
+	size              uint16
+	desc, avail, used uint64
+
+	indirect bool
+	eventIdx bool
+
+	// lastAvailIdx is the index of the next entry taken from the available
+	// ring, and usedIdx is that of the next entry put in the used ring.
+	lastAvailIdx uint16
+	usedIdx      uint16
+
+	// signalledUsedIdx is usedIdx when NeedsInterrupt was called last, and
+	// notify is false while the notification is disabled.
+	signalledUsedIdx uint16
+	notify           bool
+}
+
+// New returns the virt queue of size entries, whose parts are placed at the
+// guest physical addresses, with the features accepted by the driver. The
+// parts must be in the guest memory and aligned as required by the
+// specification. The queue resumes from the used ring, so that it is restored
+// from a snapshot of the guest memory.
+func New(mem []byte, size uint16, desc, avail, used, features uint64) (*Queue, error) {
+	if size == 0 || size > MaxSize || size&(size-1) != 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+
+	q := &Queue{
+		mem:      mem,
+		size:     size,
+		desc:     desc,
+		avail:    avail,
+		used:     used,
+		indirect: features&FeatureIndirectDesc != 0,
+		eventIdx: features&FeatureEventIdx != 0,
+		notify:   true,
+	}
+
+	for _, part := range []struct {
+		addr, size, align uint64
+	}{
+		{desc, descSize * uint64(size), 16},
+		{avail, 6 + 2*uint64(size), 2},
+		{used, 6 + usedElemSize*uint64(size), 4},
+	} {
+		if part.addr%part.align != 0 || !q.valid(part.addr, part.size) {
+			return nil, fmt.Errorf("%w: desc 0x%x, avail 0x%x, used 0x%x", ErrInvalidAddr, desc, avail, used)
+		}
+	}
+
+	q.usedIdx = q.load16(used + 2)
+	q.lastAvailIdx = q.usedIdx
+	q.signalledUsedIdx = q.usedIdx
+	q.setAvailEvent()
+
+	return q, nil
+}
+
+// Size returns the number of the entries.
+func (q *Queue) Size() uint16 {
+	return q.size
+}
+
+// Addrs returns the guest physical addresses of the descriptor table, the
+// available ring and the used ring.
+func (q *Queue) Addrs() (desc, avail, used uint64) {
+	return q.desc, q.avail, q.used
+}
+
+// LastAvailIdx returns the index of the next entry taken from the available
+// ring.
+func (q *Queue) LastAvailIdx() uint16 {
+	return q.lastAvailIdx
+}
+
+// Available returns whether the driver has made buffers available.
+func (q *Queue) Available() bool {
+	return q.lastAvailIdx != q.availIdx()
+}
+
+// Pop takes the next descriptor chain from the available ring, or returns
+// ErrEmpty if there is none. The chain is taken even if it is invalid, in
+// which case Head is valid and should be returned to the driver by Push.
+func (q *Queue) Pop() (Chain, error) {
+	if !q.Available() {
+		return Chain{}, ErrEmpty
+	}
+
+	head := q.load16(q.avail + 4 + 2*uint64(q.lastAvailIdx%q.size))
+	q.lastAvailIdx++
+
+	if q.notify {
+		q.setAvailEvent()
+	}
+
+	return q.chain(head)
+}
+
+// Rewind puts back the last n chains taken by Pop into the available ring.
+func (q *Queue) Rewind(n uint16) {
+	q.lastAvailIdx -= n
+}
+
+// Push puts the chain with the number of bytes written by the device into
+// the used ring. It is visible to the driver after Publish.
+func (q *Queue) Push(head uint16, written uint32) {
+	elem := q.mem[q.used+4+usedElemSize*uint64(q.usedIdx%q.size):]
+	binary.LittleEndian.PutUint32(elem, uint32(head))
+	binary.LittleEndian.PutUint32(elem[4:], written)
+
+	q.usedIdx++
+}
+
+// Publish makes the chains put by Push visible to the driver at once. The
+// used elements are written before the index.
+func (q *Queue) Publish() {
+	fence()
+	q.store16(q.used+2, q.usedIdx)
+}
+
+// NeedsInterrupt returns whether the driver should be interrupted after the
+// used ring is published. With FeatureEventIdx, it is true only if the used
+// index has passed used_event since the last call.
+func (q *Queue) NeedsInterrupt() bool {
+	// The index published must be visible before the flags or used_event
+	// are read, so that the interrupt is not lost when the driver enables it
+	// meanwhile.
+	fence()
+
+	if !q.eventIdx {
+		return q.load16(q.avail)&availFNoInterrupt == 0
+	}
+
+	old := q.signalledUsedIdx
+	q.signalledUsedIdx = q.usedIdx
+
+	return needEvent(q.load16(q.avail+4+2*uint64(q.size)), q.usedIdx, old)
+}
+
+// DisableNotification tells the driver not to notify the device, while the
+// device is taking the chains from the available ring anyway.
+func (q *Queue) DisableNotification() {
+	q.notify = false
+
+	// avail_event is left behind the available index instead.
+	if !q.eventIdx {
+		q.store16(q.used, q.load16(q.used)|usedFNoNotify)
+	}
+}
+
+// EnableNotification tells the driver to notify the device, and returns
+// whether buffers have been made available before that. The device must take
+// them without waiting for a notification in that case.
+func (q *Queue) EnableNotification() bool {
+	q.notify = true
+
+	if q.eventIdx {
+		q.setAvailEvent()
+	} else {
+		q.store16(q.used, q.load16(q.used)&^usedFNoNotify)
+	}
+
+	fence()
+
+	return q.Available()
+}
+
+// setAvailEvent asks the driver to notify the device when it makes the next
+// buffer available, if FeatureEventIdx is accepted.
+func (q *Queue) setAvailEvent() {
+	if q.eventIdx {
+		q.store16(q.used+4+usedElemSize*uint64(q.size), q.lastAvailIdx)
+	}
+}
+
+// needEvent returns whether the index has passed the event index by moving
+// from old to idx, which is vring_need_event of Linux.
+func needEvent(event, idx, old uint16) bool {
+	return idx-event-1 < idx-old
+}
+
+// chain returns the descriptor chain from head. The chain must not be longer
+// than the table of the descriptors, which means a loop, and the buffers must
+// be in the guest memory. With FeatureIndirectDesc, the last descriptor may
+// refer to an indirect table, which is followed instead.
+func (q *Queue) chain(head uint16) (Chain, error) {
+	c := Chain{Head: head}
+	table, n := q.desc, uint64(q.size)
+	indirect := false
+	id, walked := uint64(head), uint64(0)
+
+	for {
+		if id >= n || walked >= n {
+			return c, fmt.Errorf("%w: descriptor %d from %d", ErrInvalidChain, id, head)
+		}
+
+		walked++
+
+		d := q.readDesc(table, id)
+		if !q.valid(d.Addr, uint64(d.Len)) {
+			return c, fmt.Errorf("%w: 0x%x-0x%x", ErrInvalidAddr, d.Addr, d.Addr+uint64(d.Len))
+		}
+
+		if d.Flags&DescFIndirect != 0 {
+			// The indirect table is neither nested nor followed by
+			// another descriptor, and its size is a multiple of the
+			// descriptor.
+			if !q.indirect || indirect || d.Flags&DescFNext != 0 || d.Len == 0 || d.Len%descSize != 0 {
+				return c, fmt.Errorf("%w: indirect descriptor %d from %d", ErrInvalidChain, id, head)
+			}
+
+			table, n = d.Addr, uint64(d.Len/descSize)
+			indirect = true
+			id, walked = 0, 0
+
+			continue
+		}
+
+		writable := d.Flags&DescFWrite != 0
+		if !writable && len(c.Buffers) > 0 && c.Buffers[len(c.Buffers)-1].Writable {
+			return c, fmt.Errorf("%w: readable descriptor %d after writable one", ErrInvalidChain, id)
+		}
+
+		c.Buffers = append(c.Buffers, Buffer{Data: q.mem[d.Addr : d.Addr+uint64(d.Len)], Writable: writable})
+
+		if d.Flags&DescFNext == 0 {
+			return c, nil
+		}
+
+		id = uint64(d.Next)
+	}
+}
+
+// Desc returns the descriptor id in the descriptor table, which must be less
+// than the size.
+func (q *Queue) Desc(id uint16) Desc {
+	return q.readDesc(q.desc, uint64(id))
+}
+
+// readDesc returns the descriptor id in the table at the address, which must
+// be in the guest memory.
+func (q *Queue) readDesc(table, id uint64) Desc {
+	b := q.mem[table+descSize*id:]
+
+	return Desc{
+		Addr:  binary.LittleEndian.Uint64(b),
+		Len:   binary.LittleEndian.Uint32(b[8:]),
+		Flags: binary.LittleEndian.Uint16(b[12:]),
+		Next:  binary.LittleEndian.Uint16(b[14:]),
+	}
+}
+
+// availIdx returns the index of the available ring written by the driver.
+// The descriptors made available are read after the index.
+func (q *Queue) availIdx() uint16 {
+	idx := q.load16(q.avail + 2)
+	fence()
+
+	return idx
+}
+
+// valid returns whether the range of size bytes from addr is in the guest
+// memory.
+func (q *Queue) valid(addr, size uint64) bool {
+	return addr+size >= addr && addr+size <= uint64(len(q.mem))
+}
+
+// load16 and store16 access the 16-bit field shared with the driver by a
+// single access, which is validated by New to be in the guest memory.
+func (q *Queue) load16(addr uint64) uint16 {
+	return *(*uint16)(unsafe.Pointer(&q.mem[addr]))
+}
+
+func (q *Queue) store16(addr uint64, v uint16) {
+	*(*uint16)(unsafe.Pointer(&q.mem[addr])) = v
+}
+
+var fenceVar uint32
+
+// fence is a full memory barrier between the device and the driver running
+// on another CPU. An atomic read-modify-write is a barrier for both the
+// compiler and the CPU, e.g. the LOCK prefix of x86-64.
+func fence() {
+	atomic.AddUint32(&fenceVar, 0)
+}
@@ -0,0 +1,338 @@
+package queue_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio/queue"
+)
+
+const (
+	size  = 8
+	desc  = 0x1000
+	avail = 0x2000
+	used  = 0x3000
+)
+
+func setDesc(mem []byte, id uint16, d queue.Desc) {
+	b := mem[desc+16*uint64(id):]
+	binary.LittleEndian.PutUint64(b, d.Addr)
+	binary.LittleEndian.PutUint32(b[8:], d.Len)
+	binary.LittleEndian.PutUint16(b[12:], d.Flags)
+	binary.LittleEndian.PutUint16(b[14:], d.Next)
+}
+
+func makeAvailable(mem []byte, heads ...uint16) {
+	idx := binary.LittleEndian.Uint16(mem[avail+2:])
+
+	for _, head := range heads {
+		binary.LittleEndian.PutUint16(mem[avail+4+2*uint64(idx%size):], head)
+		idx++
+	}
+
+	binary.LittleEndian.PutUint16(mem[avail+2:], idx)
+}
+
+func newQueue(t *testing.T, mem []byte, features uint64) *queue.Queue {
+	t.Helper()
+
+	q, err := queue.New(mem, size, desc, avail, used, features)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x4000)
+
+	for _, tc := range []struct {
+		size              uint16
+		desc, avail, used uint64
+		err               error
+	}{
+		{0, desc, avail, used, queue.ErrInvalidSize},
+		{6, desc, avail, used, queue.ErrInvalidSize},
+		{size, desc + 8, avail, used, queue.ErrInvalidAddr},
+		{size, desc, avail + 1, used, queue.ErrInvalidAddr},
+		{size, desc, avail, used + 2, queue.ErrInvalidAddr},
+		{size, desc, avail, 0x3ff0, queue.ErrInvalidAddr},
+		{size, desc, avail, used, nil},
+	} {
+		if _, err := queue.New(mem, tc.size, tc.desc, tc.avail, tc.used, 0); !errors.Is(err, tc.err) {
+			t.Fatalf("unexpected error for %+v: %v", tc, err)
+		}
+	}
+}
+
+func TestPopAndPush(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x4000)
+	q := newQueue(t, mem, 0)
+
+	if _, err := q.Pop(); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	copy(mem[0x100:], "abc")
+	setDesc(mem, 3, queue.Desc{Addr: 0x100, Len: 3, Flags: queue.DescFNext, Next: 5})
+	setDesc(mem, 5, queue.Desc{Addr: 0x200, Len: 2, Flags: queue.DescFNext | queue.DescFWrite, Next: 1})
+	setDesc(mem, 1, queue.Desc{Addr: 0x300, Len: 2, Flags: queue.DescFWrite})
+	makeAvailable(mem, 3)
+
+	c, err := q.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Head != 3 || len(c.Buffers) != 3 || !bytes.Equal(c.Readable(), []byte("abc")) || c.WritableLen() != 4 {
+		t.Fatalf("unexpected chain: %+v", c)
+	}
+
+	if n := c.Write([]byte("defgh")); n != 4 || !bytes.Equal(mem[0x200:0x202], []byte("de")) ||
+		!bytes.Equal(mem[0x300:0x302], []byte("fg")) {
+		t.Fatalf("unexpected written bytes: %d", n)
+	}
+
+	q.Push(c.Head, 4)
+
+	// The used element is not visible until it is published.
+	if idx := binary.LittleEndian.Uint16(mem[used+2:]); idx != 0 {
+		t.Fatalf("used idx is published: %d", idx)
+	}
+
+	q.Publish()
+
+	if idx, id, l := binary.LittleEndian.Uint16(mem[used+2:]), binary.LittleEndian.Uint32(mem[used+4:]),
+		binary.LittleEndian.Uint32(mem[used+8:]); idx != 1 || id != 3 || l != 4 {
+		t.Fatalf("unexpected used idx %d or element %d, %d", idx, id, l)
+	}
+
+	// The queue resumes from the used ring.
+	if q = newQueue(t, mem, 0); q.LastAvailIdx() != 1 || q.Available() {
+		t.Fatalf("unexpected last avail idx: %d", q.LastAvailIdx())
+	}
+}
+
+func TestInvalidChain(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		descs map[uint16]queue.Desc
+		err   error
+	}{
+		{"loop", map[uint16]queue.Desc{
+			0: {Addr: 0x100, Len: 1, Flags: queue.DescFNext, Next: 1},
+			1: {Addr: 0x100, Len: 1, Flags: queue.DescFNext, Next: 0},
+		}, queue.ErrInvalidChain},
+		{"out of range", map[uint16]queue.Desc{
+			0: {Addr: 0x100, Len: 1, Flags: queue.DescFNext, Next: size},
+		}, queue.ErrInvalidChain},
+		{"readable after writable", map[uint16]queue.Desc{
+			0: {Addr: 0x100, Len: 1, Flags: queue.DescFNext | queue.DescFWrite, Next: 1},
+			1: {Addr: 0x100, Len: 1},
+		}, queue.ErrInvalidChain},
+		{"out of memory", map[uint16]queue.Desc{
+			0: {Addr: 0x3ff0, Len: 0x20},
+		}, queue.ErrInvalidAddr},
+	} {
+		mem := make([]byte, 0x4000)
+		q := newQueue(t, mem, 0)
+
+		for id, d := range tc.descs {
+			setDesc(mem, id, d)
+		}
+
+		makeAvailable(mem, 0)
+
+		// The invalid chain is taken anyway to be returned to the driver.
+		if c, err := q.Pop(); !errors.Is(err, tc.err) || c.Head != 0 || q.Available() {
+			t.Fatalf("unexpected error for %s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRewind(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x4000)
+	q := newQueue(t, mem, 0)
+
+	setDesc(mem, 0, queue.Desc{Addr: 0x100, Len: 1})
+	setDesc(mem, 1, queue.Desc{Addr: 0x200, Len: 1})
+	makeAvailable(mem, 0, 1)
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.Rewind(1)
+
+	if c, err := q.Pop(); err != nil || c.Head != 1 {
+		t.Fatalf("unexpected chain %+v or error %v", c, err)
+	}
+}
+
+func TestNotification(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x4000)
+	q := newQueue(t, mem, 0)
+
+	if !q.NeedsInterrupt() {
+		t.Fatal("interrupt is suppressed")
+	}
+
+	// VIRTQ_AVAIL_F_NO_INTERRUPT
+	binary.LittleEndian.PutUint16(mem[avail:], 1)
+
+	if q.NeedsInterrupt() {
+		t.Fatal("interrupt is not suppressed")
+	}
+
+	q.DisableNotification()
+
+	if flags := binary.LittleEndian.Uint16(mem[used:]); flags != 1 {
+		t.Fatalf("notification is not disabled: 0x%x", flags)
+	}
+
+	if q.EnableNotification() {
+		t.Fatal("buffers are available")
+	}
+
+	if flags := binary.LittleEndian.Uint16(mem[used:]); flags != 0 {
+		t.Fatalf("notification is not enabled: 0x%x", flags)
+	}
+
+	// Buffers made available while the notification is disabled are
+	// reported when it is enabled.
+	q.DisableNotification()
+	setDesc(mem, 0, queue.Desc{Addr: 0x100, Len: 1})
+	makeAvailable(mem, 0)
+
+	if !q.EnableNotification() {
+		t.Fatal("buffers are not available")
+	}
+}
+
+func TestIndirect(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x4000)
+	q := newQueue(t, mem, queue.FeatureIndirectDesc)
+
+	// The indirect table at 0x800 has a readable buffer and a writable one.
+	setDesc(mem, 0, queue.Desc{Addr: 0x100, Len: 1, Flags: queue.DescFNext, Next: 1})
+	setDesc(mem, 1, queue.Desc{Addr: 0x800, Len: 32, Flags: queue.DescFIndirect})
+
+	for i, d := range []queue.Desc{
+		{Addr: 0x200, Len: 2, Flags: queue.DescFNext, Next: 1},
+		{Addr: 0x300, Len: 3, Flags: queue.DescFWrite},
+	} {
+		b := mem[0x800+16*i:]
+		binary.LittleEndian.PutUint64(b, d.Addr)
+		binary.LittleEndian.PutUint32(b[8:], d.Len)
+		binary.LittleEndian.PutUint16(b[12:], d.Flags)
+		binary.LittleEndian.PutUint16(b[14:], d.Next)
+	}
+
+	makeAvailable(mem, 0)
+
+	c, err := q.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Buffers) != 3 || len(c.Readable()) != 3 || c.WritableLen() != 3 {
+		t.Fatalf("unexpected chain: %+v", c)
+	}
+
+	// Indirect descriptors are invalid unless the feature is accepted.
+	q = newQueue(t, mem, 0)
+
+	if _, err := q.Pop(); !errors.Is(err, queue.ErrInvalidChain) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The indirect table must not be followed by another descriptor.
+	q = newQueue(t, mem, queue.FeatureIndirectDesc)
+
+	setDesc(mem, 1, queue.Desc{Addr: 0x800, Len: 32, Flags: queue.DescFIndirect | queue.DescFNext, Next: 2})
+
+	if _, err := q.Pop(); !errors.Is(err, queue.ErrInvalidChain) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEventIdx(t *testing.T) {
+	t.Parallel()
+
+	const (
+		usedEvent  = avail + 4 + 2*size
+		availEvent = used + 4 + 8*size
+	)
+
+	mem := make([]byte, 0x4000)
+	q := newQueue(t, mem, queue.FeatureEventIdx)
+
+	for i := uint16(0); i < 4; i++ {
+		setDesc(mem, i, queue.Desc{Addr: 0x100, Len: 1})
+	}
+
+	makeAvailable(mem, 0, 1)
+
+	// The driver is asked to notify the next buffer after each Pop.
+	if _, err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := binary.LittleEndian.Uint16(mem[availEvent:]); e != 1 {
+		t.Fatalf("unexpected avail_event: %d", e)
+	}
+
+	// avail_event is left behind while the notification is disabled.
+	q.DisableNotification()
+
+	if _, err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := binary.LittleEndian.Uint16(mem[availEvent:]); e != 1 {
+		t.Fatalf("unexpected avail_event: %d", e)
+	}
+
+	if q.EnableNotification() || binary.LittleEndian.Uint16(mem[availEvent:]) != 2 {
+		t.Fatal("notification is not enabled")
+	}
+
+	// The driver wants the interrupt when the second buffer is used.
+	binary.LittleEndian.PutUint16(mem[usedEvent:], 1)
+
+	q.Push(0, 0)
+	q.Publish()
+
+	if q.NeedsInterrupt() {
+		t.Fatal("interrupt before used_event")
+	}
+
+	q.Push(1, 0)
+	q.Publish()
+
+	if !q.NeedsInterrupt() {
+		t.Fatal("no interrupt at used_event")
+	}
+
+	// The flags are ignored with EVENT_IDX.
+	if flags := binary.LittleEndian.Uint16(mem[used:]); flags != 0 {
+		t.Fatalf("unexpected flags of the used ring: 0x%x", flags)
+	}
+}
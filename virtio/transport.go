@@ -0,0 +1,318 @@
+package virtio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/eventfd"
+)
+
+// Bits of the interrupt status, which are shared with ISR of the legacy
+// interface.
+const (
+	// interruptVring is set when the used ring is updated.
+	interruptVring = 0x1
+
+	// interruptConfig is set when the device specific configuration is
+	// changed.
+	interruptConfig = 0x2
+)
+
+// QueueConfig is the configuration of a virt queue written by the driver.
+type QueueConfig struct {
+	Num                  uint32
+	Ready                bool
+	Desc, Driver, Device uint64
+}
+
+// TransportState is the state of a modern transport, MMIO or PCI, saved in a
+// snapshot of the VM.
+type TransportState struct {
+	DeviceFeaturesSel uint32
+	DriverFeaturesSel uint32
+	DriverFeatures    uint64
+	QueueSel          uint32
+	Queues            []QueueConfig
+	Status            uint32
+	InterruptStatus   uint32
+}
+
+// transport implements the registers common to the modern transports, which
+// differ only in the layout of the registers. It is given to the device as
+// its IRQInjector, so that the interrupt status is set before the interrupt
+// is injected by irqInjector.
+type transport struct {
+	dev         Device
+	irqInjector IRQInjector
+
+	// mu protects s except for InterruptStatus, which is protected by isrMu
+	// since the device updates it while holding its own lock.
+	mu    sync.Mutex
+	s     TransportState
+	isrMu sync.Mutex
+}
+
+func newTransport(dev Device, irqInjector IRQInjector) transport {
+	return transport{
+		dev:         dev,
+		irqInjector: irqInjector,
+		s:           resetState(dev),
+	}
+}
+
+// resetState returns the state after reset, where the virt queues have the
+// maximum number of entries of the device unless the driver makes them
+// smaller.
+func resetState(dev Device) TransportState {
+	s := TransportState{Queues: make([]QueueConfig, dev.NumQueues())}
+
+	for i := range s.Queues {
+		s.Queues[i].Num = uint32(dev.QueueNumMax())
+	}
+
+	return s
+}
+
+// InjectIRQ injects the interrupt of the device, telling the driver that the
+// used rings are updated.
+func (t *transport) InjectIRQ() {
+	t.setInterrupt(interruptVring)
+	t.irqInjector.InjectIRQ()
+}
+
+// InjectConfigIRQ injects the interrupt of the device, telling the driver
+// that the configuration is changed.
+func (t *transport) InjectConfigIRQ() {
+	t.setInterrupt(interruptConfig)
+	t.irqInjector.InjectIRQ()
+}
+
+func (t *transport) setInterrupt(isr uint32) {
+	t.isrMu.Lock()
+	defer t.isrMu.Unlock()
+
+	t.s.InterruptStatus |= isr
+}
+
+// interruptStatus returns the interrupt status, which is cleared if clear is
+// true as on reading ISR of PCI.
+func (t *transport) interruptStatus(clear bool) uint32 {
+	t.isrMu.Lock()
+	defer t.isrMu.Unlock()
+
+	isr := t.s.InterruptStatus
+	if clear {
+		t.s.InterruptStatus = 0
+	}
+
+	return isr
+}
+
+func (t *transport) ackInterrupt(isr uint32) {
+	t.isrMu.Lock()
+	defer t.isrMu.Unlock()
+
+	t.s.InterruptStatus &^= isr
+}
+
+// features returns the features offered to the driver. VERSION_1 is always
+// offered, since it is mandatory for the modern transports.
+func (t *transport) features() uint64 {
+	return t.dev.Features() | FeatureVersion1
+}
+
+// deviceFeatures returns the 32 bits of the features selected by
+// DeviceFeaturesSel. The caller must hold mu.
+func (t *transport) deviceFeatures() uint32 {
+	if t.s.DeviceFeaturesSel >= 2 {
+		return 0
+	}
+
+	return uint32(t.features() >> (32 * t.s.DeviceFeaturesSel))
+}
+
+// setDriverFeatures sets the 32 bits of the features selected by
+// DriverFeaturesSel. The caller must hold mu.
+func (t *transport) setDriverFeatures(v uint32) {
+	if t.s.DriverFeaturesSel >= 2 {
+		return
+	}
+
+	shift := 32 * t.s.DriverFeaturesSel
+	t.s.DriverFeatures = t.s.DriverFeatures&^(0xffffffff<<shift) | uint64(v)<<shift
+}
+
+// queue returns the virt queue selected by QueueSel, or nil if there is no
+// such queue. The caller must hold mu.
+func (t *transport) queue() *QueueConfig {
+	if int(t.s.QueueSel) >= len(t.s.Queues) {
+		return nil
+	}
+
+	return &t.s.Queues[t.s.QueueSel]
+}
+
+// setQueueReady maps or releases the virt queue selected by QueueSel. The
+// write to a nonexistent queue is ignored, and the invalid queue written by
+// the driver makes the device need reset instead of failing the VM. The
+// caller must hold mu.
+func (t *transport) setQueueReady(ready bool) {
+	q := t.queue()
+	if q == nil {
+		return
+	}
+
+	if !ready {
+		q.Ready = false
+		_ = t.dev.SetQueue(int(t.s.QueueSel), 0, 0, 0, 0)
+
+		return
+	}
+
+	// The driver may make the queue smaller than the maximum.
+	if q.Num == 0 || q.Num > uint32(t.dev.QueueNumMax()) {
+		t.setNeedsReset()
+
+		return
+	}
+
+	if err := t.dev.SetQueue(int(t.s.QueueSel), uint16(q.Num), q.Desc, q.Driver, q.Device); err != nil {
+		t.setNeedsReset()
+
+		return
+	}
+
+	q.Ready = true
+}
+
+// setNeedsReset sets DEVICE_NEEDS_RESET in the device status, which is
+// told to the driver by the configuration change interrupt once the device
+// is live. The caller must hold mu.
+func (t *transport) setNeedsReset() {
+	t.s.Status |= statusNeedsReset
+
+	if t.s.Status&statusDriverOK != 0 {
+		t.InjectConfigIRQ()
+	}
+}
+
+// setStatus sets the device status. Writing 0 resets the device, and
+// FEATURES_OK is not set if the driver accepts the features not offered,
+// and the device needs reset if it fails to use the features.
+// DEVICE_NEEDS_RESET is kept until the device is reset. The caller must hold
+// mu.
+func (t *transport) setStatus(status uint32) {
+	if status == 0 {
+		t.dev.Reset()
+
+		t.isrMu.Lock()
+		t.s = resetState(t.dev)
+		t.isrMu.Unlock()
+
+		return
+	}
+
+	if status&statusFeaturesOK != 0 && t.s.Status&statusFeaturesOK == 0 {
+		if t.s.DriverFeatures&^t.features() != 0 {
+			status &^= statusFeaturesOK
+		} else if err := t.dev.SetDriverFeatures(t.s.DriverFeatures); err != nil {
+			status &^= statusFeaturesOK
+			t.setNeedsReset()
+		}
+	}
+
+	t.s.Status = status | t.s.Status&statusNeedsReset
+}
+
+// notify notifies the device of the virt queue sel if it is ready. The device
+// is notified without the lock, since it may wait for the device thread which
+// injects an interrupt.
+func (t *transport) notify(sel uint32) {
+	t.mu.Lock()
+	ready := int(sel) < len(t.s.Queues) && t.s.Queues[sel].Ready
+	t.mu.Unlock()
+
+	if ready {
+		t.dev.Notify(int(sel))
+	}
+}
+
+// ServeNotifyFD notifies the device of the virt queue sel each time the
+// eventfd is signaled, which KVM does on the write to NotifyAddr of the
+// transport instead of exiting to userspace. It returns when waiting for the
+// eventfd fails.
+func (t *transport) ServeNotifyFD(sel int, e *eventfd.EventFD) {
+	for {
+		if _, err := e.Wait(); err != nil {
+			return
+		}
+
+		t.notify(uint32(sel))
+	}
+}
+
+// DriverStatus returns the device status written by the driver.
+func (t *transport) DriverStatus() uint8 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return uint8(t.s.Status)
+}
+
+func (t *transport) State() TransportState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.isrMu.Lock()
+	defer t.isrMu.Unlock()
+
+	s := t.s
+	s.Queues = append([]QueueConfig{}, t.s.Queues...)
+
+	return s
+}
+
+// SetState restores the state, and maps the virt queues of the device unless
+// the driver has not started. The state of the device must be restored before
+// calling this.
+func (t *transport) SetState(s TransportState) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(s.Queues) != len(t.s.Queues) {
+		return fmt.Errorf("%w: %d queues", ErrInvalidQueue, len(s.Queues))
+	}
+
+	t.isrMu.Lock()
+	t.s = s
+	t.s.Queues = append([]QueueConfig{}, s.Queues...)
+	t.isrMu.Unlock()
+
+	// The device is driven by the legacy interface of PCI, whose state is
+	// restored with the device.
+	if s.Status == 0 {
+		return nil
+	}
+
+	features := uint64(0)
+	if s.Status&statusFeaturesOK != 0 {
+		features = s.DriverFeatures
+	}
+
+	if err := t.dev.SetDriverFeatures(features); err != nil {
+		return err
+	}
+
+	for i, q := range s.Queues {
+		desc, avail, used := uint64(0), uint64(0), uint64(0)
+		if q.Ready {
+			desc, avail, used = q.Desc, q.Driver, q.Device
+		}
+
+		if err := t.dev.SetQueue(i, uint16(q.Num), desc, avail, used); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}